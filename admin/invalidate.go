@@ -0,0 +1,69 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"nursor-envoy-rpc/service"
+	"strconv"
+)
+
+// InvalidateSecretHeader carries the shared secret InvalidateUserHandler
+// requires.
+const InvalidateSecretHeader = "X-Admin-Secret"
+
+// InvalidateUserHandler publishes a user cache invalidation. It takes POST
+// requests carrying secret in InvalidateSecretHeader and naming the user
+// either in a JSON body ({"user_id": 42}, {"token": "..."} or
+// {"token_hash": "..."}) or in the user_id / token_hash query parameters.
+// Tokens are only read from the body so they stay out of access logs. With
+// an empty secret every request is refused.
+func InvalidateUserHandler(secret string, publish func(ctx context.Context, inv service.UserInvalidation) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "use POST"})
+			return
+		}
+		if secret == "" {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "user invalidation is disabled: no secret configured"})
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(InvalidateSecretHeader)), []byte(secret)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "missing or wrong " + InvalidateSecretHeader})
+			return
+		}
+
+		var inv service.UserInvalidation
+		if id := r.URL.Query().Get("user_id"); id != "" {
+			n, err := strconv.Atoi(id)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid user_id"})
+				return
+			}
+			inv.UserID = n
+		}
+		if r.URL.Query().Has("token") {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "send token in the JSON body, not the query"})
+			return
+		}
+		inv.TokenHash = r.URL.Query().Get("token_hash")
+		if inv.UserID == 0 && inv.TokenHash == "" && r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&inv); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid body: " + err.Error()})
+				return
+			}
+		}
+		if err := inv.Validate(); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		if err := publish(r.Context(), inv); err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"invalidated": true, "user_id": inv.UserID})
+	})
+}
@@ -0,0 +1,112 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"nursor-envoy-rpc/healthcheck"
+	"nursor-envoy-rpc/processor"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Server is the admin HTTP endpoint: liveness, readiness, Prometheus
+// metrics, optional pprof and a view of the open streams. It listens
+// separately from the gRPC port so probes and profiling never compete with
+// Envoy traffic.
+type Server struct {
+	streams  *processor.Registry
+	monitor  *healthcheck.Monitor
+	draining atomic.Bool
+	mux      *http.ServeMux
+}
+
+// NewServer returns the admin handlers for the given stream registry and
+// dependency monitor.
+func NewServer(streams *processor.Registry, monitor *healthcheck.Monitor) *Server {
+	s := &Server{streams: streams, monitor: monitor, mux: http.NewServeMux()}
+	s.mux.HandleFunc("/healthz", s.healthz)
+	s.mux.HandleFunc("/readyz", s.readyz)
+	s.mux.HandleFunc("/debug/streams", s.debugStreams)
+	s.mux.Handle("/metrics", promhttp.Handler())
+	return s
+}
+
+// EnablePprof serves Go pprof under /debug/pprof/. It is off by default
+// since profiles expose memory contents and command lines.
+func (s *Server) EnablePprof() {
+	s.mux.HandleFunc("/debug/pprof/", pprof.Index)
+	s.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	s.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	s.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	s.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// Handle registers an extra handler on the admin mux.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// SetDraining makes readiness fail so no new traffic is routed here while
+// the process shuts down.
+func (s *Server) SetDraining() {
+	s.draining.Store(true)
+}
+
+// healthz only reports that the process is alive and serving HTTP.
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok\n"))
+}
+
+type readiness struct {
+	Ready        bool              `json:"ready"`
+	Draining     bool              `json:"draining,omitempty"`
+	Dependencies map[string]string `json:"dependencies"`
+}
+
+// readyz turns green once every dependency has been reached at least once
+// and stays green until shutdown; later outages are reported by the grpc
+// health service so Envoy can fail open instead of losing all endpoints.
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	results, _ := s.monitor.Results()
+	state := readiness{
+		Draining:     s.draining.Load(),
+		Dependencies: make(map[string]string, len(results)),
+	}
+	for name, err := range results {
+		state.Dependencies[name] = "ok"
+		if err != nil {
+			state.Dependencies[name] = err.Error()
+		}
+	}
+	state.Ready = s.monitor.Started() && !state.Draining
+
+	status := http.StatusOK
+	if !state.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, state)
+}
+
+func (s *Server) debugStreams(w http.ResponseWriter, r *http.Request) {
+	streams := s.streams.Snapshot()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"count":   len(streams),
+		"streams": streams,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
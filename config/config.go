@@ -0,0 +1,115 @@
+package config
+
+import (
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+//go:embed default_rules.yaml
+var defaultRules []byte
+
+// Config is the declarative routing configuration evaluated per stream.
+type Config struct {
+	// Version identifies the config in logs and metrics. When the file
+	// does not set one, a checksum of its content is used.
+	Version string `yaml:"version" json:"version"`
+	// ProcessingMode is the processing_mode configured on the Envoy
+	// filter; rule mode overrides are applied on top of it.
+	ProcessingMode *Mode             `yaml:"processing_mode" json:"processing_mode"`
+	Record         RecordSettings    `yaml:"record" json:"record"`
+	Redact         RedactSettings    `yaml:"redact" json:"redact"`
+	RateLimit      RateLimitSettings `yaml:"rate_limit" json:"rate_limit"`
+	Auth           AuthSettings      `yaml:"auth" json:"auth"`
+	Rules          []Rule            `yaml:"rules" json:"rules"`
+}
+
+// Load reads the rules file named by RULES_FILE, falling back to the rules
+// built into the binary when it is unset.
+func Load() (*Config, error) {
+	path := os.Getenv("RULES_FILE")
+	if path == "" {
+		return Parse(defaultRules, ".yaml")
+	}
+	return LoadFile(path)
+}
+
+// LoadFile reads and validates a YAML or JSON rules file.
+func LoadFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules file: %w", err)
+	}
+	return Parse(data, filepath.Ext(path))
+}
+
+// Parse decodes and validates rules. ext selects the format: ".json" for
+// JSON, anything else is treated as YAML.
+func Parse(data []byte, ext string) (*Config, error) {
+	var cfg Config
+	var err error
+	if strings.EqualFold(ext, ".json") {
+		err = json.Unmarshal(data, &cfg)
+	} else {
+		err = yaml.UnmarshalStrict(data, &cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse rules: %w", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Version == "" {
+		sum := sha256.Sum256(data)
+		cfg.Version = "sha256:" + hex.EncodeToString(sum[:6])
+	}
+	return &cfg, nil
+}
+
+// Validate checks every rule and compiles its regular expressions.
+func (c *Config) Validate() error {
+	if err := c.ProcessingMode.validate(); err != nil {
+		return fmt.Errorf("processing_mode: %w", err)
+	}
+	if err := c.Record.validate(); err != nil {
+		return fmt.Errorf("record: %w", err)
+	}
+	if err := c.Redact.validate(); err != nil {
+		return fmt.Errorf("redact: %w", err)
+	}
+	if err := c.RateLimit.validate(); err != nil {
+		return fmt.Errorf("rate_limit: %w", err)
+	}
+	if err := c.Auth.validate(); err != nil {
+		return fmt.Errorf("auth: %w", err)
+	}
+	names := map[string]bool{}
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		if err := rule.validate(); err != nil {
+			return err
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("duplicate rule name %q", rule.Name)
+		}
+		names[rule.Name] = true
+	}
+	return nil
+}
+
+// MatchRule returns the first rule matching the request headers, or nil.
+func (c *Config) MatchRule(headers map[string]string) *Rule {
+	for i := range c.Rules {
+		if c.Rules[i].Match.Matches(headers) {
+			return &c.Rules[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package config
+
+import (
+	"fmt"
+
+	filterv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_proc/v3"
+)
+
+// Mode describes which ext_proc phases Envoy sends us. Header and trailer
+// fields take "send" or "skip"; body fields take "none", "streamed",
+// "buffered" or "buffered_partial". Empty fields inherit.
+type Mode struct {
+	ResponseHeaders  string `yaml:"response_headers" json:"response_headers"`
+	RequestBody      string `yaml:"request_body" json:"request_body"`
+	ResponseBody     string `yaml:"response_body" json:"response_body"`
+	RequestTrailers  string `yaml:"request_trailers" json:"request_trailers"`
+	ResponseTrailers string `yaml:"response_trailers" json:"response_trailers"`
+}
+
+// defaultMode mirrors the processing_mode of the Envoy filter config. A
+// mode override replaces the whole mode, so the fields a rule leaves unset
+// must be filled in from here.
+var defaultMode = Mode{
+	ResponseHeaders:  "send",
+	RequestBody:      "streamed",
+	ResponseBody:     "streamed",
+	RequestTrailers:  "skip",
+	ResponseTrailers: "skip",
+}
+
+var headerModes = map[string]filterv3.ProcessingMode_HeaderSendMode{
+	"send": filterv3.ProcessingMode_SEND,
+	"skip": filterv3.ProcessingMode_SKIP,
+}
+
+var bodyModes = map[string]filterv3.ProcessingMode_BodySendMode{
+	"none":             filterv3.ProcessingMode_NONE,
+	"streamed":         filterv3.ProcessingMode_STREAMED,
+	"buffered":         filterv3.ProcessingMode_BUFFERED,
+	"buffered_partial": filterv3.ProcessingMode_BUFFERED_PARTIAL,
+}
+
+func (m *Mode) validate() error {
+	if m == nil {
+		return nil
+	}
+	for name, v := range map[string]string{
+		"response_headers":  m.ResponseHeaders,
+		"request_trailers":  m.RequestTrailers,
+		"response_trailers": m.ResponseTrailers,
+	} {
+		if _, ok := headerModes[v]; v != "" && !ok {
+			return fmt.Errorf("%s: unknown header mode %q", name, v)
+		}
+	}
+	for name, v := range map[string]string{
+		"request_body":  m.RequestBody,
+		"response_body": m.ResponseBody,
+	} {
+		if _, ok := bodyModes[v]; v != "" && !ok {
+			return fmt.Errorf("%s: unknown body mode %q", name, v)
+		}
+	}
+	return nil
+}
+
+// merge returns m with its empty fields taken from base.
+func (m Mode) merge(base Mode) Mode {
+	pick := func(v, fallback string) string {
+		if v != "" {
+			return v
+		}
+		return fallback
+	}
+	return Mode{
+		ResponseHeaders:  pick(m.ResponseHeaders, base.ResponseHeaders),
+		RequestBody:      pick(m.RequestBody, base.RequestBody),
+		ResponseBody:     pick(m.ResponseBody, base.ResponseBody),
+		RequestTrailers:  pick(m.RequestTrailers, base.RequestTrailers),
+		ResponseTrailers: pick(m.ResponseTrailers, base.ResponseTrailers),
+	}
+}
+
+// ModeOverride returns the mode_override to send for rule, or nil when the
+// rule does not change the processing mode.
+func (c *Config) ModeOverride(rule *Rule) *filterv3.ProcessingMode {
+	if rule == nil || rule.Action.Mode == nil {
+		return nil
+	}
+	base := defaultMode
+	if c.ProcessingMode != nil {
+		base = c.ProcessingMode.merge(defaultMode)
+	}
+	m := rule.Action.Mode.merge(base)
+	return &filterv3.ProcessingMode{
+		RequestHeaderMode:   filterv3.ProcessingMode_SEND,
+		ResponseHeaderMode:  headerModes[m.ResponseHeaders],
+		RequestBodyMode:     bodyModes[m.RequestBody],
+		ResponseBodyMode:    bodyModes[m.ResponseBody],
+		RequestTrailerMode:  headerModes[m.RequestTrailers],
+		ResponseTrailerMode: headerModes[m.ResponseTrailers],
+	}
+}
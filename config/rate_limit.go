@@ -0,0 +1,138 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// Path classes requests are rate limited by.
+const (
+	PathClassChat       = "chat"
+	PathClassCompletion = "completion"
+	PathClassOther      = "other"
+)
+
+// DefaultMembership is the rate_limit.limits entry used for membership types
+// that have no entry of their own.
+const DefaultMembership = "default"
+
+// RateLimitSettings limits how many requests each user may start. Limits
+// are keyed by membership type, then path class:
+//
+//	rate_limit:
+//	  limits:
+//	    default: {chat: {requests: 30, window: 1m}}
+//	    Free:    {chat: {requests: 10, window: 1m}, completion: {requests: 300, window: 1m}}
+//
+// A class missing for a membership falls back to the "default" entry; a
+// class with no limit anywhere is not limited.
+//
+// MaxStreams caps the streams a user holds open at once, again by
+// membership type with a "default" fallback. Open streams are leases that
+// expire after StreamLease (default 1m) unless renewed.
+type RateLimitSettings struct {
+	Limits      map[string]map[string]*RateLimit `yaml:"limits" json:"limits"`
+	MaxStreams  map[string]int                   `yaml:"max_streams" json:"max_streams"`
+	StreamLease string                           `yaml:"stream_lease" json:"stream_lease"`
+
+	streamLease time.Duration
+}
+
+// DefaultStreamLease is how long a stream slot lives without renewal.
+const DefaultStreamLease = time.Minute
+
+// RateLimit allows Requests requests per sliding Window. Zero requests
+// means unlimited.
+type RateLimit struct {
+	Requests int    `yaml:"requests" json:"requests"`
+	Window   string `yaml:"window" json:"window"`
+
+	window time.Duration
+}
+
+// WindowDuration returns the parsed window.
+func (l *RateLimit) WindowDuration() time.Duration {
+	return l.window
+}
+
+func (r *RateLimitSettings) validate() error {
+	for membership, classes := range r.Limits {
+		for class, limit := range classes {
+			switch class {
+			case PathClassChat, PathClassCompletion, PathClassOther:
+			default:
+				return fmt.Errorf("%s: unknown path class %q", membership, class)
+			}
+			if limit == nil {
+				return fmt.Errorf("%s.%s: missing limit", membership, class)
+			}
+			if limit.Requests < 0 {
+				return fmt.Errorf("%s.%s: requests must not be negative", membership, class)
+			}
+			if limit.Requests == 0 {
+				continue
+			}
+			window, err := time.ParseDuration(limit.Window)
+			if err != nil {
+				return fmt.Errorf("%s.%s: window: %w", membership, class, err)
+			}
+			if window < time.Millisecond {
+				return fmt.Errorf("%s.%s: window must be at least 1ms", membership, class)
+			}
+			limit.window = window
+		}
+	}
+	for membership, max := range r.MaxStreams {
+		if max < 0 {
+			return fmt.Errorf("max_streams.%s must not be negative", membership)
+		}
+	}
+	r.streamLease = DefaultStreamLease
+	if r.StreamLease != "" {
+		lease, err := time.ParseDuration(r.StreamLease)
+		if err != nil {
+			return fmt.Errorf("stream_lease: %w", err)
+		}
+		if lease < 3*time.Millisecond {
+			return fmt.Errorf("stream_lease must be at least 3ms")
+		}
+		r.streamLease = lease
+	}
+	return nil
+}
+
+// RateLimitFor returns the limit for requests of class by users of
+// membership, or nil when they are not limited.
+func (c *Config) RateLimitFor(membership, class string) *RateLimit {
+	if c == nil {
+		return nil
+	}
+	limit, ok := c.RateLimit.Limits[membership][class]
+	if !ok {
+		limit = c.RateLimit.Limits[DefaultMembership][class]
+	}
+	if limit == nil || limit.Requests == 0 {
+		return nil
+	}
+	return limit
+}
+
+// MaxStreamsFor returns how many streams users of membership may hold open
+// at once; zero means no cap.
+func (c *Config) MaxStreamsFor(membership string) int {
+	if c == nil {
+		return 0
+	}
+	if max, ok := c.RateLimit.MaxStreams[membership]; ok {
+		return max
+	}
+	return c.RateLimit.MaxStreams[DefaultMembership]
+}
+
+// StreamLeaseTTL returns how long a stream slot lives without renewal.
+func (c *Config) StreamLeaseTTL() time.Duration {
+	if c == nil || c.RateLimit.streamLease == 0 {
+		return DefaultStreamLease
+	}
+	return c.RateLimit.streamLease
+}
@@ -0,0 +1,192 @@
+package config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Rule pairs a match condition with the action taken for matching streams.
+// Rules are evaluated in file order and the first match wins.
+type Rule struct {
+	Name   string `yaml:"name" json:"name"`
+	Match  Match  `yaml:"match" json:"match"`
+	Action Action `yaml:"action" json:"action"`
+}
+
+// Match describes which requests a rule applies to. All set conditions must
+// hold; an empty Match matches every request.
+type Match struct {
+	Authority      *StringMatch `yaml:"authority" json:"authority"`
+	Path           *StringMatch `yaml:"path" json:"path"`
+	Methods        []string     `yaml:"methods" json:"methods"`
+	HeadersPresent []string     `yaml:"headers_present" json:"headers_present"`
+	// Invert negates the whole match, e.g. "authority is not cursor".
+	Invert bool `yaml:"invert" json:"invert"`
+}
+
+// StringMatch matches a header value. Exactly one field should be set.
+type StringMatch struct {
+	Exact    string `yaml:"exact" json:"exact"`
+	Prefix   string `yaml:"prefix" json:"prefix"`
+	Suffix   string `yaml:"suffix" json:"suffix"`
+	Contains string `yaml:"contains" json:"contains"`
+	Regex    string `yaml:"regex" json:"regex"`
+
+	re *regexp.Regexp
+}
+
+// Action is what happens to a matching stream.
+type Action struct {
+	// Passthrough lets the request through untouched and stops processing
+	// the stream.
+	Passthrough bool `yaml:"passthrough" json:"passthrough"`
+	// Respond answers the request directly without contacting upstream.
+	Respond       *Respond          `yaml:"respond" json:"respond"`
+	SetHeaders    map[string]string `yaml:"set_headers" json:"set_headers"`
+	RemoveHeaders []string          `yaml:"remove_headers" json:"remove_headers"`
+	// Record controls whether the stream is pushed as an HttpRecord.
+	// Unset means record.
+	Record *bool `yaml:"record" json:"record"`
+	// Mode overrides which later phases Envoy sends for this stream, e.g.
+	// skipping bodies we neither record nor inspect.
+	Mode *Mode `yaml:"mode" json:"mode"`
+}
+
+// Respond is an immediate response. A zero Status leaves the code to Envoy.
+type Respond struct {
+	Status     int               `yaml:"status" json:"status"`
+	Body       string            `yaml:"body" json:"body"`
+	BodyBase64 string            `yaml:"body_base64" json:"body_base64"`
+	Headers    map[string]string `yaml:"headers" json:"headers"`
+
+	body string
+}
+
+// ResponseBody returns the decoded body of the response.
+func (r *Respond) ResponseBody() string {
+	return r.body
+}
+
+// ShouldRecord reports whether matching streams are recorded.
+func (a *Action) ShouldRecord() bool {
+	return a.Record == nil || *a.Record
+}
+
+func (r *Rule) validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("rule has no name")
+	}
+	if err := r.Match.Authority.compile(); err != nil {
+		return fmt.Errorf("rule %s: authority: %w", r.Name, err)
+	}
+	if err := r.Match.Path.compile(); err != nil {
+		return fmt.Errorf("rule %s: path: %w", r.Name, err)
+	}
+	if err := r.Action.Mode.validate(); err != nil {
+		return fmt.Errorf("rule %s: mode: %w", r.Name, err)
+	}
+	if r.Action.Passthrough && r.Action.Respond != nil {
+		return fmt.Errorf("rule %s: passthrough and respond are mutually exclusive", r.Name)
+	}
+	if resp := r.Action.Respond; resp != nil {
+		if resp.Status != 0 && (resp.Status < 100 || resp.Status > 599) {
+			return fmt.Errorf("rule %s: invalid status %d", r.Name, resp.Status)
+		}
+		if resp.Body != "" && resp.BodyBase64 != "" {
+			return fmt.Errorf("rule %s: body and body_base64 are mutually exclusive", r.Name)
+		}
+		resp.body = resp.Body
+		if resp.BodyBase64 != "" {
+			decoded, err := base64.StdEncoding.DecodeString(resp.BodyBase64)
+			if err != nil {
+				return fmt.Errorf("rule %s: body_base64: %w", r.Name, err)
+			}
+			resp.body = string(decoded)
+		}
+	}
+	for i, m := range r.Match.Methods {
+		r.Match.Methods[i] = strings.ToUpper(m)
+	}
+	for i, h := range r.Match.HeadersPresent {
+		r.Match.HeadersPresent[i] = strings.ToLower(h)
+	}
+	return nil
+}
+
+// Matches reports whether the request headers (keyed by lower-cased name,
+// pseudo-headers included) satisfy the match.
+func (m *Match) Matches(headers map[string]string) bool {
+	return m.matches(headers) != m.Invert
+}
+
+func (m *Match) matches(headers map[string]string) bool {
+	if !m.Authority.matches(headers[":authority"]) {
+		return false
+	}
+	if !m.Path.matches(headers[":path"]) {
+		return false
+	}
+	if len(m.Methods) > 0 {
+		method := strings.ToUpper(headers[":method"])
+		found := false
+		for _, want := range m.Methods {
+			if want == method {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, name := range m.HeadersPresent {
+		if _, ok := headers[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *StringMatch) compile() error {
+	if s == nil {
+		return nil
+	}
+	set := 0
+	for _, v := range []string{s.Exact, s.Prefix, s.Suffix, s.Contains, s.Regex} {
+		if v != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("exactly one of exact, prefix, suffix, contains, regex must be set")
+	}
+	if s.Regex != "" {
+		re, err := regexp.Compile(s.Regex)
+		if err != nil {
+			return err
+		}
+		s.re = re
+	}
+	return nil
+}
+
+func (s *StringMatch) matches(value string) bool {
+	if s == nil {
+		return true
+	}
+	switch {
+	case s.Exact != "":
+		return value == s.Exact
+	case s.Prefix != "":
+		return strings.HasPrefix(value, s.Prefix)
+	case s.Suffix != "":
+		return strings.HasSuffix(value, s.Suffix)
+	case s.Contains != "":
+		return strings.Contains(value, s.Contains)
+	case s.re != nil:
+		return s.re.MatchString(value)
+	}
+	return false
+}
@@ -0,0 +1,170 @@
+package config
+
+import (
+	"fmt"
+	"nursor-envoy-rpc/models/nursor"
+	"nursor-envoy-rpc/redact"
+	"os"
+	"time"
+)
+
+// RecordSettings bounds how much of each body an HttpRecord keeps.
+type RecordSettings struct {
+	// MaxBodyBytes caps the captured bytes per body. Zero uses the
+	// built-in default (4 MiB); a negative value disables the cap.
+	MaxBodyBytes int64 `yaml:"max_body_bytes" json:"max_body_bytes"`
+	// MemoryBodyBytes is how much of a body stays in memory before it is
+	// spilled to a temp file. Zero keeps everything in memory.
+	MemoryBodyBytes int64 `yaml:"memory_body_bytes" json:"memory_body_bytes"`
+	// SpillDir is where spill files go; empty means the system temp dir.
+	SpillDir string `yaml:"spill_dir" json:"spill_dir"`
+}
+
+func (r *RecordSettings) validate() error {
+	if r.MemoryBodyBytes < 0 {
+		return fmt.Errorf("memory_body_bytes must not be negative")
+	}
+	if r.SpillDir != "" {
+		info, err := os.Stat(r.SpillDir)
+		if err != nil {
+			return fmt.Errorf("spill_dir: %w", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("spill_dir: %s is not a directory", r.SpillDir)
+		}
+	}
+	return nil
+}
+
+// RedactSettings extends the built-in redaction policy; secrets can be
+// added but the defaults (authorization, nursor-token, x-client-key, ...)
+// are always redacted.
+type RedactSettings struct {
+	// Headers are extra header names whose values are fingerprinted.
+	Headers []string `yaml:"headers" json:"headers"`
+	// BodyPatterns are extra regular expressions whose matches in bodies
+	// and log messages are fingerprinted.
+	BodyPatterns []string `yaml:"body_patterns" json:"body_patterns"`
+
+	policy *redact.Policy
+}
+
+func (r *RedactSettings) validate() error {
+	policy, err := redact.NewPolicy(r.Headers, r.BodyPatterns)
+	if err != nil {
+		return err
+	}
+	r.policy = policy
+	return nil
+}
+
+// Redaction returns the redaction policy of the config.
+func (c *Config) Redaction() *redact.Policy {
+	if c == nil || c.Redact.policy == nil {
+		return redact.Current()
+	}
+	return c.Redact.policy
+}
+
+// BodyLimits returns the limits new records should use.
+func (c *Config) BodyLimits() nursor.BodyLimits {
+	limits := nursor.DefaultBodyLimits
+	if c == nil {
+		return limits
+	}
+	switch {
+	case c.Record.MaxBodyBytes < 0:
+		limits.MaxBytes = 0
+	case c.Record.MaxBodyBytes > 0:
+		limits.MaxBytes = c.Record.MaxBodyBytes
+	}
+	limits.MemoryBytes = c.Record.MemoryBodyBytes
+	limits.SpillDir = c.Record.SpillDir
+	return limits
+}
+
+// AuthSettings controls the lockout of clients that keep sending unknown
+// tokens. A client is identified by its address in x-forwarded-for.
+type AuthSettings struct {
+	// TrustedHops is how many proxies in front of Envoy append to
+	// x-forwarded-for; the client address is the entry before theirs.
+	TrustedHops int `yaml:"trusted_hops" json:"trusted_hops"`
+	// MaxFailures unknown tokens within FailureWindow lock the client out
+	// for Lockout. Zero uses the default of 10; a negative value disables
+	// the lockout.
+	MaxFailures   int    `yaml:"max_failures" json:"max_failures"`
+	FailureWindow string `yaml:"failure_window" json:"failure_window"`
+	Lockout       string `yaml:"lockout" json:"lockout"`
+
+	failureWindow time.Duration
+	lockout       time.Duration
+}
+
+// Defaults for AuthSettings.
+const (
+	DefaultMaxAuthFailures   = 10
+	DefaultAuthFailureWindow = 10 * time.Minute
+	DefaultAuthLockout       = 15 * time.Minute
+)
+
+func (a *AuthSettings) validate() error {
+	if a.TrustedHops < 0 {
+		return fmt.Errorf("trusted_hops must not be negative")
+	}
+	var err error
+	if a.failureWindow, err = parseDurationOr(a.FailureWindow, DefaultAuthFailureWindow); err != nil {
+		return fmt.Errorf("failure_window: %w", err)
+	}
+	if a.lockout, err = parseDurationOr(a.Lockout, DefaultAuthLockout); err != nil {
+		return fmt.Errorf("lockout: %w", err)
+	}
+	return nil
+}
+
+// AuthLockout returns the failed authentication limit: max failures per
+// window lock a client out for lockout. max is zero when it is disabled.
+func (c *Config) AuthLockout() (max int, window, lockout time.Duration) {
+	if c == nil {
+		return DefaultMaxAuthFailures, DefaultAuthFailureWindow, DefaultAuthLockout
+	}
+	max = c.Auth.MaxFailures
+	switch {
+	case max < 0:
+		max = 0
+	case max == 0:
+		max = DefaultMaxAuthFailures
+	}
+	window, lockout = c.Auth.failureWindow, c.Auth.lockout
+	if window == 0 {
+		window = DefaultAuthFailureWindow
+	}
+	if lockout == 0 {
+		lockout = DefaultAuthLockout
+	}
+	return max, window, lockout
+}
+
+// TrustedHops returns how many x-forwarded-for entries were appended by
+// trusted proxies.
+func (c *Config) TrustedHops() int {
+	if c == nil {
+		return 0
+	}
+	return c.Auth.TrustedHops
+}
+
+// parseDurationOr parses value, returning def when it is empty. Durations
+// must be positive.
+func parseDurationOr(value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("must be positive")
+	}
+	return d, nil
+}
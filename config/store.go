@@ -0,0 +1,118 @@
+package config
+
+import (
+	"context"
+	"nursor-envoy-rpc/logger"
+	"nursor-envoy-rpc/metrics"
+	"nursor-envoy-rpc/redact"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Store holds the active configuration. Readers take a snapshot with
+// Current and keep using it for the whole stream; reloads swap in a new
+// pointer and never mutate a published Config.
+type Store struct {
+	current atomic.Pointer[Config]
+	path    string
+
+	mu      sync.Mutex
+	modTime time.Time
+}
+
+// NewStore publishes cfg as the active configuration. path is the file to
+// reload from; an empty path means the built-in rules, which never change.
+func NewStore(cfg *Config, path string) *Store {
+	s := &Store{path: path}
+	if path != "" {
+		if info, err := os.Stat(path); err == nil {
+			s.modTime = info.ModTime()
+		}
+	}
+	s.publish(cfg)
+	return s
+}
+
+// Current returns the configuration snapshot new streams should use.
+func (s *Store) Current() *Config {
+	return s.current.Load()
+}
+
+// Reload re-reads the config file. A file that fails to parse or validate
+// is rejected and the previous configuration stays active.
+func (s *Store) Reload() error {
+	if s.path == "" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Remember the mtime even for a rejected file so polling does not retry
+	// it until it changes again.
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+	cfg, err := LoadFile(s.path)
+	if err != nil {
+		metrics.ConfigReloads.WithLabelValues("invalid").Inc()
+		logger.L().Infof("Rejected config reload from %s, keeping version %s: %v", s.path, s.Current().Version, err)
+		return err
+	}
+	previous := s.Current().Version
+	s.publish(cfg)
+	metrics.ConfigReloads.WithLabelValues("success").Inc()
+	logger.L().Infof("Reloaded config from %s: version %s -> %s (%d rules)", s.path, previous, cfg.Version, len(cfg.Rules))
+	return nil
+}
+
+// Watch reloads on SIGHUP and, when interval is positive, whenever the
+// file's modification time changes. It returns when ctx is done.
+func (s *Store) Watch(ctx context.Context, interval time.Duration) {
+	if s.path == "" {
+		return
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			logger.L().Info("Received SIGHUP, reloading config")
+			s.Reload()
+		case <-tick:
+			if s.changed() {
+				s.Reload()
+			}
+		}
+	}
+}
+
+func (s *Store) changed() bool {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !info.ModTime().Equal(s.modTime)
+}
+
+func (s *Store) publish(cfg *Config) {
+	s.current.Store(cfg)
+	redact.SetCurrent(cfg.Redaction())
+	metrics.SetConfigVersion(cfg.Version)
+}
@@ -0,0 +1,139 @@
+package healthcheck
+
+import (
+	"context"
+	"nursor-envoy-rpc/logger"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// ExtProcService is the service name Envoy's gRPC health check asks for.
+const ExtProcService = "envoy.service.ext_proc.v3.ExternalProcessor"
+
+// Probe checks one dependency. Its Name is also the health service name
+// reported for it, so individual dependencies can be queried.
+type Probe struct {
+	Name string
+	// Critical probes take the whole server to NOT_SERVING when they fail.
+	Critical bool
+	Check    func(ctx context.Context) error
+}
+
+// Monitor runs the probes periodically and publishes their status on a
+// grpc health server: one entry per probe, plus the overall status under ""
+// and ExtProcService.
+type Monitor struct {
+	server  *health.Server
+	probes  []Probe
+	timeout time.Duration
+
+	mu      sync.RWMutex
+	results map[string]error
+	checked bool
+	// started latches once every probe has succeeded in the same round.
+	started bool
+}
+
+// NewMonitor returns a monitor that reports to server. Until the first
+// round of probes completes every service is NOT_SERVING.
+func NewMonitor(server *health.Server, timeout time.Duration, probes ...Probe) *Monitor {
+	m := &Monitor{
+		server:  server,
+		probes:  probes,
+		timeout: timeout,
+		results: make(map[string]error),
+	}
+	for _, p := range probes {
+		server.SetServingStatus(p.Name, healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+	m.setOverall(healthpb.HealthCheckResponse_NOT_SERVING)
+	return m
+}
+
+// Run probes every interval until ctx is done.
+func (m *Monitor) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		m.CheckNow(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckNow runs every probe once, concurrently, and publishes the results.
+func (m *Monitor) CheckNow(ctx context.Context) {
+	results := make([]error, len(m.probes))
+	var wg sync.WaitGroup
+	for i, p := range m.probes {
+		wg.Add(1)
+		go func(i int, p Probe) {
+			defer wg.Done()
+			probeCtx, cancel := context.WithTimeout(ctx, m.timeout)
+			defer cancel()
+			results[i] = p.Check(probeCtx)
+		}(i, p)
+	}
+	wg.Wait()
+
+	overall := healthpb.HealthCheckResponse_SERVING
+	allUp := true
+	m.mu.Lock()
+	for i, p := range m.probes {
+		err := results[i]
+		prev, seen := m.results[p.Name]
+		m.results[p.Name] = err
+		if (err == nil) != (prev == nil) || !seen {
+			if err != nil {
+				logger.L().Warnf("Dependency %s is down: %v", p.Name, err)
+			} else {
+				logger.L().Infof("Dependency %s is up", p.Name)
+			}
+		}
+
+		status := healthpb.HealthCheckResponse_SERVING
+		if err != nil {
+			allUp = false
+			status = healthpb.HealthCheckResponse_NOT_SERVING
+			if p.Critical {
+				overall = healthpb.HealthCheckResponse_NOT_SERVING
+			}
+		}
+		m.server.SetServingStatus(p.Name, status)
+	}
+	m.checked = true
+	m.started = m.started || allUp
+	m.mu.Unlock()
+	m.setOverall(overall)
+}
+
+// Results returns the last error of every probe, nil meaning healthy, and
+// whether any round has completed yet.
+func (m *Monitor) Results() (map[string]error, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	results := make(map[string]error, len(m.results))
+	for name, err := range m.results {
+		results[name] = err
+	}
+	return results, m.checked
+}
+
+// Started reports whether every dependency has been reachable at least
+// once, i.e. the process has finished starting up.
+func (m *Monitor) Started() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.started
+}
+
+func (m *Monitor) setOverall(status healthpb.HealthCheckResponse_ServingStatus) {
+	m.server.SetServingStatus("", status)
+	m.server.SetServingStatus(ExtProcService, status)
+}
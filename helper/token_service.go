@@ -2,15 +2,25 @@ package helper
 
 import (
 	"fmt"
+	"nursor-envoy-rpc/logger"
 	"os"
 
-	"github.com/sirupsen/logrus"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 )
 
-// GetNewDB is a placeholder for getting a new GORM DB connection.
+// GetNewDB opens the database and exits the process when it is unreachable.
 func GetNewDB() *gorm.DB {
+	db, err := OpenDB()
+	if err != nil {
+		logger.L().Fatalf("Failed to initialize database: %v", err)
+	}
+	return db
+}
+
+// OpenDB opens a GORM connection to the MySQL database configured in the
+// environment.
+func OpenDB() (*gorm.DB, error) {
 	// Implement GORM DB initialization (e.g., using models.InitDB)
 	MYSQL_HOST := os.Getenv("MYSQL_HOST")
 	MYSQL_PORT := os.Getenv("MYSQL_PORT")
@@ -33,9 +43,5 @@ func GetNewDB() *gorm.DB {
 		MYSQL_DATABASE = "nursorv2"
 	}
 	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=True&loc=Local", MYSQL_USER, MYSQL_PASSWORD, MYSQL_HOST, MYSQL_PORT, MYSQL_DATABASE)
-	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
-	if err != nil {
-		logrus.Fatalf("Failed to initialize database: %v", err)
-	}
-	return db
+	return gorm.Open(mysql.Open(dsn), &gorm.Config{})
 }
@@ -1,65 +1,162 @@
 package logger
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log"
+	"nursor-envoy-rpc/redact"
 	"os"
 	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
 	// 全局日志记录器
-	logger *log.Logger
+	base = newBase()
 	// 日志文件
 	logFile *os.File
 )
 
-func init() {
-	logger = log.New(os.Stdout, "", log.LstdFlags)
-	logger.SetFlags(log.LstdFlags | log.Lshortfile)
+// Fields are structured log fields.
+type Fields = logrus.Fields
+
+type fieldsKey struct{}
+
+func newBase() *logrus.Logger {
+	l := logrus.New()
+	l.SetOutput(os.Stdout)
+	l.SetFormatter(redactingFormatter{&logrus.TextFormatter{FullTimestamp: true}})
+	return l
 }
 
-func Info(v ...interface{}) {
-	log.Println(v...)
+// redactingFormatter applies the active redaction policy to the message and
+// fields of every entry before formatting it: fields named like a sensitive
+// header are fingerprinted, everything else has secret patterns replaced.
+type redactingFormatter struct {
+	logrus.Formatter
 }
 
-func Error(v ...interface{}) {
-	log.Println(v...)
-	fmt.Println(v...)
-	//sentry.CaptureMessage(fmt.Sprintf("%v", v...))
-	//go func() {
-	//	sentry.Flush(2 * time.Second)
-	//}()
+func (f redactingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	policy := redact.Current()
+	clean := *entry
+	clean.Message = policy.String(entry.Message)
+	clean.Data = make(logrus.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		switch v := value.(type) {
+		case string:
+			if policy.IsSensitive(key) {
+				value = redact.Fingerprint(v)
+			} else {
+				value = policy.String(v)
+			}
+		case error:
+			value = policy.String(v.Error())
+		}
+		clean.Data[key] = value
+	}
+	return f.Formatter.Format(&clean)
 }
 
-// 初始化日志记录器
+// Init configures the logger from the environment:
+//   - LOG_FORMAT: "text" (default) or "json";
+//   - LOG_LEVEL: a logrus level name, "info" by default;
+//   - LOG_FILE: also append to this file, e.g. ~/.nursor/app.log.
 func Init() error {
-	// 获取用户主目录
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		return fmt.Errorf("获取用户主目录失败: %v", err)
+	switch format := strings.ToLower(os.Getenv("LOG_FORMAT")); format {
+	case "", "text":
+		base.SetFormatter(redactingFormatter{&logrus.TextFormatter{FullTimestamp: true}})
+	case "json":
+		base.SetFormatter(redactingFormatter{&logrus.JSONFormatter{}})
+	default:
+		return fmt.Errorf("unknown LOG_FORMAT %q", format)
 	}
 
-	// 创建日志目录
-	logDir := filepath.Join(homeDir, ".nursor")
-	if err := os.MkdirAll(logDir, 0755); err != nil {
-		return fmt.Errorf("创建日志目录失败: %v", err)
+	if name := os.Getenv("LOG_LEVEL"); name != "" {
+		level, err := logrus.ParseLevel(name)
+		if err != nil {
+			return fmt.Errorf("LOG_LEVEL: %w", err)
+		}
+		base.SetLevel(level)
 	}
 
-	// 打开日志文件
-	logPath := filepath.Join(logDir, "app.log")
-	logFile, err = os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-	if err != nil {
-		return fmt.Errorf("打开日志文件失败: %v", err)
+	if logPath := os.Getenv("LOG_FILE"); logPath != "" {
+		// 创建日志目录
+		if err := os.MkdirAll(filepath.Dir(logPath), 0755); err != nil {
+			return fmt.Errorf("创建日志目录失败: %v", err)
+		}
+		// 打开日志文件
+		f, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("打开日志文件失败: %v", err)
+		}
+		logFile = f
+		base.SetOutput(io.MultiWriter(os.Stdout, logFile))
 	}
 
-	// 创建日志记录器
-	logger = log.New(logFile, "", log.LstdFlags)
-	logger.Printf("日志系统初始化成功，日志文件: %s", logPath)
-
+	// Libraries that use the standard logger end up here too.
+	log.SetFlags(0)
+	log.SetOutput(base.WriterLevel(logrus.InfoLevel))
 	return nil
 }
 
+// SetOutput redirects the logger, e.g. to capture lines in tests.
+func SetOutput(w io.Writer) {
+	base.SetOutput(w)
+}
+
+// L returns the logger without any context fields.
+func L() *logrus.Entry {
+	return logrus.NewEntry(base)
+}
+
+// WithFields returns a copy of ctx whose logger carries fields in addition
+// to those already attached.
+func WithFields(ctx context.Context, fields Fields) context.Context {
+	merged := Fields{}
+	for k, v := range FieldsFrom(ctx) {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, fieldsKey{}, merged)
+}
+
+// FieldsFrom returns the fields attached to ctx. The map must not be
+// modified.
+func FieldsFrom(ctx context.Context) Fields {
+	fields, _ := ctx.Value(fieldsKey{}).(Fields)
+	return fields
+}
+
+// FromContext returns a logger carrying the fields attached to ctx and, if
+// ctx is traced, the trace ID.
+func FromContext(ctx context.Context) *logrus.Entry {
+	entry := base.WithFields(FieldsFrom(ctx))
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		entry = entry.WithField("trace_id", sc.TraceID().String())
+	}
+	return entry
+}
+
+func Info(v ...interface{}) {
+	base.Info(v...)
+}
+
+func Error(v ...interface{}) {
+	base.Error(v...)
+	//sentry.CaptureMessage(fmt.Sprintf("%v", v...))
+	//go func() {
+	//	sentry.Flush(2 * time.Second)
+	//}()
+}
+
+// GetCustomLogger returns a standard library logger writing through the
+// structured logger at info level.
 func GetCustomLogger() *log.Logger {
-	return logger
+	return log.New(base.WriterLevel(logrus.InfoLevel), "", 0)
 }
@@ -2,414 +2,328 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"flag"
 	"io"
-	"log"
 	"net"
-	"nursor-envoy-rpc/models"
-	"nursor-envoy-rpc/models/nursor"
-
+	"net/http"
+	"nursor-envoy-rpc/admin"
+	"nursor-envoy-rpc/config"
+	"nursor-envoy-rpc/healthcheck"
+	"nursor-envoy-rpc/logger"
+	"nursor-envoy-rpc/metrics"
+	"nursor-envoy-rpc/processor"
 	"nursor-envoy-rpc/service"
-	"nursor-envoy-rpc/utils"
-	"strconv"
-	"strings"
+	"nursor-envoy-rpc/tracing"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/reflection"
 	"google.golang.org/grpc/status"
-	"google.golang.org/protobuf/types/known/wrapperspb"
 
-	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
 )
 
 type extProcServer struct {
 	extprocv3.UnimplementedExternalProcessorServer
+	chain      *processor.Chain
+	configs    *config.Store
+	streams    *processor.Registry
+	postStream *service.PostStreamPool
 }
 
 func (s *extProcServer) Process(stream extprocv3.ExternalProcessor_ProcessServer) error {
-	var httpRecrod = nursor.NewRequestRecord()
-	var isChatRequest = false
-	var isChatHasException = false
+	sc := processor.NewStreamContext(stream.Context(), s.configs.Current())
+	sc.OnTransition = func(from, to processor.Phase) {
+		sc.Log().Debugf("Stream phase %s -> %s", from, to)
+	}
 	timeA := time.Now()
+	s.streams.Update(sc)
+	defer s.streams.Remove(sc.ID)
+	defer sc.Cleanup()
+	defer sc.EndTrace()
+	metrics.StreamsActive.Inc()
 	defer func() {
-		// 异步处理
-		go func() {
-			log.Printf("Stream closed after %s", time.Since(timeA))
-			if httpRecrod != nil {
-				// Push HTTP record to external service
-				httpRecordService := service.GetHttpRecordInstance()
-				if err := httpRecordService.PushHttpRecord(context.Background(), httpRecrod); err != nil {
-					log.Printf("Failed to push HTTP record: %v", err)
-				}
-			}
-			if isChatRequest {
-				if !isChatHasException {
-					dispatcherService := service.GetDispatchInstance()
-					dispatcherService.IncrTokenUsage(context.Background(), httpRecrod.AccountId)
-				} else {
-					dispatcherService := service.GetDispatchInstance()
-					dispatcherService.HandleTokenExpired(context.Background(), httpRecrod.AccountId)
-				}
-
-			}
-		}()
+		metrics.StreamsActive.Dec()
+		reason := sc.CloseReason()
+		if reason == "" {
+			reason = "unknown"
+		}
+		metrics.StreamDuration.WithLabelValues(reason).Observe(time.Since(sc.StartedAt).Seconds())
+	}()
+	defer func() {
+		sc.Log().Infof("Stream closed after %s (reason: %s)", time.Since(timeA), sc.CloseReason())
+		// 记录推送和用量统计交给后台 worker 池异步处理
+		task := sc.PostStreamTask()
+		sc.Record.Close()
+		s.postStream.Submit(task)
 	}()
-
-	var account *models.AccountInfo
 
 	for {
 		req, err := stream.Recv()
-		ctx := stream.Context()
-		// ctx := context.Background()
 		if err == io.EOF {
-			log.Println("Stream closed by client")
+			sc.Log().Debug("Stream closed by client")
+			sc.Close(processor.CloseClientEOF)
 			return nil
 		}
 		if err != nil {
 			if status.Code(err) == codes.Canceled {
-				log.Println("Stream closed by envoy")
+				sc.Log().Debug("Stream closed by envoy")
+				sc.Close(processor.CloseEnvoyCanceled)
 				return nil
 			}
-			log.Printf("Error receiving from stream: %v", err)
+			sc.Log().Errorf("Error receiving from stream: %v", err)
+			sc.Close(processor.CloseRecvError)
 			return err
 		}
-		var user *models.User
-		var innerToken string
 
+		var resp *extprocv3.ProcessingResponse
+		var endStream bool
 		switch r := req.Request.(type) {
 		case *extprocv3.ProcessingRequest_RequestHeaders:
-			log.Println("Received request headers")
-			headers := r.RequestHeaders.GetHeaders()
-			isAuthHeaderExisted := false
-
-			// 从headers中提取nursor-token
+			sc.Log().Debug("Received request headers")
+			resp, endStream, err = s.chain.OnRequestHeaders(sc, r.RequestHeaders)
+		case *extprocv3.ProcessingRequest_RequestBody:
+			sc.Log().Debug("Received request body")
+			resp, endStream, err = s.chain.OnRequestBody(sc, r.RequestBody)
+		case *extprocv3.ProcessingRequest_ResponseHeaders:
+			sc.Log().Debug("Received response headers")
+			resp, endStream, err = s.chain.OnResponseHeaders(sc, r.ResponseHeaders)
+		case *extprocv3.ProcessingRequest_ResponseBody:
+			sc.Log().Debug("Received response body")
+			resp, endStream, err = s.chain.OnResponseBody(sc, r.ResponseBody)
+		case *extprocv3.ProcessingRequest_RequestTrailers:
+			resp, endStream, err = s.chain.OnTrailers(sc, processor.DirectionRequest, r.RequestTrailers)
+		case *extprocv3.ProcessingRequest_ResponseTrailers:
+			resp, endStream, err = s.chain.OnTrailers(sc, processor.DirectionResponse, r.ResponseTrailers)
+		default:
+			sc.Log().Warnf("Unhandled request type: %T (raw: %+v)", r, req)
+			resp = &extprocv3.ProcessingResponse{}
+		}
 
-			for _, h := range headers.Headers {
-				if strings.ToLower(h.Key) == "nursor-token" {
-					innerToken = string(h.RawValue)
-					userService := service.GetUserServiceInstance()
-					user, err = userService.GetUserByInnerToken(ctx, innerToken)
-					if err != nil {
-						log.Printf("Error getting user by inner token: %v", err)
-						return err
-					}
-					httpRecrod.UserId = user.ID
-					log.Printf("Found and set nursor-token: %s", innerToken)
-					break
-				}
+		s.streams.Update(sc)
+		if resp != nil {
+			if sendErr := stream.Send(resp); sendErr != nil {
+				sc.Log().Errorf("Error sending response: %v", sendErr)
+				sc.Close(processor.CloseSendError)
+				return sendErr
 			}
-			if user == nil {
-				log.Println("User not found")
-				resp := &extprocv3.ProcessingResponse{
-					Response: &extprocv3.ProcessingResponse_ImmediateResponse{
-						ImmediateResponse: &extprocv3.ImmediateResponse{},
-					},
-				}
-				return stream.Send(resp)
-			}
-
-			for _, h := range headers.Headers {
-				httpRecrod.AddRequestHeader(h.Key, string(h.RawValue))
-				if strings.Contains(h.Key, ":authority") {
-					httpRecrod.HttpVersion = "http/2.0"
-					if strings.Contains(string(h.RawValue), "metrics.cursor.sh") {
-						resp := &extprocv3.ProcessingResponse{
-							Response: &extprocv3.ProcessingResponse_ImmediateResponse{
-								ImmediateResponse: &extprocv3.ImmediateResponse{},
-							},
-						}
-
-						if err := stream.Send(resp); err != nil {
-							log.Printf("Error sending response: %v", err)
-							return err
-						}
-						return nil
-					} else if !strings.Contains(string(h.RawValue), "cursor.sh") && !strings.Contains(string(h.RawValue), "cursor.com") {
-						// log.Println("not cursor.sh or cursor.com", string(h.RawValue))
-						// 只处理cursor.sh和cursor.com的请求
-						resp := &extprocv3.ProcessingResponse{
-							Response: &extprocv3.ProcessingResponse_RequestHeaders{
-								RequestHeaders: &extprocv3.HeadersResponse{
-									Response: &extprocv3.CommonResponse{
-										HeaderMutation: &extprocv3.HeaderMutation{},
-									},
-								},
-							},
-						}
-
-						if err := stream.Send(resp); err != nil {
-							log.Printf("Error sending response: %v", err)
-							return err
-						}
-						return nil
-					}
-
-				} else if strings.Contains(h.Key, ":path") && strings.Contains(string(h.RawValue), "AuthService/GetEmail") {
-					resp := &extprocv3.ProcessingResponse{
-						Response: &extprocv3.ProcessingResponse_ImmediateResponse{
-							ImmediateResponse: &extprocv3.ImmediateResponse{
-								Body: string([]byte{
-									0x0a, 0x10, // 前两个字节
-									0x6a, 0x69, 0x6d, 0x6d, 0x79, 0x6c, 0x65, 0x65, // jimmylee
-									0x40,                                     // @
-									0x6d, 0x69, 0x74, 0x2e, 0x65, 0x64, 0x75, // mit.edu
-									0x10, 0x01, // 后两个字节
-								}),
-							},
-						},
-					}
+		}
+		if err != nil {
+			sc.Log().Warnf("Closing stream (%s): %v", sc.CloseReason(), err)
+			return err
+		}
+		if endStream {
+			return nil
+		}
+	}
+}
 
-					if err := stream.Send(resp); err != nil {
-						log.Printf("Error sending response: %v", err)
-						return err
-					}
-					return nil
-				} else if strings.Contains(h.Key, ":path") && strings.Contains(string(h.RawValue), "GetTeam") {
-					fmt.Print("in get Eamil")
-				} else if strings.Contains(h.Key, ":path") && strings.Contains(string(h.RawValue), "ReportBug") {
-					resp := &extprocv3.ProcessingResponse{
-						Response: &extprocv3.ProcessingResponse_ImmediateResponse{
-							ImmediateResponse: &extprocv3.ImmediateResponse{},
-						},
-					}
+func main() {
+	invalidateUser := flag.Int("invalidate-user", 0, "publish a user cache invalidation for this user ID and exit")
+	invalidateToken := flag.String("invalidate-token", "", "publish a user cache invalidation for this inner token and exit")
+	backfillTokenHashes := flag.Bool("backfill-token-hashes", false, "fill in user_user.inner_token_hash for every user and exit (the column must exist)")
+	flag.Parse()
 
-					if err := stream.Send(resp); err != nil {
-						log.Printf("Error sending response: %v", err)
-						return err
-					}
-					return nil
-				}
+	if err := logger.Init(); err != nil {
+		logger.L().Fatalf("Failed to set up logging: %v", err)
+	}
+	// token 哈希配置错误时立即退出，而不是等到首次查询用户时才发现
+	tokens, err := service.TokenHasherFromEnv()
+	if err != nil {
+		logger.L().Fatalf("Invalid INNER_TOKEN_HMAC_KEY / INNER_TOKEN_LOOKUP: %v", err)
+	}
+	logger.L().Infof("Inner token lookup mode: %s", tokens.Mode())
+	if *invalidateUser != 0 || *invalidateToken != "" {
+		publishInvalidation(service.UserInvalidation{UserID: *invalidateUser, Token: *invalidateToken})
+		return
+	}
+	if *backfillTokenHashes {
+		backfillTokens()
+		return
+	}
+	cfg, err := config.Load()
+	if err != nil {
+		logger.L().Fatalf("Failed to load routing rules: %v", err)
+	}
+	logger.L().Infof("Loaded %d routing rules (version %s)", len(cfg.Rules), cfg.Version)
+	configs := config.NewStore(cfg, os.Getenv("RULES_FILE"))
+	reloadInterval := durationFromEnv("RULES_RELOAD_INTERVAL", 10*time.Second)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	shutdownTracing, err := tracing.Init(ctx)
+	if err != nil {
+		logger.L().Fatalf("Failed to set up tracing: %v", err)
+	}
+	go configs.Watch(ctx, reloadInterval)
 
-				if strings.ToLower(h.Key) == "authorization" && strings.Contains(string(h.RawValue), ".") {
-					isAuthHeaderExisted = true
-					log.Println("Authorization header found and replaced")
+	listenAddr := os.Getenv("LISTEN_ADDR")
+	if listenAddr == "" {
+		listenAddr = ":8080"
+	}
+	lis, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		logger.L().Fatalf("Failed to listen on %v: %v", listenAddr, err)
+	}
 
-					userService := service.GetUserServiceInstance()
-					var userInfo *models.User
-					// userInfo, err := userService.CheckAndGetUserFromInnerToken(ctx, orgAuth)
-					// 新版本，使用用户数据库的绑定token
-					if innerToken != "" {
-						userInfo, err = userService.GetUserByInnerToken(ctx, innerToken)
-						if err != nil {
-							log.Printf("Error getting user by inner token: %v", err)
-							resp := utils.GetResponseForErr(err)
-							// 发送响应，终止流程
-							if err := stream.Send(resp); err != nil {
-								log.Printf("Failed to send immediate response: %v", err)
-							}
-							return err
-						}
-					}
+	postStreamOptions, err := service.PostStreamOptionsFromEnv()
+	if err != nil {
+		logger.L().Fatalf("Invalid post-stream pool settings: %v", err)
+	}
+	postStream, err := service.NewPostStreamPool(postStreamOptions, service.RunPostStreamTask)
+	if err != nil {
+		logger.L().Fatalf("Failed to set up post-stream pool: %v", err)
+	}
+	postStream.Start(service.GetBackgroundInstance())
 
-					dispatcherService := service.GetDispatchInstance()
-					account, err = dispatcherService.GetAccountByUserId(ctx, userInfo.ID)
-					if err != nil || account == nil {
-						log.Printf("Error dispatching token: %v", err)
-						resp := utils.GetResponseForErr(err)
-						// 发送响应，终止流程
-						if err := stream.Send(resp); err != nil {
-							log.Printf("Failed to send immediate response: %v", err)
-						}
-						return err
-					}
-					// Set account ID in HTTP record
-					httpRecrod.AccountId = account.ID
-				}
-				// 聊天请求单独处理
-				if strings.Contains(string(h.RawValue), "StreamUnifiedChatWithTools") {
-					isChatRequest = true
-				}
+	s := grpc.NewServer()
+	streams := processor.NewRegistry()
+	extprocv3.RegisterExternalProcessorServer(s, &extProcServer{chain: processor.NewDefaultChain(), configs: configs, streams: streams, postStream: postStream})
+	reflection.Register(s)
 
-				switch h.Key {
-				case ":method":
-					httpRecrod.Method = string(h.RawValue) // e.g., "POST"
-				case ":authority":
-					httpRecrod.Host = string(h.RawValue) // e.g., "cursor.sh"
-				case ":path":
-					// :path 包含路径和查询参数，需拼接 scheme 和 host 构成完整 URL
-					scheme := httpRecrod.RequestHeaders[":scheme"] // e.g., "http" or "https"
-					if scheme == "" {
-						scheme = "http" // 默认值
-					}
-					httpRecrod.Url = scheme + "://" + httpRecrod.Host + string(h.RawValue) // e.g., "http://cursor.sh/path?query"
-				case ":scheme":
-					// 用于 URL 拼接，单独处理
-					httpRecrod.AddRequestHeader(h.Key, string(h.RawValue))
-				default:
-					httpRecrod.RequestHeaders[h.Key] = string(h.RawValue)
-				}
+	// 依赖探测：MySQL 和 account manager 不可用时整体 NOT_SERVING，
+	// Envoy 的 failure_mode_allow 会放行请求；Redis 只是缓存，不影响整体状态
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(s, healthServer)
+	monitor := healthcheck.NewMonitor(healthServer, durationFromEnv("HEALTH_PROBE_TIMEOUT", 2*time.Second),
+		healthcheck.Probe{Name: "mysql", Critical: true, Check: func(ctx context.Context) error {
+			// 首次探测同时完成 UserService 的初始化，失败时下次重试而不是退出
+			userService, err := service.InitUserService(ctx)
+			if err != nil {
+				return err
 			}
+			return userService.PingDB(ctx)
+		}},
+		healthcheck.Probe{Name: "redis", Check: func(ctx context.Context) error {
+			userService, err := service.InitUserService(ctx)
+			if err != nil {
+				return err
+			}
+			return userService.PingRedis(ctx)
+		}},
+		healthcheck.Probe{Name: "account_manager", Critical: true, Check: func(ctx context.Context) error {
+			return service.GetDispatchInstance().Ping(ctx)
+		}},
+	)
+	go monitor.Run(ctx, durationFromEnv("HEALTH_PROBE_INTERVAL", 5*time.Second))
+	go service.WatchUserInvalidations(ctx, 5*time.Second)
 
-			if !isAuthHeaderExisted {
-				log.Println("Authorization header not present")
-				resp := &extprocv3.ProcessingResponse{
-					Response: &extprocv3.ProcessingResponse_RequestHeaders{
-						RequestHeaders: &extprocv3.HeadersResponse{
-							Response: &extprocv3.CommonResponse{
-								HeaderMutation: &extprocv3.HeaderMutation{
-									RemoveHeaders: []string{"nursor-token"},
-								},
-							},
-						},
-					},
-				}
+	adminAddr := os.Getenv("ADMIN_LISTEN_ADDR")
+	if adminAddr == "" {
+		adminAddr = ":8081"
+	}
+	adminServer := admin.NewServer(streams, monitor)
+	if os.Getenv("ADMIN_ENABLE_PPROF") == "true" {
+		adminServer.EnablePprof()
+	}
+	adminServer.Handle("/users/invalidate", admin.InvalidateUserHandler(os.Getenv("ADMIN_INVALIDATE_SECRET"), service.PublishUserInvalidation))
+	adminHTTP := &http.Server{Addr: adminAddr, Handler: adminServer}
+	go func() {
+		logger.L().Infof("Starting admin HTTP server on %s...", adminAddr)
+		if err := adminHTTP.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.L().Fatalf("Failed to serve admin HTTP: %v", err)
+		}
+	}()
 
-				if err := stream.Send(resp); err != nil {
-					log.Printf("Error sending response: %v", err)
-					return err
-				}
-			} else {
-				resp := &extprocv3.ProcessingResponse{
-					Response: &extprocv3.ProcessingResponse_RequestHeaders{
-						RequestHeaders: &extprocv3.HeadersResponse{
-							Response: &extprocv3.CommonResponse{
-								HeaderMutation: &extprocv3.HeaderMutation{
-									RemoveHeaders: []string{"authorization", "nursor-token"},
-									SetHeaders: []*corev3.HeaderValueOption{
-										{
-											Header: &corev3.HeaderValue{
-												Key:      "authorization",
-												RawValue: []byte(fmt.Sprintf("Bearer %s", account.AccessToken)),
-											},
-											// TODO： 是不是还需要修改x-cleint-id字段？
-											Append: wrapperspb.Bool(false),
-										},
-										{
-											Header: &corev3.HeaderValue{
-												Key:      "x-client-key",
-												RawValue: []byte(account.ClientKey),
-											},
-											Append: wrapperspb.Bool(false),
-										},
-									},
-								},
-							},
-						},
-					},
-				}
-				if err := stream.Send(resp); err != nil {
-					log.Printf("Error sending response: %v", err)
-					return err
-				}
-				log.Println("Authorization header replaced")
-			}
+	serveErr := make(chan error, 1)
+	go func() {
+		logger.L().Infof("Starting ext_proc gRPC server on %s...", listenAddr)
+		serveErr <- s.Serve(lis)
+	}()
 
-		case *extprocv3.ProcessingRequest_RequestBody:
-			log.Println("Received request body")
-			body := r.RequestBody.GetBody()
-			httpRecrod.AddRequestBody(body)
-			resp := &extprocv3.ProcessingResponse{
-				Response: &extprocv3.ProcessingResponse_RequestBody{
-					RequestBody: &extprocv3.BodyResponse{
-						Response: &extprocv3.CommonResponse{},
-					},
-				},
-			}
-			if err := stream.Send(resp); err != nil {
-				log.Printf("Error sending response: %v", err)
-				return err
-			}
-		case *extprocv3.ProcessingRequest_ResponseHeaders:
-			log.Println("Received response headers")
-			headers := r.ResponseHeaders.GetHeaders()
-			for _, h := range headers.Headers {
-				httpRecrod.AddResponseHeader(h.Key, string(h.RawValue))
-				if strings.ToLower(h.Key) == ":status" {
-					respStatus := string(h.RawValue)
-					respStatusInt, err := strconv.Atoi(respStatus)
-					if err != nil {
-						log.Printf("Error converting response status to int: %v", err)
-					}
-					if respStatusInt >= 400 {
-						isChatHasException = true
-					}
-				}
-			}
-			var resp *extprocv3.ProcessingResponse
-			if !isChatHasException {
-				resp = &extprocv3.ProcessingResponse{
-					Response: &extprocv3.ProcessingResponse_ResponseHeaders{
-						ResponseHeaders: &extprocv3.HeadersResponse{
-							Response: &extprocv3.CommonResponse{
-								// HeaderMutation: &extprocv3.HeaderMutation{
-								// 	RemoveHeaders: []string{"authorization"},
-								// 	SetHeaders:    []*corev3.HeaderValueOption{},
-								// },
-							},
-						},
-					},
-				}
+	select {
+	case err := <-serveErr:
+		logger.L().Fatalf("Failed to serve: %v", err)
+	case <-ctx.Done():
+	}
+	stop()
+	logger.L().Info("Shutdown signal received, draining streams")
+	healthServer.Shutdown()
+	adminServer.SetDraining()
 
-			} else {
-				resp = &extprocv3.ProcessingResponse{
-					Response: &extprocv3.ProcessingResponse_ImmediateResponse{
-						ImmediateResponse: &extprocv3.ImmediateResponse{
-							// Status: &tv3.HttpStatus{
-							// 	Code: 567,
-							// },
-						},
-					},
-				}
-			}
-			if err := stream.Send(resp); err != nil {
-				log.Printf("Error sending response: %v", err)
-				return err
-			}
-		case *extprocv3.ProcessingRequest_ResponseBody:
-			log.Println("Received response body")
-			body := r.ResponseBody.GetBody()
-			httpRecrod.AddResponseBody(body)
-			var bodyMutation *extprocv3.BodyMutation
-			// TODO: 需要优化
-			if strings.Contains(string(body), "resource_exhausted") || isChatHasException {
-				fmt.Println("resource_exhausted")
-				bodyMutation = &extprocv3.BodyMutation{
-					Mutation: &extprocv3.BodyMutation_Body{
-						Body: []byte(`1`),
-					},
-				}
-			}
-			resp := &extprocv3.ProcessingResponse{
-				Response: &extprocv3.ProcessingResponse_ResponseBody{
-					ResponseBody: &extprocv3.BodyResponse{
-						Response: &extprocv3.CommonResponse{
-							BodyMutation: bodyMutation,
-						},
-					},
-				},
-			}
-			if err := stream.Send(resp); err != nil {
-				log.Printf("Error sending response: %v", err)
-				return err
-			}
-		default:
-			// 其他阶段暂不处理
-			log.Printf("Unhandled request type: %T (raw: %+v)", r, req)
-			resp := &extprocv3.ProcessingResponse{}
-			if err := stream.Send(resp); err != nil {
-				log.Printf("Error sending response: %v", err)
-				return err
-			}
+	// 先停止接收新流，等待进行中的流结束；超时后强制关闭
+	gracePeriod := durationFromEnv("SHUTDOWN_GRACE_PERIOD", 15*time.Second)
+	stopped := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(gracePeriod):
+		logger.L().Warnf("Streams still open after %s, forcing stop", gracePeriod)
+		s.Stop()
+		// Stop 不等待 Process 返回；GracefulStop 会等，被取消的流在返回前提交收尾任务
+		stopTimeout := durationFromEnv("SHUTDOWN_STOP_TIMEOUT", 2*time.Second)
+		select {
+		case <-stopped:
+		case <-time.After(stopTimeout):
+			logger.L().Warnf("Stream handlers still running %s after forcing stop", stopTimeout)
+		}
+	}
+
+	// 再等待 worker 池处理完队列中的任务（记录推送、用量统计）；
+	// 超时后剩余任务和被取消的任务落盘，下次启动时继续处理
+	postStream.Close()
+	background := service.GetBackgroundInstance()
+	drainCtx, cancel := context.WithTimeout(context.Background(), durationFromEnv("SHUTDOWN_DRAIN_TIMEOUT", 10*time.Second))
+	defer cancel()
+	if err := background.Wait(drainCtx); err != nil {
+		logger.L().Warnf("Shutdown drain incomplete: %v (%d queued tasks abandoned)", err, postStream.Abandon())
+		settleCtx, cancelSettle := context.WithTimeout(context.Background(), time.Second)
+		defer cancelSettle()
+		if err := background.Wait(settleCtx); err != nil {
+			logger.L().Warnf("Cancelled post-stream tasks not persisted: %v", err)
 		}
+	} else {
+		logger.L().Info("Shutdown complete")
+	}
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFlush()
+	if err := shutdownTracing(flushCtx); err != nil {
+		logger.L().Warnf("Failed to flush traces: %v", err)
 	}
+	adminHTTP.Close()
 }
 
-func main() {
-	listenAddr := ":8080"
-	lis, err := net.Listen("tcp", listenAddr)
-	if err != nil {
-		log.Fatalf("Failed to listen on %v: %v", listenAddr, err)
+// publishInvalidation sends a user cache invalidation to every running
+// instance, for the -invalidate-user and -invalidate-token flags.
+func publishInvalidation(inv service.UserInvalidation) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := service.PublishUserInvalidation(ctx, inv); err != nil {
+		logger.L().Fatalf("Failed to invalidate user: %v", err)
 	}
+	logger.L().Infof("Published invalidation for user %d", inv.UserID)
+}
 
-	s := grpc.NewServer()
-	extprocv3.RegisterExternalProcessorServer(s, &extProcServer{})
-	reflection.Register(s)
+// backfillTokens fills in inner_token_hash for the -backfill-token-hashes
+// flag.
+func backfillTokens() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	userService, err := service.InitUserService(ctx)
+	if err != nil {
+		logger.L().Fatalf("Failed to initialize user service: %v", err)
+	}
+	updated, err := userService.BackfillTokenHashes(ctx, 500)
+	if err != nil {
+		logger.L().Fatalf("Failed to backfill token hashes after %d users: %v", updated, err)
+	}
+	logger.L().Infof("Backfilled token hashes of %d users", updated)
+}
 
-	log.Printf("Starting ext_proc gRPC server on %s...\n", listenAddr)
-	if err := s.Serve(lis); err != nil {
-		log.Fatalf("Failed to serve: %v", err)
+// durationFromEnv parses the duration in the environment variable key,
+// falling back to def when it is unset or invalid.
+func durationFromEnv(key string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return def
 	}
+	return d
 }
@@ -0,0 +1,181 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "nursor_rpc"
+
+var (
+	// ConfigInfo is 1 for the version of the routing config currently active.
+	ConfigInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "config_info",
+		Help:      "Active routing configuration, labelled by version.",
+	}, []string{"version"})
+
+	// ConfigReloads counts reload attempts by result (success, invalid).
+	ConfigReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "config_reloads_total",
+		Help:      "Routing configuration reload attempts by result.",
+	}, []string{"result"})
+)
+
+// SetConfigVersion marks version as the only active configuration.
+func SetConfigVersion(version string) {
+	ConfigInfo.Reset()
+	ConfigInfo.WithLabelValues(version).Set(1)
+}
+
+var (
+	// StreamsActive is the number of open Process streams.
+	StreamsActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "streams_active",
+		Help:      "Open ext_proc streams.",
+	})
+
+	// StreamDuration observes stream lifetimes by close reason.
+	StreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "stream_duration_seconds",
+		Help:      "Lifetime of ext_proc streams by close reason.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 14),
+	}, []string{"reason"})
+
+	// PhaseDuration observes how long the handler chain takes per phase.
+	PhaseDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "phase_duration_seconds",
+		Help:      "Time spent handling one ext_proc message, by phase.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 16),
+	}, []string{"phase"})
+
+	// ImmediateResponses counts requests answered without going upstream,
+	// by the handler that answered and its reason.
+	ImmediateResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "immediate_responses_total",
+		Help:      "Immediate responses sent, by handler and reason.",
+	}, []string{"handler", "reason"})
+
+	// UserCacheLookups counts GetUserByInnerToken cache results: local_hit
+	// for the in-process cache, then hit, negative_hit or miss for Redis.
+	UserCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "user_cache_lookups_total",
+		Help:      "User lookups by cache result.",
+	}, []string{"result"})
+
+	// UserInvalidations counts user cache invalidations received over pub/sub
+	// by result (evicted, invalid, error).
+	UserInvalidations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "user_cache_invalidations_total",
+		Help:      "User cache invalidations received by result.",
+	}, []string{"result"})
+
+	// AccountManagerDuration observes account manager calls per endpoint.
+	AccountManagerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "account_manager_request_duration_seconds",
+		Help:      "Account manager request latency by endpoint.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint"})
+
+	// AccountManagerRequests counts account manager calls per endpoint and
+	// HTTP status ("error" when no response was received).
+	AccountManagerRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "account_manager_requests_total",
+		Help:      "Account manager requests by endpoint and status.",
+	}, []string{"endpoint", "status"})
+
+	// RateLimitDecisions counts rate limit checks by path class and result
+	// (allowed, limited, error), plus refunded for allowed requests a later
+	// handler rejected.
+	RateLimitDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limit_decisions_total",
+		Help:      "Rate limit checks by path class and result.",
+	}, []string{"class", "result"})
+
+	// StreamLimitDecisions counts concurrent stream cap checks by result
+	// (allowed, limited, error).
+	StreamLimitDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "stream_limit_decisions_total",
+		Help:      "Concurrent stream cap checks by result.",
+	}, []string{"result"})
+
+	// PostStreamQueueDepth is the number of post-stream tasks queued in
+	// memory.
+	PostStreamQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "post_stream_queue_depth",
+		Help:      "Post-stream tasks waiting in memory.",
+	})
+
+	// PostStreamQueueBytes is the size of the record bodies queued in
+	// memory.
+	PostStreamQueueBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "post_stream_queue_bytes",
+		Help:      "Bytes of record bodies waiting in memory.",
+	})
+
+	// PostStreamSpilled is the number of post-stream tasks spilled to disk.
+	PostStreamSpilled = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "post_stream_spilled",
+		Help:      "Post-stream tasks waiting on disk.",
+	})
+
+	// PostStreamDropped counts post-stream tasks given up on, by reason
+	// (drop_oldest, drop_newest, shutdown, spill_full, spill_error).
+	PostStreamDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "post_stream_dropped_total",
+		Help:      "Post-stream tasks dropped, by reason.",
+	}, []string{"reason"})
+
+	// PostStreamQueueWait observes how long tasks wait before a worker
+	// picks them up.
+	PostStreamQueueWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "post_stream_queue_wait_seconds",
+		Help:      "Time post-stream tasks spend queued.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	})
+
+	// RecordPushes counts HttpRecord pushes by result (success, failure).
+	RecordPushes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "record_pushes_total",
+		Help:      "HttpRecord pushes by result.",
+	}, []string{"result"})
+)
+
+// ObserveAccountManager records one account manager call that started at
+// start. statusCode is ignored when err is set.
+func ObserveAccountManager(endpoint string, start time.Time, statusCode int, err error) {
+	AccountManagerDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(statusCode)
+	}
+	AccountManagerRequests.WithLabelValues(endpoint, status).Inc()
+}
+
+// Result returns "success" or "failure" for err, for result labels.
+func Result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
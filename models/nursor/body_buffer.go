@@ -0,0 +1,159 @@
+package nursor
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// BodyLimits bounds how much of a body a record keeps.
+type BodyLimits struct {
+	// MaxBytes caps the captured bytes; the rest is only counted. Zero
+	// means no cap.
+	MaxBytes int64
+	// MemoryBytes is how much is held in memory before spilling to a temp
+	// file. Zero disables spilling.
+	MemoryBytes int64
+	// SpillDir is where spill files are created; empty means os.TempDir().
+	SpillDir string
+}
+
+// DefaultBodyLimits keeps up to 4 MiB per body, in memory.
+var DefaultBodyLimits = BodyLimits{MaxBytes: 4 << 20}
+
+// BodyBuffer accumulates body chunks up to a cap, counting everything it
+// sees. Once MemoryBytes is exceeded the captured bytes move to a temp file.
+type BodyBuffer struct {
+	limits    BodyLimits
+	mem       []byte
+	file      *os.File
+	total     int64
+	captured  int64
+	truncated bool
+	// readErr is the error from reading the spill file back, if any.
+	readErr error
+}
+
+// NewBodyBuffer returns an empty buffer with the given limits.
+func NewBodyBuffer(limits BodyLimits) *BodyBuffer {
+	return &BodyBuffer{limits: limits}
+}
+
+// Write captures p up to the cap. It never fails: a spill error falls back
+// to truncating at what is already captured.
+func (b *BodyBuffer) Write(p []byte) (int, error) {
+	b.total += int64(len(p))
+	chunk := p
+	if b.limits.MaxBytes > 0 {
+		room := b.limits.MaxBytes - b.captured
+		if room <= 0 {
+			b.truncated = len(p) > 0 || b.truncated
+			return len(p), nil
+		}
+		if int64(len(chunk)) > room {
+			chunk = chunk[:room]
+			b.truncated = true
+		}
+	}
+
+	if b.file == nil && b.limits.MemoryBytes > 0 && b.captured+int64(len(chunk)) > b.limits.MemoryBytes {
+		if err := b.spill(); err != nil {
+			// Keep what we have in memory rather than growing past the limit.
+			b.truncated = true
+			return len(p), nil
+		}
+	}
+	if b.file != nil {
+		if _, err := b.file.Write(chunk); err != nil {
+			b.truncated = true
+			return len(p), nil
+		}
+	} else {
+		b.mem = append(b.mem, chunk...)
+	}
+	b.captured += int64(len(chunk))
+	return len(p), nil
+}
+
+func (b *BodyBuffer) spill() error {
+	f, err := os.CreateTemp(b.limits.SpillDir, "nursor-body-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b.mem); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	b.file = f
+	b.mem = nil
+	return nil
+}
+
+// Total is the number of body bytes seen, captured or not.
+func (b *BodyBuffer) Total() int64 { return b.total }
+
+// Captured is the number of body bytes kept.
+func (b *BodyBuffer) Captured() int64 { return b.captured }
+
+// Truncated reports whether some of the body was dropped.
+func (b *BodyBuffer) Truncated() bool { return b.truncated }
+
+// Len is the number of captured bytes, for len()-style emptiness checks.
+func (b *BodyBuffer) Len() int {
+	if b == nil {
+		return 0
+	}
+	return int(b.captured)
+}
+
+// Bytes returns the captured body followed, if the body was cut short, by
+// a truncation marker.
+func (b *BodyBuffer) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	var data []byte
+	if b.file != nil {
+		data = make([]byte, b.captured)
+		if n, err := b.file.ReadAt(data, 0); n < len(data) {
+			// Keep what could be read and report the rest as dropped.
+			b.readErr = fmt.Errorf("read %d of %d spilled bytes: %w", n, len(data), err)
+			b.truncated = true
+			b.captured = int64(n)
+			data = data[:n]
+		}
+	} else {
+		data = append([]byte(nil), b.mem...)
+	}
+	if b.truncated {
+		data = append(data, fmt.Sprintf("\n...[nursor: truncated, captured %d of %d bytes]", b.captured, b.total)...)
+	}
+	return data
+}
+
+// ReadErr returns the error that cut the body short when Bytes read the
+// spill file back, if any.
+func (b *BodyBuffer) ReadErr() error {
+	if b == nil {
+		return nil
+	}
+	return b.readErr
+}
+
+// Close removes the spill file, if any. The buffer is empty afterwards.
+func (b *BodyBuffer) Close() error {
+	if b == nil || b.file == nil {
+		return nil
+	}
+	name := b.file.Name()
+	b.file.Close()
+	b.file = nil
+	b.captured = 0
+	return os.Remove(name)
+}
+
+// MarshalJSON encodes the captured body like a []byte field would.
+func (b *BodyBuffer) MarshalJSON() ([]byte, error) {
+	return json.Marshal(b.Bytes())
+}
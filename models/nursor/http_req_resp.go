@@ -8,33 +8,51 @@ import (
 
 type HttpRecord struct {
 	RequestHeaders  map[string]string `json:"request_headers"`
-	RequestBody     []byte            `json:"request_body"`
+	RequestBody     *BodyBuffer       `json:"request_body"`
 	ResponseHeaders map[string]string `json:"response_headers"`
-	ResponseBody    []byte            `json:"response_body"`
-	Url             string            `json:"url"`
-	Method          string            `json:"method"`
-	Host            string            `json:"host"`
-	CreateAt        string            `json:"create_at"`
-	HttpVersion     string            `json:"http_version"`
-	UserId          int               `json:"user_id"`
-	AccountId       int               `json:"account_id"`
-	Status          int               `json:"status"`
+	ResponseBody    *BodyBuffer       `json:"response_body"`
+	// ResponseTrailers holds trailers sent after the response body, e.g. by
+	// gRPC upstreams.
+	ResponseTrailers map[string]string `json:"response_trailers"`
+	// GrpcStatus and GrpcMessage come from the grpc-status/grpc-message
+	// trailers (or headers, for trailers-only responses). GrpcStatus is
+	// empty when the upstream did not send one.
+	GrpcStatus  string `json:"grpc_status"`
+	GrpcMessage string `json:"grpc_message"`
+	Url         string `json:"url"`
+	Method      string `json:"method"`
+	Host        string `json:"host"`
+	CreateAt    string `json:"create_at"`
+	HttpVersion string `json:"http_version"`
+	UserId      int    `json:"user_id"`
+	AccountId   int    `json:"account_id"`
+	Status      int    `json:"status"`
+	// RequestId ties the record to the stream's logs and account manager
+	// calls.
+	RequestId string `json:"request_id"`
 }
 
 func NewRequestRecord() *HttpRecord {
+	return NewRequestRecordWithLimits(DefaultBodyLimits)
+}
+
+// NewRequestRecordWithLimits creates a record whose bodies are bounded by
+// limits.
+func NewRequestRecordWithLimits(limits BodyLimits) *HttpRecord {
 	return &HttpRecord{
-		RequestHeaders:  map[string]string{},
-		RequestBody:     []byte{},
-		ResponseHeaders: map[string]string{},
-		ResponseBody:    []byte{},
-		Url:             "",
-		Method:          "Post",
-		Host:            "cursor.sh",
-		CreateAt:        time.Now().Format("2006-01-02 15:04:05"),
-		HttpVersion:     "http/1.1",
-		AccountId:       0,
-		UserId:          0,
-		Status:          200,
+		RequestHeaders:   map[string]string{},
+		RequestBody:      NewBodyBuffer(limits),
+		ResponseHeaders:  map[string]string{},
+		ResponseBody:     NewBodyBuffer(limits),
+		ResponseTrailers: map[string]string{},
+		Url:              "",
+		Method:           "Post",
+		Host:             "cursor.sh",
+		CreateAt:         time.Now().Format("2006-01-02 15:04:05"),
+		HttpVersion:      "http/1.1",
+		AccountId:        0,
+		UserId:           0,
+		Status:           200,
 	}
 }
 
@@ -43,29 +61,60 @@ func (r *HttpRecord) AddRequestHeader(key, value string) {
 }
 func (r *HttpRecord) AddRequestBody(body []byte) {
 	if r.RequestBody == nil {
-		r.RequestBody = []byte{}
+		r.RequestBody = NewBodyBuffer(DefaultBodyLimits)
 	}
-	// 追加数据
-	// 这里使用 append 追加数据
-	r.RequestBody = append(r.RequestBody, body...)
-
+	// 追加数据，超过上限的部分只计数不保存
+	r.RequestBody.Write(body)
 }
 func (r *HttpRecord) AddResponseHeader(key, value string) {
 	r.ResponseHeaders[key] = value
+	r.captureGrpcStatus(key, value)
 }
 func (r *HttpRecord) AddResponseBody(body []byte) {
 	if r.ResponseBody == nil {
-		r.ResponseBody = []byte{}
+		r.ResponseBody = NewBodyBuffer(DefaultBodyLimits)
+	}
+	// 追加数据，超过上限的部分只计数不保存
+	r.ResponseBody.Write(body)
+}
+
+// Close releases any temp files holding spilled bodies.
+func (r *HttpRecord) Close() error {
+	if r == nil {
+		return nil
+	}
+	reqErr := r.RequestBody.Close()
+	respErr := r.ResponseBody.Close()
+	if reqErr != nil {
+		return reqErr
+	}
+	return respErr
+}
+
+func (r *HttpRecord) AddResponseTrailer(key, value string) {
+	if r.ResponseTrailers == nil {
+		r.ResponseTrailers = map[string]string{}
+	}
+	r.ResponseTrailers[key] = value
+	r.captureGrpcStatus(key, value)
+}
+
+// captureGrpcStatus keeps the gRPC status fields, which may arrive either in
+// the trailers or, for trailers-only responses, in the headers.
+func (r *HttpRecord) captureGrpcStatus(key, value string) {
+	switch strings.ToLower(key) {
+	case "grpc-status":
+		r.GrpcStatus = value
+	case "grpc-message":
+		r.GrpcMessage = value
 	}
-	// 追加数据
-	r.ResponseBody = append(r.ResponseBody, body...)
 }
 
 func (r *HttpRecord) Base64RequestBody() string {
 	if r.RequestBody == nil {
 		return ""
 	}
-	return base64.StdEncoding.EncodeToString(r.RequestBody)
+	return base64.StdEncoding.EncodeToString(r.RequestBody.Bytes())
 }
 
 func (r *HttpRecord) Base64ResponseBody() string {
@@ -74,7 +123,7 @@ func (r *HttpRecord) Base64ResponseBody() string {
 	}
 
 	// 将 ResponseBody 转换为字符串
-	bodyStr := string(r.ResponseBody)
+	bodyStr := string(r.ResponseBody.Bytes())
 
 	// 检查是否为有效的 Base64 编码
 	// 1. 去除首尾空格
@@ -29,12 +29,15 @@ const (
 
 // User represents the user_user table in the database.
 type User struct {
-	ID             int            `gorm:"primaryKey;column:id" json:"id"`
-	IsDispatched   bool           `gorm:"default:false;column:is_dispatched" json:"is_dispatched"`
-	IsFree         bool           `gorm:"default:false;column:is_free" json:"is_free"`
-	Name           string         `gorm:"type:varchar(255);column:name" json:"name"`
-	Email          string         `gorm:"type:varchar(255);unique;column:email" json:"email"`
-	InnerToken     string         `gorm:"type:varchar(255);column:inner_token" json:"inner_token"`
+	ID           int    `gorm:"primaryKey;column:id" json:"id"`
+	IsDispatched bool   `gorm:"default:false;column:is_dispatched" json:"is_dispatched"`
+	IsFree       bool   `gorm:"default:false;column:is_free" json:"is_free"`
+	Name         string `gorm:"type:varchar(255);column:name" json:"name"`
+	Email        string `gorm:"type:varchar(255);unique;column:email" json:"email"`
+	InnerToken   string `gorm:"type:varchar(255);column:inner_token" json:"inner_token"`
+	// InnerTokenHash is the HMAC of InnerToken used for lookups, nil until
+	// backfilled.
+	InnerTokenHash *string        `gorm:"type:char(64);index:idx_user_user_inner_token_hash;column:inner_token_hash" json:"-"`
 	MembershipType MembershipType `gorm:"type:varchar(255);column:membership_type" json:"membership_type"`
 	SalesChannel   *SalesChannel  `gorm:"type:varchar(255);column:sales_channel" json:"sales_channel"`
 	ClientID       *string        `gorm:"type:varchar(255);column:client_id" json:"client_id"`
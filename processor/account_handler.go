@@ -0,0 +1,49 @@
+package processor
+
+import (
+	"fmt"
+	"nursor-envoy-rpc/logger"
+	"nursor-envoy-rpc/service"
+	"nursor-envoy-rpc/utils"
+	"strings"
+
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// AccountHandler swaps the client's Cursor credentials for those of an
+// account dispatched to the user. Requests without a JWT authorization
+// header only have the nursor-token stripped.
+type AccountHandler struct {
+	BaseHandler
+}
+
+func (h *AccountHandler) Name() string { return "account" }
+
+func (h *AccountHandler) OnRequestHeaders(sc *StreamContext, headers *extprocv3.HttpHeaders) (*Result, error) {
+	if !strings.Contains(sc.Header("authorization"), ".") {
+		sc.Log().Info("Authorization header not present")
+		return (&Result{}).RemoveHeader("nursor-token"), nil
+	}
+
+	dispatcherService := service.GetDispatchInstance()
+	account, err := dispatcherService.GetAccountByUserId(sc.Ctx, sc.User.ID)
+	if err != nil || account == nil {
+		sc.Log().Warnf("Error dispatching token: %v", err)
+		if err == nil {
+			err = fmt.Errorf("%w for user %d", utils.ErrNoAccountAvailable, sc.User.ID)
+		}
+		// 发送响应，终止流程
+		return Immediate(utils.GetResponseForErr(sc.Ctx, err, sc.Header("content-type")).GetImmediateResponse()), err
+	}
+	sc.Account = account
+	sc.Record.AccountId = account.ID
+	sc.AddLogFields(logger.Fields{"account_id": account.ID})
+
+	sc.Log().Info("Authorization header replaced")
+	// TODO： 是不是还需要修改x-cleint-id字段？
+	return (&Result{}).
+		RemoveHeader("authorization").
+		RemoveHeader("nursor-token").
+		SetHeader("authorization", fmt.Sprintf("Bearer %s", account.AccessToken)).
+		SetHeader("x-client-key", account.ClientKey), nil
+}
@@ -0,0 +1,90 @@
+package processor
+
+import (
+	"errors"
+	"nursor-envoy-rpc/logger"
+	"nursor-envoy-rpc/redact"
+	"nursor-envoy-rpc/service"
+	"nursor-envoy-rpc/utils"
+
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// AuthHandler resolves the nursor-token request header to a user. Requests
+// without a known user are answered immediately, and clients sending too
+// many unknown tokens are locked out for a while.
+type AuthHandler struct {
+	BaseHandler
+	// Guard defaults to service.GetAuthGuardInstance().
+	Guard service.AuthGuard
+}
+
+func (h *AuthHandler) Name() string { return "auth" }
+
+func (h *AuthHandler) OnRequestHeaders(sc *StreamContext, headers *extprocv3.HttpHeaders) (*Result, error) {
+	// 从headers中提取nursor-token
+	sc.InnerToken = sc.Header("nursor-token")
+	if sc.InnerToken == "" {
+		sc.Log().Info("User not found")
+		return Immediate(&extprocv3.ImmediateResponse{Details: "missing_token"}), nil
+	}
+
+	maxFailures, window, lockout := sc.Config.AuthLockout()
+	clientIP := sc.ClientIP(sc.Config.TrustedHops())
+	guard, err := h.guard(sc, maxFailures, clientIP)
+	if err != nil {
+		return h.reject(sc, err), nil
+	}
+	if guard != nil {
+		locked, err := guard.LockedFor(sc.Ctx, clientIP)
+		if err != nil {
+			sc.Log().Warnf("Auth lockout check failed, continuing: %v", err)
+		} else if locked > 0 {
+			return h.reject(sc, &utils.AuthLockedError{ClientIP: clientIP, RetryAfter: locked}), nil
+		}
+	}
+
+	// 用户服务尚未就绪（数据库不可用）时返回 503，而不是退出进程
+	userService, err := service.InitUserService(sc.Ctx)
+	if err != nil {
+		return h.reject(sc, err), nil
+	}
+	user, err := userService.GetUserByInnerToken(sc.Ctx, sc.InnerToken)
+	if err != nil {
+		sc.Log().Infof("Error getting user by inner token: %v", err)
+		if guard != nil && errors.Is(err, utils.ErrUserNotFound) {
+			locked, guardErr := guard.RecordFailure(sc.Ctx, clientIP, maxFailures, window, lockout)
+			if guardErr != nil {
+				sc.Log().Warnf("Failed to record auth failure: %v", guardErr)
+			} else if locked > 0 {
+				sc.Log().WithField("client_ip", clientIP).Warnf("Client locked out for %s after %d unknown tokens", locked, maxFailures)
+			}
+		}
+		return h.reject(sc, err), nil
+	}
+	sc.User = user
+	sc.Record.UserId = user.ID
+	sc.AddLogFields(logger.Fields{"user_id": user.ID})
+	sc.Log().Infof("Found and set nursor-token: %s", redact.Fingerprint(sc.InnerToken))
+	return nil, nil
+}
+
+// guard returns the guard to use, or nil when the lockout is disabled or
+// the client address is unknown.
+func (h *AuthHandler) guard(sc *StreamContext, maxFailures int, clientIP string) (service.AuthGuard, error) {
+	if maxFailures == 0 || clientIP == "" {
+		return nil, nil
+	}
+	if h.Guard != nil {
+		return h.Guard, nil
+	}
+	guard, err := service.GetAuthGuardInstance(sc.Ctx)
+	if err != nil {
+		return nil, err
+	}
+	return guard, nil
+}
+
+func (h *AuthHandler) reject(sc *StreamContext, err error) *Result {
+	return Immediate(utils.GetResponseForErr(sc.Ctx, err, sc.Header("content-type")).GetImmediateResponse())
+}
@@ -0,0 +1,252 @@
+package processor
+
+import (
+	"nursor-envoy-rpc/metrics"
+	"time"
+
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// Chain runs an ordered list of handlers for each ext_proc phase and folds
+// their results into a single ProcessingResponse.
+type Chain struct {
+	handlers []Handler
+}
+
+// NewChain builds a chain that runs handlers in the given order.
+func NewChain(handlers ...Handler) *Chain {
+	return &Chain{handlers: handlers}
+}
+
+// NewDefaultChain returns the handlers the server runs in production.
+func NewDefaultChain() *Chain {
+	return NewChain(
+		&AuthHandler{},
+		&RecordHandler{},
+		&RulesHandler{},
+		&RateLimitHandler{},
+		&StreamLimitHandler{},
+		&AccountHandler{},
+		&UpstreamErrorHandler{},
+	)
+}
+
+// Handlers returns the handlers in chain order.
+func (c *Chain) Handlers() []Handler {
+	return c.handlers
+}
+
+// OnRequestHeaders runs the request headers phase. The returned bool tells
+// the caller to close the stream once the response has been sent. Each phase
+// first advances the stream state, so an out-of-order message fails with a
+// FailedPrecondition status before any handler runs.
+func (c *Chain) OnRequestHeaders(sc *StreamContext, headers *extprocv3.HttpHeaders) (*extprocv3.ProcessingResponse, bool, error) {
+	defer observePhase(PhaseRequestHeaders, time.Now())
+	if err := sc.advanceOrClose(PhaseRequestHeaders); err != nil {
+		return nil, true, err
+	}
+	sc.setRequestHeaders(headers)
+	sc.assignRequestID()
+	sc.startTrace()
+	merged, err := c.run(sc, func(h Handler) (*Result, error) {
+		return h.OnRequestHeaders(sc, headers)
+	})
+	closeIfDone(sc, merged, err)
+	if merged.ImmediateResponse != nil {
+		return immediateResponse(merged), true, err
+	}
+	if merged.ModeOverride != nil {
+		sc.applyMode(merged.ModeOverride)
+	}
+	return &extprocv3.ProcessingResponse{
+		ModeOverride: merged.ModeOverride,
+		Response: &extprocv3.ProcessingResponse_RequestHeaders{
+			RequestHeaders: &extprocv3.HeadersResponse{
+				Response: &extprocv3.CommonResponse{
+					HeaderMutation: headerMutation(merged, true),
+					BodyMutation:   merged.BodyMutation,
+				},
+			},
+		},
+	}, merged.EndStream, err
+}
+
+// OnRequestBody runs the request body phase.
+func (c *Chain) OnRequestBody(sc *StreamContext, body *extprocv3.HttpBody) (*extprocv3.ProcessingResponse, bool, error) {
+	defer observePhase(PhaseRequestBody, time.Now())
+	if err := sc.advanceOrClose(PhaseRequestBody); err != nil {
+		return nil, true, err
+	}
+	merged, err := c.run(sc, func(h Handler) (*Result, error) {
+		return h.OnRequestBody(sc, body)
+	})
+	closeIfDone(sc, merged, err)
+	if merged.ImmediateResponse != nil {
+		return immediateResponse(merged), true, err
+	}
+	return &extprocv3.ProcessingResponse{
+		Response: &extprocv3.ProcessingResponse_RequestBody{
+			RequestBody: &extprocv3.BodyResponse{
+				Response: &extprocv3.CommonResponse{
+					HeaderMutation: headerMutation(merged, false),
+					BodyMutation:   merged.BodyMutation,
+				},
+			},
+		},
+	}, merged.EndStream, err
+}
+
+// OnResponseHeaders runs the response headers phase.
+func (c *Chain) OnResponseHeaders(sc *StreamContext, headers *extprocv3.HttpHeaders) (*extprocv3.ProcessingResponse, bool, error) {
+	defer observePhase(PhaseResponseHeaders, time.Now())
+	if err := sc.advanceOrClose(PhaseResponseHeaders); err != nil {
+		return nil, true, err
+	}
+	merged, err := c.run(sc, func(h Handler) (*Result, error) {
+		return h.OnResponseHeaders(sc, headers)
+	})
+	closeIfDone(sc, merged, err)
+	if merged.ImmediateResponse != nil {
+		return immediateResponse(merged), true, err
+	}
+	return &extprocv3.ProcessingResponse{
+		Response: &extprocv3.ProcessingResponse_ResponseHeaders{
+			ResponseHeaders: &extprocv3.HeadersResponse{
+				Response: &extprocv3.CommonResponse{
+					HeaderMutation: headerMutation(merged, false),
+					BodyMutation:   merged.BodyMutation,
+				},
+			},
+		},
+	}, merged.EndStream, err
+}
+
+// OnResponseBody runs the response body phase.
+func (c *Chain) OnResponseBody(sc *StreamContext, body *extprocv3.HttpBody) (*extprocv3.ProcessingResponse, bool, error) {
+	defer observePhase(PhaseResponseBody, time.Now())
+	if err := sc.advanceOrClose(PhaseResponseBody); err != nil {
+		return nil, true, err
+	}
+	merged, err := c.run(sc, func(h Handler) (*Result, error) {
+		return h.OnResponseBody(sc, body)
+	})
+	closeIfDone(sc, merged, err)
+	if merged.ImmediateResponse != nil {
+		return immediateResponse(merged), true, err
+	}
+	return &extprocv3.ProcessingResponse{
+		Response: &extprocv3.ProcessingResponse_ResponseBody{
+			ResponseBody: &extprocv3.BodyResponse{
+				Response: &extprocv3.CommonResponse{
+					HeaderMutation: headerMutation(merged, false),
+					BodyMutation:   merged.BodyMutation,
+				},
+			},
+		},
+	}, merged.EndStream, err
+}
+
+// OnTrailers runs the request or response trailers phase.
+func (c *Chain) OnTrailers(sc *StreamContext, dir Direction, trailers *extprocv3.HttpTrailers) (*extprocv3.ProcessingResponse, bool, error) {
+	phase := PhaseRequestTrailers
+	if dir == DirectionResponse {
+		phase = PhaseResponseTrailers
+	}
+	defer observePhase(phase, time.Now())
+	if err := sc.advanceOrClose(phase); err != nil {
+		return nil, true, err
+	}
+	merged, err := c.run(sc, func(h Handler) (*Result, error) {
+		return h.OnTrailers(sc, dir, trailers)
+	})
+	closeIfDone(sc, merged, err)
+	if merged.ImmediateResponse != nil {
+		return immediateResponse(merged), true, err
+	}
+	trailersResponse := &extprocv3.TrailersResponse{HeaderMutation: headerMutation(merged, false)}
+	if dir == DirectionResponse {
+		return &extprocv3.ProcessingResponse{
+			Response: &extprocv3.ProcessingResponse_ResponseTrailers{ResponseTrailers: trailersResponse},
+		}, merged.EndStream, err
+	}
+	return &extprocv3.ProcessingResponse{
+		Response: &extprocv3.ProcessingResponse_RequestTrailers{RequestTrailers: trailersResponse},
+	}, merged.EndStream, err
+}
+
+// run calls every handler until one fails, answers immediately or ends the
+// stream. A handler may return both a result and an error, in which case the
+// result is still sent before the error closes the stream.
+func (c *Chain) run(sc *StreamContext, call func(Handler) (*Result, error)) (*Result, error) {
+	merged := &Result{}
+	for _, h := range c.handlers {
+		res, err := call(h)
+		if res != nil {
+			merged.SetHeaders = append(merged.SetHeaders, res.SetHeaders...)
+			merged.RemoveHeaders = append(merged.RemoveHeaders, res.RemoveHeaders...)
+			if res.BodyMutation != nil {
+				merged.BodyMutation = res.BodyMutation
+			}
+			if res.ImmediateResponse != nil {
+				merged.ImmediateResponse = res.ImmediateResponse
+				reason := res.ImmediateResponse.Details
+				if reason == "" {
+					reason = "unspecified"
+				}
+				metrics.ImmediateResponses.WithLabelValues(h.Name(), reason).Inc()
+			}
+			merged.EndStream = merged.EndStream || res.EndStream
+			if res.ModeOverride != nil {
+				merged.ModeOverride = res.ModeOverride
+			}
+		}
+		if err != nil {
+			sc.Log().WithField("handler", h.Name()).Errorf("Handler failed: %v", err)
+			return merged, err
+		}
+		if merged.ImmediateResponse != nil || merged.EndStream {
+			break
+		}
+	}
+	return merged, nil
+}
+
+func observePhase(phase Phase, start time.Time) {
+	metrics.PhaseDuration.WithLabelValues(phase.String()).Observe(time.Since(start).Seconds())
+}
+
+// closeIfDone records why the stream is about to end, if it is.
+func closeIfDone(sc *StreamContext, merged *Result, err error) {
+	if merged.ImmediateResponse != nil && sc.Phase() != PhaseClosed {
+		sc.immediate = true
+	}
+	switch {
+	case err != nil:
+		sc.Close(CloseHandlerError)
+	case merged.ImmediateResponse != nil:
+		sc.Close(CloseImmediate)
+	case merged.EndStream:
+		sc.Close(CloseEndStream)
+	}
+}
+
+func immediateResponse(merged *Result) *extprocv3.ProcessingResponse {
+	return &extprocv3.ProcessingResponse{
+		Response: &extprocv3.ProcessingResponse_ImmediateResponse{
+			ImmediateResponse: merged.ImmediateResponse,
+		},
+	}
+}
+
+// headerMutation converts the merged result into a HeaderMutation. Request
+// header responses always carry one, even if empty, which is what Envoy
+// expects for a passthrough.
+func headerMutation(merged *Result, always bool) *extprocv3.HeaderMutation {
+	if !always && len(merged.SetHeaders) == 0 && len(merged.RemoveHeaders) == 0 {
+		return nil
+	}
+	return &extprocv3.HeaderMutation{
+		SetHeaders:    merged.SetHeaders,
+		RemoveHeaders: merged.RemoveHeaders,
+	}
+}
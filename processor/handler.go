@@ -0,0 +1,107 @@
+package processor
+
+import (
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	filterv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_proc/v3"
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// Direction tells a handler which side of the exchange a phase belongs to.
+type Direction int
+
+const (
+	DirectionRequest Direction = iota
+	DirectionResponse
+)
+
+func (d Direction) String() string {
+	if d == DirectionResponse {
+		return "response"
+	}
+	return "request"
+}
+
+// Handler is one step of the ext_proc pipeline. Handlers are run in chain
+// order for every phase; a nil Result means "no opinion, continue".
+type Handler interface {
+	Name() string
+	OnRequestHeaders(sc *StreamContext, headers *extprocv3.HttpHeaders) (*Result, error)
+	OnRequestBody(sc *StreamContext, body *extprocv3.HttpBody) (*Result, error)
+	OnResponseHeaders(sc *StreamContext, headers *extprocv3.HttpHeaders) (*Result, error)
+	OnResponseBody(sc *StreamContext, body *extprocv3.HttpBody) (*Result, error)
+	OnTrailers(sc *StreamContext, dir Direction, trailers *extprocv3.HttpTrailers) (*Result, error)
+}
+
+// BaseHandler implements every phase as a no-op so concrete handlers only
+// override the phases they care about.
+type BaseHandler struct{}
+
+func (BaseHandler) OnRequestHeaders(*StreamContext, *extprocv3.HttpHeaders) (*Result, error) {
+	return nil, nil
+}
+
+func (BaseHandler) OnRequestBody(*StreamContext, *extprocv3.HttpBody) (*Result, error) {
+	return nil, nil
+}
+
+func (BaseHandler) OnResponseHeaders(*StreamContext, *extprocv3.HttpHeaders) (*Result, error) {
+	return nil, nil
+}
+
+func (BaseHandler) OnResponseBody(*StreamContext, *extprocv3.HttpBody) (*Result, error) {
+	return nil, nil
+}
+
+func (BaseHandler) OnTrailers(*StreamContext, Direction, *extprocv3.HttpTrailers) (*Result, error) {
+	return nil, nil
+}
+
+// Result is what a handler wants done with the current phase. Header and
+// body mutations from all handlers are merged; an ImmediateResponse or
+// EndStream stops the chain.
+type Result struct {
+	SetHeaders        []*corev3.HeaderValueOption
+	RemoveHeaders     []string
+	BodyMutation      *extprocv3.BodyMutation
+	ImmediateResponse *extprocv3.ImmediateResponse
+	// EndStream sends the merged response and then closes the stream, so
+	// Envoy stops consulting us for the rest of the exchange.
+	EndStream bool
+	// ModeOverride changes which phases Envoy sends for the rest of the
+	// stream. Only honoured in the request headers phase; the last handler
+	// to set it wins.
+	ModeOverride *filterv3.ProcessingMode
+}
+
+// SetHeader adds an overwrite of key to the result.
+func (r *Result) SetHeader(key, value string) *Result {
+	r.SetHeaders = append(r.SetHeaders, &corev3.HeaderValueOption{
+		Header: &corev3.HeaderValue{
+			Key:      key,
+			RawValue: []byte(value),
+		},
+		Append: wrapperspb.Bool(false),
+	})
+	return r
+}
+
+// RemoveHeader adds a removal of key to the result.
+func (r *Result) RemoveHeader(key string) *Result {
+	r.RemoveHeaders = append(r.RemoveHeaders, key)
+	return r
+}
+
+// Immediate returns a result that answers the request directly.
+func Immediate(resp *extprocv3.ImmediateResponse) *Result {
+	return &Result{ImmediateResponse: resp}
+}
+
+// headerValue prefers raw_value, which is what Envoy sends when
+// envoy_reloadable_features_send_header_raw_value is on.
+func headerValue(h *corev3.HeaderValue) string {
+	if len(h.RawValue) > 0 {
+		return string(h.RawValue)
+	}
+	return h.Value
+}
@@ -0,0 +1,92 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"nursor-envoy-rpc/config"
+	"nursor-envoy-rpc/metrics"
+	"nursor-envoy-rpc/service"
+	"nursor-envoy-rpc/utils"
+	"strings"
+
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// completionPaths mark Cursor Tab completion calls.
+var completionPaths = []string{"/aiserver.v1.AiService/StreamCpp", "/aiserver.v1.CppService/"}
+
+// PathClass returns the rate limit class of the stream's request.
+func PathClass(sc *StreamContext) string {
+	if sc.IsChatRequest {
+		return config.PathClassChat
+	}
+	for _, prefix := range completionPaths {
+		if strings.HasPrefix(sc.Path(), prefix) {
+			return config.PathClassCompletion
+		}
+	}
+	return config.PathClassOther
+}
+
+// RateLimitHandler limits how many requests each user starts, per path
+// class, with the limits of the user's membership type. When Redis cannot
+// be reached requests are let through.
+type RateLimitHandler struct {
+	BaseHandler
+	// Limiter defaults to service.GetRateLimiterInstance().
+	Limiter service.RateLimiter
+}
+
+func (h *RateLimitHandler) Name() string { return "rate_limit" }
+
+func (h *RateLimitHandler) OnRequestHeaders(sc *StreamContext, headers *extprocv3.HttpHeaders) (*Result, error) {
+	if sc.User == nil {
+		return nil, nil
+	}
+	class := PathClass(sc)
+	limit := sc.Config.RateLimitFor(string(sc.User.MembershipType), class)
+	if limit == nil {
+		return nil, nil
+	}
+	limiter := h.Limiter
+	if limiter == nil {
+		instance, err := service.GetRateLimiterInstance(sc.Ctx)
+		if err != nil {
+			return Immediate(utils.GetResponseForErr(sc.Ctx, err, sc.Header("content-type")).GetImmediateResponse()), nil
+		}
+		limiter = instance
+	}
+	key := fmt.Sprintf("%d:%s", sc.User.ID, class)
+	decision, err := limiter.Allow(sc.Ctx, key, limit.Requests, limit.WindowDuration())
+	if err != nil {
+		metrics.RateLimitDecisions.WithLabelValues(class, "error").Inc()
+		sc.Log().Warnf("Rate limit check failed, allowing request: %v", err)
+		return nil, nil
+	}
+	if decision.Allowed {
+		metrics.RateLimitDecisions.WithLabelValues(class, "allowed").Inc()
+		h.refundIfRejected(sc, limiter, key, decision.Member)
+		return nil, nil
+	}
+	metrics.RateLimitDecisions.WithLabelValues(class, "limited").Inc()
+	err = &utils.RateLimitError{Class: class, Limit: limit.Requests, Window: limit.WindowDuration(), RetryAfter: decision.RetryAfter}
+	return Immediate(utils.GetResponseForErr(sc.Ctx, err, sc.Header("content-type")).GetImmediateResponse()), nil
+}
+
+// refundIfRejected gives the request back to the window when a later
+// handler, such as the stream cap or account dispatch, answers the request
+// headers itself, so requests that never reach upstream do not use up quota.
+// Handlers failing with an immediate response count as rejections too.
+func (h *RateLimitHandler) refundIfRejected(sc *StreamContext, limiter service.RateLimiter, key, member string) {
+	ctx := sc.Detach(context.Background())
+	sc.AddCleanup(func() {
+		if !sc.AnsweredImmediately() || sc.ClosedIn() != PhaseRequestHeaders {
+			return
+		}
+		if err := limiter.Refund(ctx, key, member); err != nil {
+			sc.Log().Warnf("Failed to refund rate limit for rejected request: %v", err)
+			return
+		}
+		metrics.RateLimitDecisions.WithLabelValues(PathClass(sc), "refunded").Inc()
+	})
+}
@@ -0,0 +1,75 @@
+package processor
+
+import (
+	"strings"
+
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// RecordHandler copies headers and bodies into the stream's HttpRecord and
+// flags chat requests for usage accounting. Bodies are not kept for streams
+// whose rule disables recording.
+type RecordHandler struct {
+	BaseHandler
+}
+
+func (h *RecordHandler) Name() string { return "record" }
+
+func (h *RecordHandler) OnRequestHeaders(sc *StreamContext, headers *extprocv3.HttpHeaders) (*Result, error) {
+	record := sc.Record
+	for _, hv := range headers.GetHeaders().GetHeaders() {
+		record.AddRequestHeader(hv.Key, headerValue(hv))
+	}
+	record.HttpVersion = "http/2.0"
+	if method := sc.Method(); method != "" {
+		record.Method = method // e.g., "POST"
+	}
+	if authority := sc.Authority(); authority != "" {
+		record.Host = authority // e.g., "cursor.sh"
+	}
+	// :path 包含路径和查询参数，需拼接 scheme 和 host 构成完整 URL
+	scheme := sc.Header(":scheme")
+	if scheme == "" {
+		scheme = "http" // 默认值
+	}
+	record.Url = scheme + "://" + record.Host + sc.Path() // e.g., "http://cursor.sh/path?query"
+
+	// 聊天请求单独处理
+	if strings.Contains(sc.Path(), "StreamUnifiedChatWithTools") {
+		sc.IsChatRequest = true
+	}
+	return nil, nil
+}
+
+func (h *RecordHandler) OnRequestBody(sc *StreamContext, body *extprocv3.HttpBody) (*Result, error) {
+	if sc.SkipRecord {
+		return nil, nil
+	}
+	sc.Record.AddRequestBody(body.GetBody())
+	return nil, nil
+}
+
+func (h *RecordHandler) OnResponseHeaders(sc *StreamContext, headers *extprocv3.HttpHeaders) (*Result, error) {
+	for _, hv := range headers.GetHeaders().GetHeaders() {
+		sc.Record.AddResponseHeader(hv.Key, headerValue(hv))
+	}
+	return nil, nil
+}
+
+func (h *RecordHandler) OnResponseBody(sc *StreamContext, body *extprocv3.HttpBody) (*Result, error) {
+	if sc.SkipRecord {
+		return nil, nil
+	}
+	sc.Record.AddResponseBody(body.GetBody())
+	return nil, nil
+}
+
+func (h *RecordHandler) OnTrailers(sc *StreamContext, dir Direction, trailers *extprocv3.HttpTrailers) (*Result, error) {
+	if dir != DirectionResponse {
+		return nil, nil
+	}
+	for _, hv := range trailers.GetTrailers().GetHeaders() {
+		sc.Record.AddResponseTrailer(hv.Key, headerValue(hv))
+	}
+	return nil, nil
+}
@@ -0,0 +1,86 @@
+package processor
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// StreamInfo is a point-in-time view of an open stream, safe to hand to
+// other goroutines.
+type StreamInfo struct {
+	ID        string    `json:"id"`
+	RequestID string    `json:"request_id,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	Phase     string    `json:"phase"`
+	Method    string    `json:"method,omitempty"`
+	Authority string    `json:"authority,omitempty"`
+	Path      string    `json:"path,omitempty"`
+	Rule      string    `json:"rule,omitempty"`
+	UserID    int       `json:"user_id,omitempty"`
+	AccountID int       `json:"account_id,omitempty"`
+	IsChat    bool      `json:"is_chat,omitempty"`
+}
+
+// Registry tracks the open streams for debugging. The stream goroutine
+// publishes snapshots with Update; readers never touch the StreamContext.
+type Registry struct {
+	mu      sync.RWMutex
+	streams map[string]StreamInfo
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{streams: make(map[string]StreamInfo)}
+}
+
+// Update records the current state of sc, adding it if it is new. It must
+// be called from the goroutine that owns sc.
+func (r *Registry) Update(sc *StreamContext) {
+	info := StreamInfo{
+		ID:        sc.ID,
+		RequestID: sc.RequestID,
+		StartedAt: sc.StartedAt,
+		Phase:     sc.Phase().String(),
+		Method:    sc.Method(),
+		Authority: sc.Authority(),
+		Path:      sc.Path(),
+		UserID:    sc.Record.UserId,
+		AccountID: sc.Record.AccountId,
+		IsChat:    sc.IsChatRequest,
+	}
+	if sc.Rule != nil {
+		info.Rule = sc.Rule.Name
+	}
+	r.mu.Lock()
+	r.streams[sc.ID] = info
+	r.mu.Unlock()
+}
+
+// Remove forgets the stream with the given ID.
+func (r *Registry) Remove(id string) {
+	r.mu.Lock()
+	delete(r.streams, id)
+	r.mu.Unlock()
+}
+
+// Len returns the number of open streams.
+func (r *Registry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.streams)
+}
+
+// Snapshot returns the open streams, oldest first.
+func (r *Registry) Snapshot() []StreamInfo {
+	r.mu.RLock()
+	streams := make([]StreamInfo, 0, len(r.streams))
+	for _, info := range r.streams {
+		streams = append(streams, info)
+	}
+	r.mu.RUnlock()
+	sort.Slice(streams, func(i, j int) bool {
+		return streams[i].StartedAt.Before(streams[j].StartedAt)
+	})
+	return streams
+}
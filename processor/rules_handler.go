@@ -0,0 +1,63 @@
+package processor
+
+import (
+	"nursor-envoy-rpc/config"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	v32 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+)
+
+// RulesHandler applies the first rule of the stream's config snapshot that
+// matches the request.
+type RulesHandler struct {
+	BaseHandler
+}
+
+func (h *RulesHandler) Name() string { return "rules" }
+
+func (h *RulesHandler) OnRequestHeaders(sc *StreamContext, headers *extprocv3.HttpHeaders) (*Result, error) {
+	if sc.Config == nil {
+		return nil, nil
+	}
+	rule := sc.Config.MatchRule(sc.RequestHeaders)
+	if rule == nil {
+		return nil, nil
+	}
+	sc.Log().WithField("rule", rule.Name).Info("Matched rule")
+	sc.Rule = rule
+	sc.SkipRecord = !rule.Action.ShouldRecord()
+
+	if rule.Action.Respond != nil {
+		resp := immediateFromRule(rule.Action.Respond)
+		resp.Details = "rule_" + rule.Name
+		return Immediate(resp), nil
+	}
+	res := &Result{
+		EndStream:    rule.Action.Passthrough,
+		ModeOverride: sc.Config.ModeOverride(rule),
+	}
+	for _, key := range rule.Action.RemoveHeaders {
+		res.RemoveHeader(key)
+	}
+	for key, value := range rule.Action.SetHeaders {
+		res.SetHeader(key, value)
+	}
+	return res, nil
+}
+
+func immediateFromRule(respond *config.Respond) *extprocv3.ImmediateResponse {
+	resp := &extprocv3.ImmediateResponse{Body: respond.ResponseBody()}
+	if respond.Status != 0 {
+		resp.Status = &v32.HttpStatus{Code: v32.StatusCode(respond.Status)}
+	}
+	if len(respond.Headers) > 0 {
+		resp.Headers = &extprocv3.HeaderMutation{}
+		for key, value := range respond.Headers {
+			resp.Headers.SetHeaders = append(resp.Headers.SetHeaders, &corev3.HeaderValueOption{
+				Header: &corev3.HeaderValue{Key: key, RawValue: []byte(value)},
+			})
+		}
+	}
+	return resp
+}
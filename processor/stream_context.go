@@ -0,0 +1,225 @@
+package processor
+
+import (
+	"context"
+	"net"
+	"nursor-envoy-rpc/config"
+	"nursor-envoy-rpc/logger"
+	"nursor-envoy-rpc/models/nursor"
+	"nursor-envoy-rpc/service"
+	"nursor-envoy-rpc/tracing"
+	"nursor-envoy-rpc/utils"
+	"strings"
+	"time"
+
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// StreamContext carries everything handlers share for one Process stream.
+// The phase, user, account and record live in the embedded StreamState.
+type StreamContext struct {
+	*StreamState
+
+	// ID identifies the stream in logs and the debug views.
+	ID        string
+	StartedAt time.Time
+	// RequestID correlates the stream's logs, record and account manager
+	// calls. It is Envoy's x-request-id when present, else a new UUID.
+	RequestID string
+
+	Ctx context.Context
+	// Config is the configuration snapshot taken when the stream started;
+	// reloads during the stream do not affect it.
+	Config *config.Config
+
+	// RequestHeaders holds the request headers keyed by lower-cased name.
+	RequestHeaders map[string]string
+
+	// Rule is the routing rule matched by the request, if any.
+	Rule *config.Rule
+	// SkipRecord is set when the matched rule opts the stream out of
+	// recording.
+	SkipRecord bool
+
+	// Span covers the whole stream. It starts with the request headers,
+	// continuing the client's traceparent, and Ctx carries it from then on.
+	Span trace.Span
+
+	cleanups []func()
+}
+
+// NewStreamContext creates the per-stream state for a new Process call.
+func NewStreamContext(ctx context.Context, cfg *config.Config) *StreamContext {
+	id := uuid.NewString()
+	return &StreamContext{
+		StreamState:    NewStreamState(nursor.NewRequestRecordWithLimits(cfg.BodyLimits())),
+		ID:             id,
+		StartedAt:      time.Now(),
+		Ctx:            logger.WithFields(ctx, logger.Fields{"stream_id": id}),
+		Config:         cfg,
+		RequestHeaders: map[string]string{},
+	}
+}
+
+// Log returns the stream's logger. Its lines carry the stream ID and, as
+// they become known, the authority, path, user and account.
+func (sc *StreamContext) Log() *logrus.Entry {
+	return logger.FromContext(sc.Ctx)
+}
+
+// AddLogFields attaches fields to every later line of the stream's logger,
+// including those logged by services handed sc.Ctx.
+func (sc *StreamContext) AddLogFields(fields logger.Fields) {
+	sc.Ctx = logger.WithFields(sc.Ctx, fields)
+}
+
+// AddCleanup registers fn to run when the stream ends, e.g. to give back
+// resources a handler holds for the stream's lifetime.
+func (sc *StreamContext) AddCleanup(fn func()) {
+	sc.cleanups = append(sc.cleanups, fn)
+}
+
+// Cleanup runs the registered cleanups, last registered first.
+func (sc *StreamContext) Cleanup() {
+	for i := len(sc.cleanups) - 1; i >= 0; i-- {
+		sc.cleanups[i]()
+	}
+	sc.cleanups = nil
+}
+
+// Header returns the request header with the given name, case-insensitively.
+func (sc *StreamContext) Header(key string) string {
+	return sc.RequestHeaders[strings.ToLower(key)]
+}
+
+// Authority returns the request :authority pseudo-header.
+func (sc *StreamContext) Authority() string {
+	return sc.RequestHeaders[":authority"]
+}
+
+// Path returns the request :path pseudo-header.
+func (sc *StreamContext) Path() string {
+	return sc.RequestHeaders[":path"]
+}
+
+// ClientIP returns the client address from x-forwarded-for: the entry just
+// before the trustedHops entries appended by proxies in front of Envoy.
+// Earlier entries are set by the client and cannot be trusted. It returns
+// "" when there is no valid address.
+func (sc *StreamContext) ClientIP(trustedHops int) string {
+	xff := sc.Header("x-forwarded-for")
+	if xff == "" {
+		return ""
+	}
+	entries := strings.Split(xff, ",")
+	i := len(entries) - 1 - trustedHops
+	if i < 0 {
+		i = 0
+	}
+	ip := net.ParseIP(strings.TrimSpace(entries[i]))
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// Method returns the request :method pseudo-header.
+func (sc *StreamContext) Method() string {
+	return sc.RequestHeaders[":method"]
+}
+
+func (sc *StreamContext) setRequestHeaders(headers *extprocv3.HttpHeaders) {
+	for _, h := range headers.GetHeaders().GetHeaders() {
+		sc.RequestHeaders[strings.ToLower(h.Key)] = headerValue(h)
+	}
+}
+
+// assignRequestID picks the stream's request ID once the request headers
+// are known and attaches it to the record, the logs and Ctx.
+func (sc *StreamContext) assignRequestID() {
+	sc.RequestID = utils.RequestIDOrNew(sc.Header(utils.RequestIDHeader))
+	sc.Record.RequestId = sc.RequestID
+	sc.Ctx = utils.WithRequestID(sc.Ctx, sc.RequestID)
+	sc.AddLogFields(logger.Fields{"request_id": sc.RequestID})
+}
+
+// startTrace opens the stream span as a child of the request's trace.
+func (sc *StreamContext) startTrace() {
+	sc.AddLogFields(logger.Fields{"authority": sc.Authority(), "path": sc.Path()})
+	ctx := tracing.Extract(sc.Ctx, sc.RequestHeaders)
+	sc.Ctx, sc.Span = tracing.Tracer().Start(ctx, "ext_proc.Process",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithTimestamp(sc.StartedAt),
+		trace.WithAttributes(
+			attribute.String("stream.id", sc.ID),
+			attribute.String("request.id", sc.RequestID),
+			attribute.String("http.method", sc.Method()),
+			attribute.String("http.host", sc.Authority()),
+			attribute.String("http.target", sc.Path()),
+		))
+}
+
+// Detach returns ctx carrying the stream's span, request ID and log fields,
+// for work that outlives the stream's own context.
+func (sc *StreamContext) Detach(ctx context.Context) context.Context {
+	ctx = logger.WithFields(ctx, logger.FieldsFrom(sc.Ctx))
+	if sc.RequestID != "" {
+		ctx = utils.WithRequestID(ctx, sc.RequestID)
+	}
+	if sc.Span == nil {
+		return ctx
+	}
+	return trace.ContextWithSpanContext(ctx, sc.Span.SpanContext())
+}
+
+// PostStreamTask captures what is left to do once the stream has ended.
+// The record is converted to its payload here, so it can be closed as soon
+// as this returns.
+func (sc *StreamContext) PostStreamTask() *service.PostStreamTask {
+	task := &service.PostStreamTask{
+		StreamID:   sc.ID,
+		RequestID:  sc.RequestID,
+		AccountID:  sc.Record.AccountId,
+		IsChat:     sc.IsChatRequest,
+		ChatFailed: sc.IsChatHasException,
+		LogFields:  logger.FieldsFrom(sc.Ctx),
+		Trace:      tracing.InjectMap(sc.Detach(context.Background())),
+	}
+	if sc.Record != nil && !sc.SkipRecord {
+		task.Record = service.NewHttpRecordPayload(sc.Record)
+		if err := sc.Record.RequestBody.ReadErr(); err != nil {
+			sc.Log().Warnf("Failed to read back the request body, record truncated: %v", err)
+		}
+		if err := sc.Record.ResponseBody.ReadErr(); err != nil {
+			sc.Log().Warnf("Failed to read back the response body, record truncated: %v", err)
+		}
+	}
+	return task
+}
+
+// EndTrace closes the stream span, if one was started, annotating it with
+// what the stream learned.
+func (sc *StreamContext) EndTrace() {
+	if sc.Span == nil {
+		return
+	}
+	sc.Span.SetAttributes(
+		attribute.String("stream.close_reason", sc.CloseReason()),
+		attribute.Int("user.id", sc.Record.UserId),
+		attribute.Int("account.id", sc.Record.AccountId),
+		attribute.Int("http.status_code", sc.Record.Status),
+	)
+	if sc.Rule != nil {
+		sc.Span.SetAttributes(attribute.String("rule", sc.Rule.Name))
+	}
+	switch sc.CloseReason() {
+	case CloseRecvError, CloseSendError, CloseHandlerError, CloseOutOfOrder:
+		sc.Span.SetStatus(codes.Error, sc.CloseReason())
+	}
+	sc.Span.End()
+}
@@ -0,0 +1,57 @@
+package processor
+
+import (
+	"context"
+	"nursor-envoy-rpc/metrics"
+	"nursor-envoy-rpc/service"
+	"nursor-envoy-rpc/utils"
+	"strconv"
+
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// StreamLimitHandler caps how many streams a user holds open at once. The
+// slot is leased for the life of the stream and given back by
+// StreamContext.Cleanup. When Redis cannot be reached streams are let
+// through.
+type StreamLimitHandler struct {
+	BaseHandler
+	// Slots defaults to service.GetStreamSlotsInstance().
+	Slots service.StreamSlots
+}
+
+func (h *StreamLimitHandler) Name() string { return "stream_limit" }
+
+func (h *StreamLimitHandler) OnRequestHeaders(sc *StreamContext, headers *extprocv3.HttpHeaders) (*Result, error) {
+	if sc.User == nil {
+		return nil, nil
+	}
+	max := sc.Config.MaxStreamsFor(string(sc.User.MembershipType))
+	if max == 0 {
+		return nil, nil
+	}
+	slots := h.Slots
+	if slots == nil {
+		instance, err := service.GetStreamSlotsInstance(sc.Ctx)
+		if err != nil {
+			return Immediate(utils.GetResponseForErr(sc.Ctx, err, sc.Header("content-type")).GetImmediateResponse()), nil
+		}
+		slots = instance
+	}
+	key := strconv.Itoa(sc.User.ID)
+	ttl := sc.Config.StreamLeaseTTL()
+	acquired, held, err := slots.Acquire(sc.Ctx, key, sc.ID, max, ttl)
+	if err != nil {
+		metrics.StreamLimitDecisions.WithLabelValues("error").Inc()
+		sc.Log().Warnf("Stream limit check failed, allowing stream: %v", err)
+		return nil, nil
+	}
+	if !acquired {
+		metrics.StreamLimitDecisions.WithLabelValues("limited").Inc()
+		err = &utils.StreamLimitError{Limit: max, Held: held}
+		return Immediate(utils.GetResponseForErr(sc.Ctx, err, sc.Header("content-type")).GetImmediateResponse()), nil
+	}
+	metrics.StreamLimitDecisions.WithLabelValues("allowed").Inc()
+	sc.AddCleanup(service.HoldStreamSlot(sc.Detach(context.Background()), slots, key, sc.ID, ttl))
+	return nil, nil
+}
@@ -0,0 +1,211 @@
+package processor
+
+import (
+	"fmt"
+	"nursor-envoy-rpc/models"
+	"nursor-envoy-rpc/models/nursor"
+	"time"
+
+	filterv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_proc/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Phase is the ext_proc message a stream most recently handled.
+type Phase int
+
+const (
+	PhaseStart Phase = iota
+	PhaseRequestHeaders
+	PhaseRequestBody
+	PhaseRequestTrailers
+	PhaseResponseHeaders
+	PhaseResponseBody
+	PhaseResponseTrailers
+	PhaseClosed
+)
+
+var phaseNames = [...]string{
+	PhaseStart:            "start",
+	PhaseRequestHeaders:   "request_headers",
+	PhaseRequestBody:      "request_body",
+	PhaseRequestTrailers:  "request_trailers",
+	PhaseResponseHeaders:  "response_headers",
+	PhaseResponseBody:     "response_body",
+	PhaseResponseTrailers: "response_trailers",
+	PhaseClosed:           "closed",
+}
+
+func (p Phase) String() string {
+	if p < 0 || int(p) >= len(phaseNames) {
+		return fmt.Sprintf("phase(%d)", int(p))
+	}
+	return phaseNames[p]
+}
+
+// Reasons recorded by StreamState.Close.
+const (
+	CloseClientEOF     = "client_eof"
+	CloseEnvoyCanceled = "envoy_canceled"
+	CloseRecvError     = "recv_error"
+	CloseSendError     = "send_error"
+	CloseImmediate     = "immediate_response"
+	CloseEndStream     = "end_stream"
+	CloseHandlerError  = "handler_error"
+	CloseOutOfOrder    = "out_of_order"
+)
+
+// Transition is one recorded phase change.
+type Transition struct {
+	From Phase
+	To   Phase
+	At   time.Time
+}
+
+// StreamState is the per-stream state machine. It validates that Envoy's
+// messages arrive in a legal order and carries what the handlers learn
+// about the stream along the way.
+//
+// Request and response sides are tracked separately because in streamed
+// body mode Envoy may interleave request body chunks with the response.
+type StreamState struct {
+	phase       Phase
+	seen        [PhaseClosed + 1]bool
+	transitions []Transition
+	closeReason string
+	closedIn    Phase
+	// immediate is set when a handler answered the stream itself.
+	immediate bool
+
+	// OnTransition, if set, is called after every accepted phase change.
+	OnTransition func(from, to Phase)
+
+	Record     *nursor.HttpRecord
+	InnerToken string
+	User       *models.User
+	Account    *models.AccountInfo
+
+	IsChatRequest      bool
+	IsChatHasException bool
+}
+
+// NewStreamState returns a state in PhaseStart recording into record.
+func NewStreamState(record *nursor.HttpRecord) *StreamState {
+	return &StreamState{Record: record}
+}
+
+// Phase returns the current phase.
+func (s *StreamState) Phase() Phase {
+	return s.phase
+}
+
+// Seen reports whether the stream has been through phase p.
+func (s *StreamState) Seen(p Phase) bool {
+	return s.seen[p]
+}
+
+// Transitions returns every accepted phase change in order.
+func (s *StreamState) Transitions() []Transition {
+	return s.transitions
+}
+
+// CloseReason returns why the stream was closed, or "" while it is open.
+func (s *StreamState) CloseReason() string {
+	return s.closeReason
+}
+
+// ClosedIn returns the phase the stream was in when it was closed.
+func (s *StreamState) ClosedIn() Phase {
+	return s.closedIn
+}
+
+// AnsweredImmediately reports whether the stream ended with an immediate
+// response, whether or not a handler error came with it.
+func (s *StreamState) AnsweredImmediately() bool {
+	return s.immediate
+}
+
+// Advance moves the stream into phase to. Messages Envoy must not send in
+// the current state are rejected with a FailedPrecondition status.
+func (s *StreamState) Advance(to Phase) error {
+	if err := s.check(to); err != nil {
+		return status.Errorf(codes.FailedPrecondition, "ext_proc: unexpected %s in phase %s: %s", to, s.phase, err)
+	}
+	s.move(to)
+	return nil
+}
+
+// Close moves the stream to PhaseClosed. Only the first reason is kept.
+func (s *StreamState) Close(reason string) {
+	if s.phase == PhaseClosed {
+		return
+	}
+	s.closeReason = reason
+	s.closedIn = s.phase
+	s.move(PhaseClosed)
+}
+
+// advanceOrClose is Advance that also closes the stream when the message
+// is out of order, since the caller will not process it.
+func (s *StreamState) advanceOrClose(to Phase) error {
+	err := s.Advance(to)
+	if err != nil {
+		s.Close(CloseOutOfOrder)
+	}
+	return err
+}
+
+// applyMode lets the state machine follow a mode override. When response
+// headers are skipped Envoy may still send response body or trailers, so
+// the headers phase is treated as already passed.
+func (s *StreamState) applyMode(mode *filterv3.ProcessingMode) {
+	if mode.GetResponseHeaderMode() == filterv3.ProcessingMode_SKIP {
+		s.seen[PhaseResponseHeaders] = true
+	}
+}
+
+func (s *StreamState) check(to Phase) error {
+	if s.seen[PhaseClosed] {
+		return fmt.Errorf("stream already closed (%s)", s.closeReason)
+	}
+	switch to {
+	case PhaseRequestHeaders:
+		if s.seen[PhaseRequestHeaders] {
+			return fmt.Errorf("request headers already received")
+		}
+	case PhaseRequestBody, PhaseRequestTrailers:
+		if !s.seen[PhaseRequestHeaders] {
+			return fmt.Errorf("request headers not received yet")
+		}
+		if s.seen[PhaseRequestTrailers] {
+			return fmt.Errorf("request trailers already received")
+		}
+	case PhaseResponseHeaders:
+		if !s.seen[PhaseRequestHeaders] {
+			return fmt.Errorf("request headers not received yet")
+		}
+		if s.seen[PhaseResponseHeaders] {
+			return fmt.Errorf("response headers already received")
+		}
+	case PhaseResponseBody, PhaseResponseTrailers:
+		if !s.seen[PhaseResponseHeaders] {
+			return fmt.Errorf("response headers not received yet")
+		}
+		if s.seen[PhaseResponseTrailers] {
+			return fmt.Errorf("response trailers already received")
+		}
+	default:
+		return fmt.Errorf("not a message phase")
+	}
+	return nil
+}
+
+func (s *StreamState) move(to Phase) {
+	from := s.phase
+	s.phase = to
+	s.seen[to] = true
+	s.transitions = append(s.transitions, Transition{From: from, To: to, At: time.Now()})
+	if s.OnTransition != nil {
+		s.OnTransition(from, to)
+	}
+}
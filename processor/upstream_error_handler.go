@@ -0,0 +1,83 @@
+package processor
+
+import (
+	"nursor-envoy-rpc/logger"
+	"strconv"
+	"strings"
+
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// UpstreamErrorHandler watches the upstream response for failures so a chat
+// stream that errored is not billed and its account gets checked. Both an
+// HTTP status >= 400 and a non-OK grpc-status count as a failure.
+type UpstreamErrorHandler struct {
+	BaseHandler
+}
+
+func (h *UpstreamErrorHandler) Name() string { return "upstream_error" }
+
+func (h *UpstreamErrorHandler) OnResponseHeaders(sc *StreamContext, headers *extprocv3.HttpHeaders) (*Result, error) {
+	failedStatus := false
+	for _, hv := range headers.GetHeaders().GetHeaders() {
+		// Trailers-only gRPC responses carry grpc-status in the headers.
+		if strings.ToLower(hv.Key) == "grpc-status" && grpcFailed(headerValue(hv)) {
+			sc.IsChatHasException = true
+		}
+		if strings.ToLower(hv.Key) != ":status" {
+			continue
+		}
+		respStatusInt, err := strconv.Atoi(headerValue(hv))
+		if err != nil {
+			sc.Log().Warnf("Error converting response status to int: %v", err)
+			continue
+		}
+		sc.Record.Status = respStatusInt
+		if respStatusInt >= 400 {
+			sc.IsChatHasException = true
+			failedStatus = true
+		}
+	}
+	if failedStatus {
+		return Immediate(&extprocv3.ImmediateResponse{Details: "upstream_error"}), nil
+	}
+	return nil, nil
+}
+
+func (h *UpstreamErrorHandler) OnResponseBody(sc *StreamContext, body *extprocv3.HttpBody) (*Result, error) {
+	// TODO: 需要优化
+	if strings.Contains(string(body.GetBody()), "resource_exhausted") || sc.IsChatHasException {
+		sc.Log().Warn("resource_exhausted")
+		return &Result{
+			BodyMutation: &extprocv3.BodyMutation{
+				Mutation: &extprocv3.BodyMutation_Body{
+					Body: []byte(`1`),
+				},
+			},
+		}, nil
+	}
+	return nil, nil
+}
+
+func (h *UpstreamErrorHandler) OnTrailers(sc *StreamContext, dir Direction, trailers *extprocv3.HttpTrailers) (*Result, error) {
+	if dir != DirectionResponse {
+		return nil, nil
+	}
+	for _, hv := range trailers.GetTrailers().GetHeaders() {
+		if strings.ToLower(hv.Key) == "grpc-status" && grpcFailed(headerValue(hv)) {
+			sc.Log().Infof("Upstream finished with grpc-status %s", headerValue(hv))
+			sc.IsChatHasException = true
+		}
+	}
+	return nil, nil
+}
+
+// grpcFailed reports whether a grpc-status value is anything but OK (0).
+func grpcFailed(value string) bool {
+	code, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		logger.L().Warnf("Error converting grpc-status to int: %v", err)
+		return false
+	}
+	return code != 0
+}
@@ -0,0 +1,128 @@
+package redact
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// DefaultHeaders are always redacted; configured headers are added to them.
+var DefaultHeaders = []string{
+	"authorization",
+	"proxy-authorization",
+	"cookie",
+	"set-cookie",
+	"nursor-token",
+	"x-client-key",
+	"x-api-key",
+}
+
+// DefaultBodyPatterns match secrets that show up in bodies and messages:
+// JWTs and bearer credentials.
+var DefaultBodyPatterns = []string{
+	`eyJ[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]+`,
+	`(?i)bearer\s+[A-Za-z0-9._~+/-]+=*`,
+}
+
+// Policy decides what is secret and how it is replaced. Secrets become a
+// short fingerprint so redacted records can still be correlated with each
+// other without storing the value.
+type Policy struct {
+	headers  map[string]bool
+	patterns []*regexp.Regexp
+}
+
+// NewPolicy builds a policy redacting the default headers and patterns plus
+// the given ones. Header names are case-insensitive.
+func NewPolicy(headers, bodyPatterns []string) (*Policy, error) {
+	p := &Policy{headers: map[string]bool{}}
+	for _, h := range append(append([]string{}, DefaultHeaders...), headers...) {
+		p.headers[strings.ToLower(h)] = true
+	}
+	for _, expr := range append(append([]string{}, DefaultBodyPatterns...), bodyPatterns...) {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("body pattern %q: %w", expr, err)
+		}
+		p.patterns = append(p.patterns, re)
+	}
+	return p, nil
+}
+
+var current atomic.Pointer[Policy]
+
+func init() {
+	p, err := NewPolicy(nil, nil)
+	if err != nil {
+		panic(err)
+	}
+	current.Store(p)
+}
+
+// Current returns the active policy.
+func Current() *Policy {
+	return current.Load()
+}
+
+// SetCurrent makes p the active policy.
+func SetCurrent(p *Policy) {
+	current.Store(p)
+}
+
+// Fingerprint returns a stable, non-reversible stand-in for value.
+func Fingerprint(value string) string {
+	if value == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(value))
+	return "[redacted:" + hex.EncodeToString(sum[:8]) + "]"
+}
+
+// IsSensitive reports whether header name is redacted.
+func (p *Policy) IsSensitive(name string) bool {
+	return p.headers[strings.ToLower(name)]
+}
+
+// Headers returns a copy of headers with sensitive values fingerprinted.
+func (p *Policy) Headers(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+	out := make(map[string]string, len(headers))
+	for name, value := range headers {
+		if p.IsSensitive(name) {
+			value = Fingerprint(value)
+		}
+		out[name] = value
+	}
+	return out
+}
+
+// String fingerprints every match of the body patterns in s.
+func (p *Policy) String(s string) string {
+	for _, re := range p.patterns {
+		s = re.ReplaceAllStringFunc(s, Fingerprint)
+	}
+	return s
+}
+
+// Body fingerprints every match of the body patterns in body. Replacements
+// keep the length of the match, padding with '*' (or only masking when the
+// match is shorter than a fingerprint), so length-prefixed encodings such
+// as protobuf stay decodable.
+func (p *Policy) Body(body []byte) []byte {
+	for _, re := range p.patterns {
+		body = re.ReplaceAllFunc(body, func(match []byte) []byte {
+			out := bytes.Repeat([]byte("*"), len(match))
+			if fp := Fingerprint(string(match)); len(fp) <= len(match) {
+				copy(out, fp)
+			}
+			return out
+		})
+	}
+	return body
+}
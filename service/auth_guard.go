@@ -0,0 +1,92 @@
+package service
+
+import (
+	"context"
+	"nursor-envoy-rpc/tracing"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// AuthGuard counts failed authentications per client and locks out clients
+// that fail too often, so tokens cannot be guessed.
+type AuthGuard interface {
+	// LockedFor returns how long client stays locked out, zero if it is not.
+	LockedFor(ctx context.Context, client string) (time.Duration, error)
+	// RecordFailure counts a failed authentication by client. Reaching max
+	// failures within window locks the client out for lockout, which is
+	// then returned.
+	RecordFailure(ctx context.Context, client string, max int, window, lockout time.Duration) (time.Duration, error)
+}
+
+// recordFailureScript counts failures in a fixed window starting at the
+// first one and swaps the counter for a lock once it reaches the limit.
+var recordFailureScript = redis.NewScript(`
+local count = redis.call('INCR', KEYS[1])
+if count == 1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+if count >= tonumber(ARGV[2]) then
+	redis.call('SET', KEYS[2], '1', 'PX', ARGV[3])
+	redis.call('DEL', KEYS[1])
+	return tonumber(ARGV[3])
+end
+return 0
+`)
+
+// RedisAuthGuard keeps failure counters and locks in Redis, shared by
+// every server instance.
+type RedisAuthGuard struct {
+	client        redis.UniversalClient
+	failurePrefix string
+	lockPrefix    string
+}
+
+var authGuardInstance *RedisAuthGuard
+var authGuardOnce sync.Once
+
+// GetAuthGuardInstance returns the guard using the UserService's Redis, failing
+// while the UserService cannot be set up.
+func GetAuthGuardInstance(ctx context.Context) (*RedisAuthGuard, error) {
+	us, err := InitUserService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	authGuardOnce.Do(func() {
+		authGuardInstance = NewRedisAuthGuard(us.defaultRedis)
+	})
+	return authGuardInstance, nil
+}
+
+// NewRedisAuthGuard returns a guard storing its state in client.
+func NewRedisAuthGuard(client redis.UniversalClient) *RedisAuthGuard {
+	return &RedisAuthGuard{
+		client:        client,
+		failurePrefix: "nursor-rpc:auth_failures:",
+		lockPrefix:    "nursor-rpc:auth_lock:",
+	}
+}
+
+func (g *RedisAuthGuard) LockedFor(ctx context.Context, client string) (time.Duration, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "redis.PTTL auth_lock", trace.WithSpanKind(trace.SpanKindClient))
+	ttl, err := g.client.PTTL(ctx, g.lockPrefix+client).Result()
+	tracing.End(span, err)
+	if err != nil || ttl < 0 {
+		// -2: no lock, -1: no expiry (never set by us)
+		return 0, err
+	}
+	return ttl, nil
+}
+
+func (g *RedisAuthGuard) RecordFailure(ctx context.Context, client string, max int, window, lockout time.Duration) (time.Duration, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "redis.EVAL auth_failure", trace.WithSpanKind(trace.SpanKindClient))
+	locked, err := recordFailureScript.Run(ctx, g.client, []string{g.failurePrefix + client, g.lockPrefix + client},
+		window.Milliseconds(), max, lockout.Milliseconds()).Int64()
+	tracing.End(span, err)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(locked) * time.Millisecond, nil
+}
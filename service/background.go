@@ -0,0 +1,98 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"nursor-envoy-rpc/logger"
+	"sync"
+)
+
+// BackgroundTasks tracks work that outlives the stream that started it,
+// such as pushing the HttpRecord and usage accounting, so shutdown can wait
+// for it instead of dropping it.
+type BackgroundTasks struct {
+	mu      sync.Mutex
+	running int
+	// idle is closed when running drops back to zero. It is nil while
+	// nothing runs.
+	idle   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// singleton instance
+var backgroundInstance *BackgroundTasks
+var backgroundOnce sync.Once
+
+// GetBackgroundInstance returns the process-wide task tracker.
+func GetBackgroundInstance() *BackgroundTasks {
+	backgroundOnce.Do(func() {
+		backgroundInstance = NewBackgroundTasks()
+	})
+	return backgroundInstance
+}
+
+// NewBackgroundTasks returns an empty tracker.
+func NewBackgroundTasks() *BackgroundTasks {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &BackgroundTasks{ctx: ctx, cancel: cancel}
+}
+
+// Go runs fn in its own goroutine. The context passed to fn is only
+// cancelled when Wait gives up on the running tasks.
+func (b *BackgroundTasks) Go(name string, fn func(ctx context.Context)) {
+	b.mu.Lock()
+	b.running++
+	if b.idle == nil {
+		b.idle = make(chan struct{})
+	}
+	b.mu.Unlock()
+
+	go func() {
+		defer b.done()
+		defer func() {
+			if r := recover(); r != nil {
+				logger.L().Errorf("Background task %s panicked: %v", name, r)
+			}
+		}()
+		fn(b.ctx)
+	}()
+}
+
+func (b *BackgroundTasks) done() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.running--
+	if b.running == 0 {
+		close(b.idle)
+		b.idle = nil
+	}
+}
+
+// Running returns the number of tasks not yet finished.
+func (b *BackgroundTasks) Running() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.running
+}
+
+// Wait blocks until no task is running or ctx is done. In the latter case
+// the remaining tasks are cancelled and an error reporting how many were
+// still running is returned.
+func (b *BackgroundTasks) Wait(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		idle := b.idle
+		b.mu.Unlock()
+		if idle == nil {
+			return nil
+		}
+		select {
+		case <-idle:
+			// Tasks started while we waited get their own round.
+		case <-ctx.Done():
+			b.cancel()
+			return fmt.Errorf("%d background tasks still running: %w", b.Running(), ctx.Err())
+		}
+	}
+}
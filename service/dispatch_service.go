@@ -7,19 +7,24 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"nursor-envoy-rpc/logger"
 
+	"nursor-envoy-rpc/metrics"
 	"nursor-envoy-rpc/models"
+	"nursor-envoy-rpc/tracing"
+	"nursor-envoy-rpc/utils"
 	"os"
 	"strconv"
 	"sync"
 	"time"
 
-	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // DispatchService manages token dispatching and request recording.
 type DispatchService struct {
-	userService     *UserService
 	accountMagerUrl string
 	initialized     bool
 }
@@ -47,17 +52,42 @@ func (ds *DispatchService) initialize() {
 		ds.accountMagerUrl = "http://172.16.238.2:31219/"
 	}
 
-	ds.userService = GetUserServiceInstance()
 	ds.initialized = true
 }
 
 // InitializeForTest initializes the service for testing purposes with a custom URL
 func (ds *DispatchService) InitializeForTest(url string) {
 	ds.accountMagerUrl = url
-	ds.userService = GetUserServiceInstance()
 	ds.initialized = true
 }
 
+// Ping checks that the account manager answers its health endpoint.
+func (ds *DispatchService) Ping(ctx context.Context) error {
+	url := ds.accountMagerUrl
+	if url == "" {
+		return fmt.Errorf("%w: URL is not configured", utils.ErrAccountManagerUnavailable)
+	}
+	if url[len(url)-1] != '/' {
+		url += "/"
+	}
+	url += "health"
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := doAccountManager(req, "health")
+	if err != nil {
+		return fmt.Errorf("%w: %w", utils.ErrAccountManagerUnavailable, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: health returned status %d", utils.ErrAccountManagerUnavailable, resp.StatusCode)
+	}
+	return nil
+}
+
 // AcquireAccountRequest represents the request body for acquiring an account
 type AcquireAccountRequest struct {
 	UserID string `json:"userId"`
@@ -77,6 +107,60 @@ type AcquireAccountErrorResponse struct {
 	Message string `json:"message"`
 }
 
+// accountManagerClient is shared by every account manager call so that
+// connections are reused; the idle pool is sized for the post-stream
+// workers pushing in parallel.
+var accountManagerClient = &http.Client{
+	Timeout:   30 * time.Second,
+	Transport: newAccountManagerTransport(),
+}
+
+func newAccountManagerTransport() http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 64
+	return transport
+}
+
+// doAccountManager sends req in its own client span, propagating the trace
+// context and request ID, and records its latency and status under endpoint.
+func doAccountManager(req *http.Request, endpoint string) (*http.Response, error) {
+	ctx, span := tracing.Tracer().Start(req.Context(), "account_manager "+endpoint,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.method", req.Method),
+			attribute.String("http.url", req.URL.String()),
+		))
+	req = req.WithContext(ctx)
+	tracing.Inject(ctx, req.Header)
+	if id := utils.RequestIDFrom(ctx); id != "" {
+		req.Header.Set(utils.RequestIDHeader, id)
+	}
+
+	start := time.Now()
+	resp, err := accountManagerClient.Do(req)
+	statusCode := 0
+	if resp != nil {
+		statusCode = resp.StatusCode
+		span.SetAttributes(attribute.Int("http.status_code", statusCode))
+		if statusCode >= 400 {
+			span.SetStatus(codes.Error, http.StatusText(statusCode))
+		}
+	}
+	metrics.ObserveAccountManager(endpoint, start, statusCode, err)
+	tracing.End(span, err)
+	return resp, err
+}
+
+// accountManagerError turns an error answer from the account manager into an
+// *utils.AccountManagerError, keeping the raw body when it is not JSON.
+func accountManagerError(statusCode int, body []byte) error {
+	var errorResp AcquireAccountErrorResponse
+	if err := json.Unmarshal(body, &errorResp); err != nil {
+		return &utils.AccountManagerError{StatusCode: statusCode, Code: string(body)}
+	}
+	return &utils.AccountManagerError{StatusCode: statusCode, Code: errorResp.Error, Message: errorResp.Message}
+}
+
 // AssignNewTokenForUser acquires a new account for the user via HTTP request
 func (ds *DispatchService) GetAccountByUserId(ctx context.Context, userID int) (*models.AccountInfo, error) {
 	// Prepare request
@@ -91,7 +175,7 @@ func (ds *DispatchService) GetAccountByUserId(ctx context.Context, userID int) (
 	// Build URL
 	url := ds.accountMagerUrl
 	if url == "" {
-		return nil, fmt.Errorf("account manager URL is not configured")
+		return nil, fmt.Errorf("%w: URL is not configured", utils.ErrAccountManagerUnavailable)
 	}
 	if url[len(url)-1] != '/' {
 		url += "/"
@@ -105,16 +189,11 @@ func (ds *DispatchService) GetAccountByUserId(ctx context.Context, userID int) (
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	// Create HTTP client with timeout
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
-
 	// Send request
-	logrus.Infof("Sending request to acquire account for user %d: %s", userID, url)
-	resp, err := client.Do(req)
+	logger.FromContext(ctx).Infof("Sending request to acquire account for user %d: %s", userID, url)
+	resp, err := doAccountManager(req, "acquire")
 	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
+		return nil, fmt.Errorf("%w: failed to send request: %w", utils.ErrAccountManagerUnavailable, err)
 	}
 	defer resp.Body.Close()
 
@@ -125,12 +204,8 @@ func (ds *DispatchService) GetAccountByUserId(ctx context.Context, userID int) (
 	}
 
 	// Handle error responses (402 or other error status codes)
-	if resp.StatusCode == http.StatusPaymentRequired || resp.StatusCode >= 400 {
-		var errorResp AcquireAccountErrorResponse
-		if err := json.Unmarshal(body, &errorResp); err != nil {
-			return nil, fmt.Errorf("account manager returned error (status %d): %s", resp.StatusCode, string(body))
-		}
-		return nil, fmt.Errorf("account manager error: %s - %s", errorResp.Error, errorResp.Message)
+	if resp.StatusCode >= 400 {
+		return nil, accountManagerError(resp.StatusCode, body)
 	}
 
 	// Parse successful response
@@ -144,7 +219,7 @@ func (ds *DispatchService) GetAccountByUserId(ctx context.Context, userID int) (
 	}
 
 	// Convert AccountInfo to models.Cursor
-	logrus.Infof("Successfully acquired account for user %d: cursor_id=%s", userID, accountResp.Account.CursorID)
+	logger.FromContext(ctx).Infof("Successfully acquired account for user %d: cursor_id=%s", userID, accountResp.Account.CursorID)
 	return &accountResp.Account, nil
 }
 
@@ -167,7 +242,7 @@ func (ds *DispatchService) IncrTokenUsage(ctx context.Context, AccountId int) er
 	// Build URL
 	url := ds.accountMagerUrl
 	if url == "" {
-		return fmt.Errorf("account manager URL is not configured")
+		return fmt.Errorf("%w: URL is not configured", utils.ErrAccountManagerUnavailable)
 	}
 	if url[len(url)-1] != '/' {
 		url += "/"
@@ -181,16 +256,11 @@ func (ds *DispatchService) IncrTokenUsage(ctx context.Context, AccountId int) er
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	// Create HTTP client with timeout
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
-
 	// Send request
-	logrus.Infof("Sending request to increment usage for account %d: %s", AccountId, url)
-	resp, err := client.Do(req)
+	logger.FromContext(ctx).Infof("Sending request to increment usage for account %d: %s", AccountId, url)
+	resp, err := doAccountManager(req, "usage/inc")
 	if err != nil {
-		return fmt.Errorf("failed to send request: %w", err)
+		return fmt.Errorf("%w: failed to send request: %w", utils.ErrAccountManagerUnavailable, err)
 	}
 	defer resp.Body.Close()
 
@@ -200,13 +270,9 @@ func (ds *DispatchService) IncrTokenUsage(ctx context.Context, AccountId int) er
 		return fmt.Errorf("failed to read response body: %w", err)
 	}
 
-	// Handle error responses
+	// Handle error responses (402 or other error status codes)
 	if resp.StatusCode >= 400 {
-		var errorResp AcquireAccountErrorResponse
-		if err := json.Unmarshal(body, &errorResp); err != nil {
-			return fmt.Errorf("account manager returned error (status %d): %s", resp.StatusCode, string(body))
-		}
-		return fmt.Errorf("account manager error: %s - %s", errorResp.Error, errorResp.Message)
+		return accountManagerError(resp.StatusCode, body)
 	}
 
 	// Check for successful response
@@ -214,7 +280,7 @@ func (ds *DispatchService) IncrTokenUsage(ctx context.Context, AccountId int) er
 		return fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
 	}
 
-	logrus.Infof("Successfully incremented usage for account %d", AccountId)
+	logger.FromContext(ctx).Infof("Successfully incremented usage for account %d", AccountId)
 	return nil
 }
 
@@ -223,7 +289,7 @@ func (ds *DispatchService) HandleTokenExpired(ctx context.Context, AccountId int
 	// Build URL with accountId in the path
 	url := ds.accountMagerUrl
 	if url == "" {
-		return fmt.Errorf("account manager URL is not configured")
+		return fmt.Errorf("%w: URL is not configured", utils.ErrAccountManagerUnavailable)
 	}
 	if url[len(url)-1] != '/' {
 		url += "/"
@@ -237,16 +303,11 @@ func (ds *DispatchService) HandleTokenExpired(ctx context.Context, AccountId int
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	// Create HTTP client with timeout
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
-
 	// Send request
-	logrus.Infof("Sending request to disable expired account %d: %s", AccountId, url)
-	resp, err := client.Do(req)
+	logger.FromContext(ctx).Infof("Sending request to disable expired account %d: %s", AccountId, url)
+	resp, err := doAccountManager(req, "disable-with-check")
 	if err != nil {
-		return fmt.Errorf("failed to send request: %w", err)
+		return fmt.Errorf("%w: failed to send request: %w", utils.ErrAccountManagerUnavailable, err)
 	}
 	defer resp.Body.Close()
 
@@ -256,13 +317,9 @@ func (ds *DispatchService) HandleTokenExpired(ctx context.Context, AccountId int
 		return fmt.Errorf("failed to read response body: %w", err)
 	}
 
-	// Handle error responses
+	// Handle error responses (402 or other error status codes)
 	if resp.StatusCode >= 400 {
-		var errorResp AcquireAccountErrorResponse
-		if err := json.Unmarshal(body, &errorResp); err != nil {
-			return fmt.Errorf("account manager returned error (status %d): %s", resp.StatusCode, string(body))
-		}
-		return fmt.Errorf("account manager error: %s - %s", errorResp.Error, errorResp.Message)
+		return accountManagerError(resp.StatusCode, body)
 	}
 
 	// Check for successful response
@@ -270,6 +327,6 @@ func (ds *DispatchService) HandleTokenExpired(ctx context.Context, AccountId int
 		return fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
 	}
 
-	logrus.Infof("Successfully disabled expired account %d", AccountId)
+	logger.FromContext(ctx).Infof("Successfully disabled expired account %d", AccountId)
 	return nil
 }
@@ -8,12 +8,13 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"nursor-envoy-rpc/logger"
+	"nursor-envoy-rpc/metrics"
 	"nursor-envoy-rpc/models/nursor"
+	"nursor-envoy-rpc/redact"
 	"os"
 	"sync"
 	"time"
-
-	"github.com/sirupsen/logrus"
 )
 
 // HttpRecordService manages HTTP record pushing to external service.
@@ -55,51 +56,78 @@ func (hrs *HttpRecordService) InitializeForTest(url string) {
 
 // HttpRecordPayload represents the payload format expected by the HTTP record API
 type HttpRecordPayload struct {
-	RequestHeaders  map[string]string `json:"request_headers"`
-	RequestBody     string            `json:"request_body"` // Base64 encoded
-	ResponseHeaders map[string]string `json:"response_headers"`
-	ResponseBody    string            `json:"response_body"` // Base64 encoded
-	Url             string            `json:"url"`
-	Method          string            `json:"method"`
-	Host            string            `json:"host"`
-	Datetime        int64             `json:"datetime"` // Unix timestamp
-	HttpVersion     string            `json:"http_version"`
-	AccountID       int               `json:"account_id"`
-	UserID          int               `json:"user_id"`
-	Status          int               `json:"status"`
+	RequestHeaders   map[string]string `json:"request_headers"`
+	RequestBody      string            `json:"request_body"` // Base64 encoded
+	ResponseHeaders  map[string]string `json:"response_headers"`
+	ResponseBody     string            `json:"response_body"` // Base64 encoded
+	ResponseTrailers map[string]string `json:"response_trailers"`
+	GrpcStatus       string            `json:"grpc_status,omitempty"`
+	GrpcMessage      string            `json:"grpc_message,omitempty"`
+	Url              string            `json:"url"`
+	Method           string            `json:"method"`
+	Host             string            `json:"host"`
+	Datetime         int64             `json:"datetime"` // Unix timestamp
+	HttpVersion      string            `json:"http_version"`
+	AccountID        int               `json:"account_id"`
+	UserID           int               `json:"user_id"`
+	Status           int               `json:"status"`
+	RequestID        string            `json:"request_id,omitempty"`
+	// Body sizes: *_size is what went over the wire, *_captured what was
+	// kept; *_truncated is set when the two differ.
+	RequestBodySize       int64 `json:"request_body_size"`
+	RequestBodyCaptured   int64 `json:"request_body_captured"`
+	RequestBodyTruncated  bool  `json:"request_body_truncated"`
+	ResponseBodySize      int64 `json:"response_body_size"`
+	ResponseBodyCaptured  int64 `json:"response_body_captured"`
+	ResponseBodyTruncated bool  `json:"response_body_truncated"`
 }
 
+var errNilRecord = fmt.Errorf("http record is nil")
+
 // PushHttpRecord pushes an HTTP record to the external service.
 func (hrs *HttpRecordService) PushHttpRecord(ctx context.Context, record *nursor.HttpRecord) error {
 	if record == nil {
-		return fmt.Errorf("http record is nil")
+		metrics.RecordPushes.WithLabelValues(metrics.Result(errNilRecord)).Inc()
+		return errNilRecord
 	}
+	return hrs.PushPayload(ctx, NewHttpRecordPayload(record))
+}
 
-	// Convert HttpRecord to API payload format
-	payload := HttpRecordPayload{
-		RequestHeaders:  record.RequestHeaders,
-		ResponseHeaders: record.ResponseHeaders,
-		Url:             record.Url,
-		Method:          record.Method,
-		Host:            record.Host,
-		HttpVersion:     record.HttpVersion,
-		AccountID:       record.AccountId,
-		UserID:          record.UserId,
-		Status:          record.Status,
+// NewHttpRecordPayload converts record to the API payload format, with
+// secrets redacted. The payload no longer refers to the record, so the
+// record can be closed once it is built.
+func NewHttpRecordPayload(record *nursor.HttpRecord) *HttpRecordPayload {
+	policy := redact.Current()
+	payload := &HttpRecordPayload{
+		RequestHeaders:   policy.Headers(record.RequestHeaders),
+		ResponseHeaders:  policy.Headers(record.ResponseHeaders),
+		ResponseTrailers: policy.Headers(record.ResponseTrailers),
+		GrpcStatus:       record.GrpcStatus,
+		GrpcMessage:      record.GrpcMessage,
+		Url:              record.Url,
+		Method:           record.Method,
+		Host:             record.Host,
+		HttpVersion:      record.HttpVersion,
+		AccountID:        record.AccountId,
+		UserID:           record.UserId,
+		Status:           record.Status,
+		RequestID:        record.RequestId,
 	}
 
 	// Encode request body to base64
-	if len(record.RequestBody) > 0 {
-		payload.RequestBody = base64.StdEncoding.EncodeToString(record.RequestBody)
-	} else {
-		payload.RequestBody = ""
+	if record.RequestBody.Len() > 0 || record.RequestBody.Truncated() {
+		payload.RequestBody = base64.StdEncoding.EncodeToString(policy.Body(record.RequestBody.Bytes()))
+		payload.RequestBodySize = record.RequestBody.Total()
+		payload.RequestBodyCaptured = record.RequestBody.Captured()
+		payload.RequestBodyTruncated = record.RequestBody.Truncated()
 	}
 
 	// Encode response body to base64
-	if len(record.ResponseBody) > 0 {
-		payload.ResponseBody = base64.StdEncoding.EncodeToString(record.ResponseBody)
-	} else {
-		payload.ResponseBody = ""
+	if record.ResponseBody.Len() > 0 || record.ResponseBody.Truncated() {
+		payload.ResponseBody = base64.StdEncoding.EncodeToString(policy.Body(record.ResponseBody.Bytes()))
+		payload.ResponseBodySize = record.ResponseBody.Total()
+		payload.ResponseBodyCaptured = record.ResponseBody.Captured()
+		payload.ResponseBodyTruncated = record.ResponseBody.Truncated()
 	}
 
 	// Convert CreateAt string to Unix timestamp
@@ -114,6 +142,14 @@ func (hrs *HttpRecordService) PushHttpRecord(ctx context.Context, record *nursor
 	} else {
 		payload.Datetime = time.Now().Unix()
 	}
+	return payload
+}
+
+// PushPayload pushes an already converted record to the external service.
+func (hrs *HttpRecordService) PushPayload(ctx context.Context, payload *HttpRecordPayload) (err error) {
+	defer func() {
+		metrics.RecordPushes.WithLabelValues(metrics.Result(err)).Inc()
+	}()
 
 	// Marshal payload to JSON
 	jsonData, err := json.Marshal(payload)
@@ -138,14 +174,9 @@ func (hrs *HttpRecordService) PushHttpRecord(ctx context.Context, record *nursor
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	// Create HTTP client with timeout
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
-
 	// Send request
-	logrus.Debugf("Pushing HTTP record to %s", url)
-	resp, err := client.Do(req)
+	logger.FromContext(ctx).Debugf("Pushing HTTP record to %s", url)
+	resp, err := doAccountManager(req, "http-record")
 	if err != nil {
 		return fmt.Errorf("failed to send request: %w", err)
 	}
@@ -167,6 +198,6 @@ func (hrs *HttpRecordService) PushHttpRecord(ctx context.Context, record *nursor
 		return fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
 	}
 
-	logrus.Debugf("Successfully pushed HTTP record for user %d, account %d", record.UserId, record.AccountId)
+	logger.FromContext(ctx).Debugf("Successfully pushed HTTP record for user %d, account %d", payload.UserID, payload.AccountID)
 	return nil
 }
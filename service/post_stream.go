@@ -0,0 +1,88 @@
+package service
+
+import (
+	"context"
+	"nursor-envoy-rpc/logger"
+	"nursor-envoy-rpc/tracing"
+	"nursor-envoy-rpc/utils"
+	"time"
+)
+
+// PostStreamTask is the work left when a stream ends: pushing its record
+// and accounting the account's usage. It only holds plain data so it can
+// be queued, spilled to disk and picked up again after a restart.
+type PostStreamTask struct {
+	StreamID   string    `json:"stream_id"`
+	RequestID  string    `json:"request_id,omitempty"`
+	EnqueuedAt time.Time `json:"enqueued_at"`
+	// Record is nil when the stream is not recorded.
+	Record *HttpRecordPayload `json:"record,omitempty"`
+	// Chat requests count towards the account's usage, or disable it when
+	// the upstream reported an exception.
+	AccountID  int  `json:"account_id"`
+	IsChat     bool `json:"is_chat"`
+	ChatFailed bool `json:"chat_failed"`
+	// LogFields and Trace restore the stream's log fields and trace
+	// context.
+	LogFields logger.Fields     `json:"log_fields,omitempty"`
+	Trace     map[string]string `json:"trace,omitempty"`
+}
+
+// Size returns the bytes of record body the task holds, which is what
+// bounds the memory queue by size.
+func (t *PostStreamTask) Size() int {
+	if t.Record == nil {
+		return 0
+	}
+	return len(t.Record.RequestBody) + len(t.Record.ResponseBody)
+}
+
+// Done reports whether nothing is left to run: RunPostStreamTask clears
+// the record and the chat flag once they are handled.
+func (t *PostStreamTask) Done() bool {
+	return t.Record == nil && !t.IsChat
+}
+
+// Context returns ctx carrying the task's log fields, request ID and trace
+// context.
+func (t *PostStreamTask) Context(ctx context.Context) context.Context {
+	ctx = logger.WithFields(ctx, t.LogFields)
+	if t.RequestID != "" {
+		ctx = utils.WithRequestID(ctx, t.RequestID)
+	}
+	return tracing.Extract(ctx, t.Trace)
+}
+
+// RunPostStreamTask pushes the task's record and updates the account's
+// usage. Failures are logged; the task is not retried.
+func RunPostStreamTask(ctx context.Context, task *PostStreamTask) {
+	ctx, span := tracing.Tracer().Start(task.Context(ctx), "post_stream")
+	defer span.End()
+	log := logger.FromContext(ctx)
+
+	if task.Record != nil {
+		// Push HTTP record to external service
+		if err := GetHttpRecordInstance().PushPayload(ctx, task.Record); err != nil {
+			log.Errorf("Failed to push HTTP record: %v", err)
+		} else {
+			// 完成的部分从任务中去掉，任务被取消落盘后不会重复执行
+			task.Record = nil
+		}
+	}
+	if task.IsChat {
+		dispatcherService := GetDispatchInstance()
+		if !task.ChatFailed {
+			if err := dispatcherService.IncrTokenUsage(ctx, task.AccountID); err != nil {
+				log.Errorf("Failed to increment usage for account %d: %v", task.AccountID, err)
+			} else {
+				task.IsChat = false
+			}
+		} else {
+			if err := dispatcherService.HandleTokenExpired(ctx, task.AccountID); err != nil {
+				log.Errorf("Failed to disable account %d: %v", task.AccountID, err)
+			} else {
+				task.IsChat = false
+			}
+		}
+	}
+}
@@ -0,0 +1,421 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"nursor-envoy-rpc/logger"
+	"nursor-envoy-rpc/metrics"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OverflowPolicy decides what happens to a task submitted while the queue
+// is full.
+type OverflowPolicy string
+
+const (
+	// OverflowDropOldest drops the longest queued task to make room.
+	OverflowDropOldest OverflowPolicy = "drop_oldest"
+	// OverflowDropNewest drops the submitted task.
+	OverflowDropNewest OverflowPolicy = "drop_newest"
+	// OverflowSpill writes the submitted task to SpillDir; workers pick
+	// spilled tasks up, oldest first, whenever the queue is empty.
+	OverflowSpill OverflowPolicy = "spill"
+)
+
+// PostStreamOptions size the post-stream worker pool.
+type PostStreamOptions struct {
+	Workers   int
+	QueueSize int
+	// QueueBytes caps the record bodies held in the memory queue, which
+	// counts as full once either limit is reached; zero means no cap.
+	QueueBytes int
+	Overflow   OverflowPolicy
+	// SpillDir holds spilled tasks: overflow under OverflowSpill, and
+	// whatever is left queued at shutdown under every policy. Empty
+	// disables spilling for the drop policies. Tasks beyond MaxSpilled
+	// files are dropped.
+	SpillDir   string
+	MaxSpilled int
+}
+
+// PostStreamOptionsFromEnv reads POST_STREAM_WORKERS (8),
+// POST_STREAM_QUEUE_SIZE (1000), POST_STREAM_QUEUE_BYTES (64 MiB),
+// POST_STREAM_OVERFLOW (drop_oldest),
+// POST_STREAM_SPILL_DIR ($TMPDIR/nursor-post-stream) and
+// POST_STREAM_MAX_SPILLED (10000).
+func PostStreamOptionsFromEnv() (PostStreamOptions, error) {
+	opts := PostStreamOptions{
+		Workers:    8,
+		QueueSize:  1000,
+		QueueBytes: 64 << 20,
+		Overflow:   OverflowDropOldest,
+		SpillDir:   filepath.Join(os.TempDir(), "nursor-post-stream"),
+		MaxSpilled: 10000,
+	}
+	for key, dst := range map[string]*int{
+		"POST_STREAM_WORKERS":     &opts.Workers,
+		"POST_STREAM_QUEUE_SIZE":  &opts.QueueSize,
+		"POST_STREAM_QUEUE_BYTES": &opts.QueueBytes,
+		"POST_STREAM_MAX_SPILLED": &opts.MaxSpilled,
+	} {
+		if value := os.Getenv(key); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s: %w", key, err)
+			}
+			*dst = n
+		}
+	}
+	if value := os.Getenv("POST_STREAM_OVERFLOW"); value != "" {
+		opts.Overflow = OverflowPolicy(value)
+	}
+	if value := os.Getenv("POST_STREAM_SPILL_DIR"); value != "" {
+		opts.SpillDir = value
+	}
+	return opts, nil
+}
+
+// PostStreamPool runs post-stream tasks on a fixed number of workers
+// behind a bounded queue, so an account manager outage cannot pile up
+// unbounded goroutines.
+type PostStreamPool struct {
+	opts PostStreamOptions
+	run  func(ctx context.Context, task *PostStreamTask)
+
+	mu    sync.Mutex
+	cond  *sync.Cond
+	queue []*PostStreamTask
+	// queuedBytes is the Size of the tasks in queue.
+	queuedBytes int
+	spilled     []string // file names in SpillDir, oldest first
+	// spilling counts spill files being written outside the lock, so they
+	// count against MaxSpilled.
+	spilling int
+	seq      uint64
+	closed   bool
+}
+
+// NewPostStreamPool returns a pool running run for each task. Tasks
+// spilled by an earlier process are queued again.
+func NewPostStreamPool(opts PostStreamOptions, run func(ctx context.Context, task *PostStreamTask)) (*PostStreamPool, error) {
+	if opts.Workers < 1 {
+		return nil, fmt.Errorf("workers must be at least 1")
+	}
+	if opts.QueueSize < 1 {
+		return nil, fmt.Errorf("queue size must be at least 1")
+	}
+	if opts.QueueBytes < 0 {
+		return nil, fmt.Errorf("queue bytes must not be negative")
+	}
+	p := &PostStreamPool{opts: opts, run: run}
+	p.cond = sync.NewCond(&p.mu)
+	switch opts.Overflow {
+	case OverflowDropOldest, OverflowDropNewest:
+	case OverflowSpill:
+		if opts.SpillDir == "" {
+			return nil, fmt.Errorf("overflow policy %s needs a spill dir", opts.Overflow)
+		}
+	default:
+		return nil, fmt.Errorf("unknown overflow policy %q", opts.Overflow)
+	}
+	if opts.SpillDir != "" {
+		if err := os.MkdirAll(opts.SpillDir, 0o700); err != nil {
+			return nil, fmt.Errorf("spill dir: %w", err)
+		}
+		entries, err := os.ReadDir(opts.SpillDir)
+		if err != nil {
+			return nil, fmt.Errorf("spill dir: %w", err)
+		}
+		for _, entry := range entries {
+			if strings.HasSuffix(entry.Name(), ".json") {
+				p.spilled = append(p.spilled, entry.Name())
+			}
+		}
+		sort.Strings(p.spilled)
+	}
+	p.updateGauges()
+	return p, nil
+}
+
+// Start runs the workers as tasks of bg, so bg.Wait covers them once the
+// pool is closed.
+func (p *PostStreamPool) Start(bg *BackgroundTasks) {
+	for i := 0; i < p.opts.Workers; i++ {
+		bg.Go("post-stream-worker", p.work)
+	}
+}
+
+// Submit queues task, applying the overflow policy when the queue is full.
+// Tasks submitted after Close are spilled or dropped.
+func (p *PostStreamPool) Submit(task *PostStreamTask) {
+	if task.EnqueuedAt.IsZero() {
+		task.EnqueuedAt = time.Now()
+	}
+	size := task.Size()
+	var spill string
+	p.mu.Lock()
+	switch {
+	case p.closed:
+		spill = p.overflow(task, "shutdown", true)
+	case !p.full(size):
+		p.push(task, size)
+	case p.opts.Overflow == OverflowDropOldest:
+		for p.full(size) {
+			p.drop(p.pop(), string(OverflowDropOldest))
+		}
+		p.push(task, size)
+	default:
+		spill = p.overflow(task, string(p.opts.Overflow), false)
+	}
+	p.updateGauges()
+	p.mu.Unlock()
+
+	// 落盘在锁外进行，磁盘慢时不阻塞其他流的收尾和 worker
+	if spill != "" {
+		p.writeSpill(task, spill)
+	}
+}
+
+// Close stops taking new tasks; the workers exit once the queue is empty.
+// Spilled tasks stay on disk for the next start.
+func (p *PostStreamPool) Close() {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	p.cond.Broadcast()
+}
+
+// Abandon spills whatever is still queued, whatever the overflow policy,
+// for when the shutdown drain timed out; the next start runs it. Tasks
+// being run when the drain was cancelled are spilled by their workers. Tasks
+// are only dropped without a SpillDir or beyond MaxSpilled. It returns how
+// many tasks it took off the queue.
+func (p *PostStreamPool) Abandon() int {
+	p.mu.Lock()
+	remaining := p.queue
+	p.queue = nil
+	p.queuedBytes = 0
+	spills := make([]string, len(remaining))
+	for i, task := range remaining {
+		spills[i] = p.overflow(task, "shutdown", true)
+	}
+	p.updateGauges()
+	p.mu.Unlock()
+
+	for i, task := range remaining {
+		if spills[i] != "" {
+			p.writeSpill(task, spills[i])
+		}
+	}
+	return len(remaining)
+}
+
+// Queued returns how many tasks wait in memory and on disk.
+func (p *PostStreamPool) Queued() (memory, spilled int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.queue), len(p.spilled)
+}
+
+func (p *PostStreamPool) work(ctx context.Context) {
+	// Wake every worker when the background context is cancelled, so none
+	// stays parked in cond.Wait.
+	stop := context.AfterFunc(ctx, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.cond.Broadcast()
+	})
+	defer stop()
+	for {
+		task := p.next(ctx)
+		if task == nil {
+			return
+		}
+		p.runTask(ctx, task)
+		if ctx.Err() != nil {
+			// 退出时等待超时，正在执行的任务被取消：未完成的部分落盘，下次启动时重试
+			p.persistCancelled(task)
+			return
+		}
+	}
+}
+
+// persistCancelled spills what is left of a task whose run was cancelled
+// by the shutdown drain timing out.
+func (p *PostStreamPool) persistCancelled(task *PostStreamTask) {
+	if task.Done() {
+		return
+	}
+	p.mu.Lock()
+	spill := p.overflow(task, "shutdown", true)
+	p.updateGauges()
+	p.mu.Unlock()
+	if spill != "" {
+		p.writeSpill(task, spill)
+	}
+}
+
+func (p *PostStreamPool) runTask(ctx context.Context, task *PostStreamTask) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.FromContext(task.Context(ctx)).Errorf("Post-stream task panicked: %v", r)
+		}
+	}()
+	metrics.PostStreamQueueWait.Observe(time.Since(task.EnqueuedAt).Seconds())
+	p.run(ctx, task)
+}
+
+// next blocks until there is a task to run. It returns nil once the pool
+// is closed and drained, or ctx is done.
+func (p *PostStreamPool) next(ctx context.Context) *PostStreamTask {
+	p.mu.Lock()
+	for {
+		if ctx.Err() != nil {
+			p.mu.Unlock()
+			return nil
+		}
+		if len(p.queue) > 0 {
+			task := p.pop()
+			p.updateGauges()
+			p.mu.Unlock()
+			return task
+		}
+		if !p.closed && len(p.spilled) > 0 {
+			name := p.spilled[0]
+			p.spilled = p.spilled[1:]
+			p.updateGauges()
+			p.mu.Unlock()
+			if task := p.unspill(name); task != nil {
+				return task
+			}
+			p.mu.Lock()
+			continue
+		}
+		if p.closed {
+			p.mu.Unlock()
+			return nil
+		}
+		p.cond.Wait()
+	}
+}
+
+// full reports whether a task of size bytes does not fit in the memory
+// queue. A task larger than QueueBytes still fits in an empty queue.
+// p.mu must be held.
+func (p *PostStreamPool) full(size int) bool {
+	if len(p.queue) >= p.opts.QueueSize {
+		return true
+	}
+	return p.opts.QueueBytes > 0 && len(p.queue) > 0 && p.queuedBytes+size > p.opts.QueueBytes
+}
+
+// push appends task to the memory queue. p.mu must be held.
+func (p *PostStreamPool) push(task *PostStreamTask, size int) {
+	p.queue = append(p.queue, task)
+	p.queuedBytes += size
+	p.cond.Signal()
+}
+
+// pop takes the oldest task off the memory queue. p.mu must be held.
+func (p *PostStreamPool) pop() *PostStreamTask {
+	task := p.queue[0]
+	p.queue[0] = nil
+	p.queue = p.queue[1:]
+	p.queuedBytes -= task.Size()
+	return task
+}
+
+// overflow handles a task that cannot be queued. It returns the spill file
+// name reserved for the task when it is to be spilled, which OverflowSpill
+// does always and the other policies only at shutdown; otherwise the task
+// is dropped for reason. p.mu must be held.
+func (p *PostStreamPool) overflow(task *PostStreamTask, reason string, shutdown bool) string {
+	if p.opts.SpillDir == "" || (p.opts.Overflow != OverflowSpill && !shutdown) {
+		p.drop(task, reason)
+		return ""
+	}
+	if len(p.spilled)+p.spilling >= p.opts.MaxSpilled {
+		p.drop(task, "spill_full")
+		return ""
+	}
+	p.seq++
+	p.spilling++
+	return fmt.Sprintf("%020d-%06d.json", time.Now().UnixNano(), p.seq%1000000)
+}
+
+// writeSpill writes task to the file name reserved by overflow. It must be
+// called without p.mu held.
+func (p *PostStreamPool) writeSpill(task *PostStreamTask, name string) {
+	err := writeSpillFile(filepath.Join(p.opts.SpillDir, name), task)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	defer p.updateGauges()
+	p.spilling--
+	if err != nil {
+		logger.L().Errorf("Failed to spill post-stream task: %v", err)
+		p.drop(task, "spill_error")
+		return
+	}
+	// Writes finish out of order; keep the list oldest first.
+	i := sort.SearchStrings(p.spilled, name)
+	p.spilled = append(p.spilled, "")
+	copy(p.spilled[i+1:], p.spilled[i:])
+	p.spilled[i] = name
+	p.cond.Signal()
+}
+
+func writeSpillFile(path string, task *PostStreamTask) error {
+	data, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// unspill reads back and removes the spilled task name, taken off the list
+// by the caller, or returns nil when it cannot be read. It must be called
+// without p.mu held.
+func (p *PostStreamPool) unspill(name string) *PostStreamTask {
+	path := filepath.Join(p.opts.SpillDir, name)
+	data, err := os.ReadFile(path)
+	os.Remove(path)
+	if err != nil {
+		logger.L().Errorf("Failed to read spilled post-stream task %s: %v", name, err)
+		metrics.PostStreamDropped.WithLabelValues("spill_error").Inc()
+		return nil
+	}
+	var task PostStreamTask
+	if err := json.Unmarshal(data, &task); err != nil {
+		logger.L().Errorf("Failed to decode spilled post-stream task %s: %v", name, err)
+		metrics.PostStreamDropped.WithLabelValues("spill_error").Inc()
+		return nil
+	}
+	return &task
+}
+
+func (p *PostStreamPool) drop(task *PostStreamTask, reason string) {
+	metrics.PostStreamDropped.WithLabelValues(reason).Inc()
+	logger.FromContext(task.Context(context.Background())).Warnf("Dropped post-stream task (%s)", reason)
+}
+
+func (p *PostStreamPool) updateGauges() {
+	metrics.PostStreamQueueDepth.Set(float64(len(p.queue)))
+	metrics.PostStreamQueueBytes.Set(float64(p.queuedBytes))
+	metrics.PostStreamSpilled.Set(float64(len(p.spilled)))
+}
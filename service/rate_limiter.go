@@ -0,0 +1,118 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"nursor-envoy-rpc/tracing"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RateDecision is the outcome of one rate limit check.
+type RateDecision struct {
+	Allowed bool
+	// Remaining is how many more requests the window allows.
+	Remaining int
+	// RetryAfter is how long until the oldest request leaves the window;
+	// only set when the request was refused.
+	RetryAfter time.Duration
+	// Member identifies the recorded request for Refund; only set when the
+	// request was allowed.
+	Member string
+}
+
+// RateLimiter counts requests per key in a sliding window.
+type RateLimiter interface {
+	Allow(ctx context.Context, key string, limit int, window time.Duration) (RateDecision, error)
+	// Refund removes an allowed request from the window again, for requests
+	// rejected after being counted.
+	Refund(ctx context.Context, key, member string) error
+}
+
+// slidingWindowScript keeps one sorted set member per request, scored by
+// its start time in milliseconds. Members older than the window are dropped
+// before counting, so the limit applies to any window-long interval.
+var slidingWindowScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local count = redis.call('ZCARD', KEYS[1])
+if count < limit then
+	redis.call('ZADD', KEYS[1], now, ARGV[4])
+	redis.call('PEXPIRE', KEYS[1], window)
+	return {1, limit - count - 1, 0}
+end
+local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+local retry = window
+if oldest[2] then
+	retry = tonumber(oldest[2]) + window - now
+end
+return {0, 0, retry}
+`)
+
+// RedisRateLimiter is a sliding window log rate limiter shared by every
+// server instance through Redis.
+type RedisRateLimiter struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+var rateLimiterInstance *RedisRateLimiter
+var rateLimiterOnce sync.Once
+
+// GetRateLimiterInstance returns the limiter using the UserService's Redis, failing
+// while the UserService cannot be set up.
+func GetRateLimiterInstance(ctx context.Context) (*RedisRateLimiter, error) {
+	us, err := InitUserService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rateLimiterOnce.Do(func() {
+		rateLimiterInstance = NewRedisRateLimiter(us.defaultRedis)
+	})
+	return rateLimiterInstance, nil
+}
+
+// NewRedisRateLimiter returns a limiter storing its windows in client.
+func NewRedisRateLimiter(client redis.UniversalClient) *RedisRateLimiter {
+	return &RedisRateLimiter{client: client, prefix: "nursor-rpc:ratelimit:"}
+}
+
+// Allow records a request under key and reports whether it fits in limit
+// requests per window. Refused requests are not recorded.
+func (l *RedisRateLimiter) Allow(ctx context.Context, key string, limit int, window time.Duration) (RateDecision, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "redis.EVAL rate_limit", trace.WithSpanKind(trace.SpanKindClient))
+	now := time.Now().UnixMilli()
+	member := fmt.Sprintf("%d-%s", now, uuid.NewString())
+	res, err := slidingWindowScript.Run(ctx, l.client, []string{l.prefix + key},
+		now, window.Milliseconds(), limit, member).Int64Slice()
+	tracing.End(span, err)
+	if err != nil {
+		return RateDecision{}, err
+	}
+	if len(res) != 3 {
+		return RateDecision{}, fmt.Errorf("unexpected rate limit reply %v", res)
+	}
+	decision := RateDecision{
+		Allowed:    res[0] == 1,
+		Remaining:  int(res[1]),
+		RetryAfter: time.Duration(res[2]) * time.Millisecond,
+	}
+	if decision.Allowed {
+		decision.Member = member
+	}
+	return decision, nil
+}
+
+// Refund removes member, recorded by Allow, from the window under key.
+func (l *RedisRateLimiter) Refund(ctx context.Context, key, member string) error {
+	ctx, span := tracing.Tracer().Start(ctx, "redis.ZREM rate_limit", trace.WithSpanKind(trace.SpanKindClient))
+	err := l.client.ZRem(ctx, l.prefix+key, member).Err()
+	tracing.End(span, err)
+	return err
+}
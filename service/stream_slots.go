@@ -0,0 +1,142 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"nursor-envoy-rpc/logger"
+	"nursor-envoy-rpc/tracing"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// StreamSlots tracks the open streams of each user as leases that expire
+// unless renewed, so slots held by a crashed server free themselves.
+type StreamSlots interface {
+	// Acquire takes a slot for member under key if fewer than max leases
+	// are live, returning whether it did and how many are held.
+	Acquire(ctx context.Context, key, member string, max int, ttl time.Duration) (bool, int, error)
+	Renew(ctx context.Context, key, member string, ttl time.Duration) error
+	Release(ctx context.Context, key, member string) error
+}
+
+// acquireSlotScript stores leases in a sorted set scored by their expiry
+// in milliseconds and drops expired ones before counting.
+var acquireSlotScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local ttl = tonumber(ARGV[2])
+local max = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+local count = redis.call('ZCARD', KEYS[1])
+if count >= max then
+	return {0, count}
+end
+redis.call('ZADD', KEYS[1], now + ttl, ARGV[4])
+redis.call('PEXPIRE', KEYS[1], ttl)
+return {1, count + 1}
+`)
+
+// renewSlotScript extends a lease that is still held.
+var renewSlotScript = redis.NewScript(`
+if not redis.call('ZSCORE', KEYS[1], ARGV[3]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], tonumber(ARGV[1]) + tonumber(ARGV[2]), ARGV[3])
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return 1
+`)
+
+// RedisStreamSlots keeps stream leases in Redis, shared by every server
+// instance.
+type RedisStreamSlots struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+var streamSlotsInstance *RedisStreamSlots
+var streamSlotsOnce sync.Once
+
+// GetStreamSlotsInstance returns the stream slots using the UserService's Redis, failing
+// while the UserService cannot be set up.
+func GetStreamSlotsInstance(ctx context.Context) (*RedisStreamSlots, error) {
+	us, err := InitUserService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	streamSlotsOnce.Do(func() {
+		streamSlotsInstance = NewRedisStreamSlots(us.defaultRedis)
+	})
+	return streamSlotsInstance, nil
+}
+
+// NewRedisStreamSlots returns stream slots stored in client.
+func NewRedisStreamSlots(client redis.UniversalClient) *RedisStreamSlots {
+	return &RedisStreamSlots{client: client, prefix: "nursor-rpc:streams:"}
+}
+
+func (s *RedisStreamSlots) Acquire(ctx context.Context, key, member string, max int, ttl time.Duration) (bool, int, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "redis.EVAL stream_slot_acquire", trace.WithSpanKind(trace.SpanKindClient))
+	res, err := acquireSlotScript.Run(ctx, s.client, []string{s.prefix + key},
+		time.Now().UnixMilli(), ttl.Milliseconds(), max, member).Int64Slice()
+	tracing.End(span, err)
+	if err != nil {
+		return false, 0, err
+	}
+	if len(res) != 2 {
+		return false, 0, fmt.Errorf("unexpected stream slot reply %v", res)
+	}
+	return res[0] == 1, int(res[1]), nil
+}
+
+func (s *RedisStreamSlots) Renew(ctx context.Context, key, member string, ttl time.Duration) error {
+	renewed, err := renewSlotScript.Run(ctx, s.client, []string{s.prefix + key},
+		time.Now().UnixMilli(), ttl.Milliseconds(), member).Int()
+	if err != nil {
+		return err
+	}
+	if renewed == 0 {
+		return fmt.Errorf("stream slot %s of %s expired", member, key)
+	}
+	return nil
+}
+
+func (s *RedisStreamSlots) Release(ctx context.Context, key, member string) error {
+	return s.client.ZRem(ctx, s.prefix+key, member).Err()
+}
+
+// HoldStreamSlot renews an acquired lease every third of ttl until the
+// returned release func is called, which also gives the slot back. ctx
+// only carries log fields and trace; it should outlive the stream.
+func HoldStreamSlot(ctx context.Context, slots StreamSlots, key, member string, ttl time.Duration) (release func()) {
+	renewCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-renewCtx.Done():
+				return
+			case <-ticker.C:
+				if err := slots.Renew(renewCtx, key, member, ttl); err != nil && renewCtx.Err() == nil {
+					logger.FromContext(ctx).Warnf("Failed to renew stream slot: %v", err)
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cancel()
+			<-done
+			releaseCtx, cancelRelease := context.WithTimeout(ctx, 2*time.Second)
+			defer cancelRelease()
+			if err := slots.Release(releaseCtx, key, member); err != nil {
+				logger.FromContext(ctx).Warnf("Failed to release stream slot: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"nursor-envoy-rpc/logger"
+)
+
+// ErrTokenHashColumnMissing is returned by BackfillTokenHashes when
+// user_user has no inner_token_hash column yet.
+var ErrTokenHashColumnMissing = errors.New("user_user.inner_token_hash does not exist: add it with a Django migration or the SQL in the readme first")
+
+// BackfillTokenHashes sets the hash of every user whose hash is missing or
+// no longer matches inner_token, batchSize rows at a time. It only writes
+// hashes: the column and its index must already exist, since the schema
+// belongs to the Django side. It returns the number of rows updated and
+// can be rerun safely.
+func (us *UserService) BackfillTokenHashes(ctx context.Context, batchSize int) (int, error) {
+	if !us.tokens.HasKey() {
+		return 0, errors.New("INNER_TOKEN_HMAC_KEY is not set")
+	}
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+	if !us.store.HasTokenHashColumn(ctx) {
+		return 0, ErrTokenHashColumnMissing
+	}
+
+	updated, lastID := 0, 0
+	for {
+		rows, err := us.store.Tokens(ctx, lastID, batchSize)
+		if err != nil {
+			return updated, err
+		}
+		if len(rows) == 0 {
+			return updated, nil
+		}
+		for _, r := range rows {
+			lastID = r.ID
+			hash := us.tokens.Hash(r.InnerToken)
+			if r.InnerTokenHash != nil && *r.InnerTokenHash == hash {
+				continue
+			}
+			// 只在 token 未被同时修改时写入
+			changed, err := us.store.SetTokenHash(ctx, r.ID, r.InnerToken, hash)
+			if err != nil {
+				return updated, err
+			}
+			if changed {
+				updated++
+			}
+		}
+		logger.L().Infof("Backfilled token hashes up to user %d (%d updated)", lastID, updated)
+	}
+}
@@ -0,0 +1,219 @@
+package service
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"nursor-envoy-rpc/models"
+	"nursor-envoy-rpc/utils"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// LocalUserCache is the in-process tier in front of the Redis user cache.
+// It keeps the most recently used tokens for a short TTL, including tokens
+// known to belong to no user, and makes concurrent lookups of the same
+// token share one load.
+type LocalUserCache struct {
+	size int
+	ttl  time.Duration
+
+	mu    sync.Mutex
+	order *list.List // front is most recently used
+	items map[string]*list.Element
+	// gen changes on every eviction, so loads that started before it do
+	// not cache what they read.
+	gen   uint64
+	group singleflight.Group
+}
+
+type localUserEntry struct {
+	token     string
+	user      *models.User // nil for unknown tokens
+	expiresAt time.Time
+}
+
+// NewLocalUserCache returns a cache of at most size tokens kept for ttl. A
+// size of zero keeps nothing but still deduplicates concurrent loads.
+func NewLocalUserCache(size int, ttl time.Duration) *LocalUserCache {
+	return &LocalUserCache{size: size, ttl: ttl, order: list.New(), items: map[string]*list.Element{}}
+}
+
+// localUserCacheFromEnv reads USER_LOCAL_CACHE_SIZE (10000, 0 disables)
+// and USER_LOCAL_CACHE_TTL (5s).
+func localUserCacheFromEnv() *LocalUserCache {
+	size, err := strconv.Atoi(os.Getenv("USER_LOCAL_CACHE_SIZE"))
+	if err != nil || size < 0 {
+		size = 10000
+	}
+	ttl, err := time.ParseDuration(os.Getenv("USER_LOCAL_CACHE_TTL"))
+	if err != nil || ttl <= 0 {
+		ttl = 5 * time.Second
+	}
+	return NewLocalUserCache(size, ttl)
+}
+
+// Get returns the live entry for token. unknown is set when the token is
+// cached as belonging to no user.
+func (c *LocalUserCache) Get(token string) (user *models.User, unknown, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, found := c.items[token]
+	if !found {
+		return nil, false, false
+	}
+	entry := elem.Value.(*localUserEntry)
+	if !time.Now().Before(entry.expiresAt) {
+		c.remove(elem)
+		return nil, false, false
+	}
+	c.order.MoveToFront(elem)
+	if entry.user == nil {
+		return nil, true, true
+	}
+	return copyUser(entry.user), false, true
+}
+
+// Set caches user for token, or the token as unknown when user is nil, for
+// the cache TTL but at most ttl.
+func (c *LocalUserCache) Set(token string, user *models.User, ttl time.Duration) {
+	c.mu.Lock()
+	gen := c.gen
+	c.mu.Unlock()
+	c.set(token, user, ttl, gen)
+}
+
+// set caches the entry unless the cache was evicted from since gen.
+func (c *LocalUserCache) set(token string, user *models.User, ttl time.Duration, gen uint64) {
+	if c.size == 0 {
+		return
+	}
+	if ttl > c.ttl || ttl <= 0 {
+		ttl = c.ttl
+	}
+	if user != nil {
+		user = copyUser(user)
+	}
+	entry := &localUserEntry{token: token, user: user, expiresAt: time.Now().Add(ttl)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen != gen {
+		return
+	}
+	if elem, found := c.items[token]; found {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.items[token] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+// Delete forgets token. Loads of token already running are not cached.
+func (c *LocalUserCache) Delete(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.group.Forget(token)
+	if elem, found := c.items[token]; found {
+		c.remove(elem)
+	}
+}
+
+// TokensOf returns the tokens cached for the user with id.
+func (c *LocalUserCache) TokensOf(id int) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var tokens []string
+	for token, elem := range c.items {
+		if user := elem.Value.(*localUserEntry).user; user != nil && user.ID == id {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// DeleteUser forgets every token cached for the user with id and returns
+// them.
+func (c *LocalUserCache) DeleteUser(id int) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	var tokens []string
+	for token, elem := range c.items {
+		if user := elem.Value.(*localUserEntry).user; user != nil && user.ID == id {
+			tokens = append(tokens, token)
+			c.group.Forget(token)
+			c.remove(elem)
+		}
+	}
+	return tokens
+}
+
+// Purge forgets everything, for when invalidations may have been missed.
+func (c *LocalUserCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.order.Init()
+	c.items = map[string]*list.Element{}
+}
+
+// Len returns the number of cached tokens, expired ones included until
+// they are looked up or evicted.
+func (c *LocalUserCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func (c *LocalUserCache) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.items, elem.Value.(*localUserEntry).token)
+}
+
+// Lookup returns the user owning token from the cache, or loads it once for
+// all concurrent callers and caches the result: users for at most
+// userTTL(user), unknown tokens (utils.ErrUserNotFound) for the cache TTL.
+// Other errors are not cached. local reports whether the cache answered.
+func (c *LocalUserCache) Lookup(ctx context.Context, token string, load func(ctx context.Context) (*models.User, error), userTTL func(*models.User) time.Duration) (user *models.User, local bool, err error) {
+	if user, unknown, ok := c.Get(token); ok {
+		if unknown {
+			return nil, true, fmt.Errorf("%w: token cached as unknown", utils.ErrUserNotFound)
+		}
+		return user, true, nil
+	}
+	// The load is shared, so a caller giving up must not cancel it for
+	// the others.
+	loadCtx := context.WithoutCancel(ctx)
+	result, err, _ := c.group.Do(token, func() (interface{}, error) {
+		c.mu.Lock()
+		gen := c.gen
+		c.mu.Unlock()
+		user, err := load(loadCtx)
+		switch {
+		case err == nil:
+			c.set(token, user, userTTL(user), gen)
+		case errors.Is(err, utils.ErrUserNotFound):
+			c.set(token, nil, c.ttl, gen)
+		}
+		return user, err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return copyUser(result.(*models.User)), false, nil
+}
+
+func copyUser(user *models.User) *models.User {
+	u := *user
+	return &u
+}
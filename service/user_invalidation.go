@@ -0,0 +1,217 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"nursor-envoy-rpc/logger"
+	"nursor-envoy-rpc/metrics"
+	"nursor-envoy-rpc/redact"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// UserInvalidationChannel is the Redis pub/sub channel on which every
+// instance listens for users whose cached entry must be dropped. Anything
+// able to PUBLISH (the admin endpoint, the -invalidate-user flag, a
+// publisher fed by database triggers) can use it.
+const UserInvalidationChannel = "nursor-rpc:user_cache:invalidate"
+
+// UserInvalidation names a user whose cache entries are stale, by ID, by
+// inner token or token hash, or several of them. The message on
+// UserInvalidationChannel is its JSON, e.g. {"user_id": 42}.
+type UserInvalidation struct {
+	UserID    int    `json:"user_id,omitempty"`
+	Token     string `json:"token,omitempty"`
+	TokenHash string `json:"token_hash,omitempty"`
+}
+
+// ParseUserInvalidation decodes a message from UserInvalidationChannel. A
+// bare number is accepted as a user ID.
+func ParseUserInvalidation(payload string) (UserInvalidation, error) {
+	var inv UserInvalidation
+	var id int
+	if err := json.Unmarshal([]byte(payload), &id); err == nil {
+		inv.UserID = id
+	} else if err := json.Unmarshal([]byte(payload), &inv); err != nil {
+		return inv, fmt.Errorf("invalid user invalidation %q: %w", payload, err)
+	}
+	return inv, inv.Validate()
+}
+
+// Validate checks that the invalidation names a user.
+func (inv UserInvalidation) Validate() error {
+	if inv.UserID <= 0 && inv.Token == "" && inv.TokenHash == "" {
+		return errors.New("user invalidation needs a user_id, token or token_hash")
+	}
+	return nil
+}
+
+// PublishUserInvalidation drops the user's entries from Redis and tells
+// every instance to drop them from its local cache.
+func PublishUserInvalidation(ctx context.Context, inv UserInvalidation) error {
+	us, err := InitUserService(ctx)
+	if err != nil {
+		return err
+	}
+	return us.InvalidateUser(ctx, inv)
+}
+
+// InvalidateUser evicts the user here and publishes the invalidation for
+// the other instances. The token is looked up by ID when missing so that
+// subscribers need not query the database. When tokens are hashed only the
+// hash is published.
+func (us *UserService) InvalidateUser(ctx context.Context, inv UserInvalidation) error {
+	if err := inv.Validate(); err != nil {
+		return err
+	}
+	if err := us.resolveToken(ctx, &inv); err != nil {
+		return err
+	}
+	if us.tokens.Hashed() && inv.Token != "" {
+		inv.TokenHash = us.tokens.Hash(inv.Token)
+		inv.Token = ""
+	}
+	if err := us.evictUser(ctx, inv); err != nil {
+		return err
+	}
+	payload, _ := json.Marshal(inv)
+	return us.defaultRedis.Publish(ctx, UserInvalidationChannel, payload).Err()
+}
+
+// resolveToken fills in the current inner token of inv.UserID, or its hash
+// once the plaintext is gone, when the invalidation only names the user.
+// Unknown IDs keep an empty token.
+func (us *UserService) resolveToken(ctx context.Context, inv *UserInvalidation) error {
+	if inv.Token != "" || inv.TokenHash != "" || inv.UserID <= 0 {
+		return nil
+	}
+	row, err := us.store.TokenOf(ctx, inv.UserID, us.tokens.Hashed())
+	if err != nil {
+		return fmt.Errorf("look up token of user %d: %w", inv.UserID, err)
+	}
+	inv.Token = row.InnerToken
+	if row.InnerToken == "" && row.InnerTokenHash != nil {
+		inv.TokenHash = *row.InnerTokenHash
+	}
+	return nil
+}
+
+// cacheKey returns the key the invalidated token is cached under, empty
+// when it names none usable here.
+func (us *UserService) cacheKey(inv UserInvalidation) string {
+	switch {
+	case inv.Token != "":
+		return us.tokens.CacheKey(inv.Token)
+	case us.tokens.Hashed():
+		return inv.TokenHash
+	}
+	return ""
+}
+
+// evictUser drops the user's Redis entries, then the local ones, so a
+// lookup racing with it cannot refill the local cache from Redis. Keys the
+// local cache still holds for the user ID are dropped from Redis too,
+// which covers tokens rotated since they were cached.
+func (us *UserService) evictUser(ctx context.Context, inv UserInvalidation) error {
+	key := us.cacheKey(inv)
+	var keys []string
+	if key != "" {
+		keys = append(keys, us.userCachePrefix+key)
+	}
+	if inv.UserID > 0 {
+		for _, cached := range us.localCache.TokensOf(inv.UserID) {
+			if cached != key {
+				keys = append(keys, us.userCachePrefix+cached)
+			}
+		}
+	}
+	var err error
+	if len(keys) > 0 {
+		err = us.defaultRedis.Del(ctx, keys...).Err()
+	}
+
+	if key != "" {
+		us.localCache.Delete(key)
+	}
+	if inv.UserID > 0 {
+		us.localCache.DeleteUser(inv.UserID)
+	}
+	return err
+}
+
+// WatchUserInvalidations subscribes to UserInvalidationChannel until ctx is
+// done, evicting every user announced on it. It waits for the UserService
+// to come up first, retrying every retry.
+func WatchUserInvalidations(ctx context.Context, retry time.Duration) {
+	for {
+		us, err := InitUserService(ctx)
+		if err == nil {
+			us.watchInvalidations(ctx)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+	}
+}
+
+func (us *UserService) watchInvalidations(ctx context.Context) {
+	pubsub := us.defaultRedis.Subscribe(ctx, UserInvalidationChannel)
+	defer pubsub.Close()
+
+	// Subscription confirmations arrive on every (re)connect. Anything
+	// published while disconnected was missed, so the local cache is
+	// dropped; Redis entries were already deleted by the publisher.
+	messages := pubsub.ChannelWithSubscriptions(ctx, 100)
+	subscribed := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			switch m := msg.(type) {
+			case *redis.Subscription:
+				if m.Kind != "subscribe" {
+					continue
+				}
+				if subscribed {
+					logger.L().Warn("Resubscribed to user invalidations, purging the local user cache")
+					us.localCache.Purge()
+				} else {
+					logger.L().Infof("Listening for user invalidations on %s", UserInvalidationChannel)
+				}
+				subscribed = true
+			case *redis.Message:
+				us.handleInvalidation(ctx, m.Payload)
+			}
+		}
+	}
+}
+
+func (us *UserService) handleInvalidation(ctx context.Context, payload string) {
+	inv, err := ParseUserInvalidation(payload)
+	if err != nil {
+		metrics.UserInvalidations.WithLabelValues("invalid").Inc()
+		logger.L().Warnf("Ignoring user invalidation: %v", err)
+		return
+	}
+	// 其他发布者（如数据库触发器）可能只给出用户 ID，也没有删除 Redis 中的缓存
+	if err := us.resolveToken(ctx, &inv); err != nil {
+		logger.L().Warnf("Failed to resolve the token of user %d: %v", inv.UserID, err)
+	}
+	if err := us.evictUser(ctx, inv); err != nil {
+		metrics.UserInvalidations.WithLabelValues("error").Inc()
+		logger.L().Warnf("Failed to evict user %d (token %s): %v", inv.UserID, redact.Fingerprint(us.cacheKey(inv)), err)
+		return
+	}
+	metrics.UserInvalidations.WithLabelValues("evicted").Inc()
+	logger.L().Infof("Evicted user %d (token %s) from the user cache", inv.UserID, redact.Fingerprint(us.cacheKey(inv)))
+}
@@ -3,84 +3,255 @@ package service
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"nursor-envoy-rpc/helper"
+	"nursor-envoy-rpc/logger"
+	"nursor-envoy-rpc/metrics"
 	"nursor-envoy-rpc/models"
+	"nursor-envoy-rpc/tracing"
+	"nursor-envoy-rpc/utils"
 	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"gorm.io/gorm"
 )
 
 // UserService manages user-related operations with Redis caching and token validation.
 type UserService struct {
-	defaultRedis                *redis.Client
-	db                          *gorm.DB
+	defaultRedis                redis.UniversalClient
+	store                       UserStore
 	userCachePrefix             string
 	userCachePrefixID           string
 	userSubscriptionCachePrefix string
-	initialized                 bool
+	// expiryGrace is how long users keep working after ExpiredAt.
+	expiryGrace time.Duration
+	// negativeCacheTTL is how long unknown tokens are cached; zero
+	// disables it.
+	negativeCacheTTL time.Duration
+	// localCache answers repeated lookups without going to Redis. It is
+	// keyed like Redis, by tokens.CacheKey.
+	localCache *LocalUserCache
+	// tokens hashes inner tokens for cache keys and lookups.
+	tokens *TokenHasher
 }
 
 // singleton instance
 var userInstance *UserService
-var userOnce sync.Once
-
-// GetUserServiceInstance returns the singleton instance of UserService.
-func GetUserServiceInstance() *UserService {
-	userOnce.Do(func() {
-		db := helper.GetNewDB()
-		redisClient := helper.GetNewRedis()
-		userInstance = &UserService{}
-		userInstance.initialize(db, redisClient)
-	})
-	return userInstance
-}
+var userMu sync.Mutex
 
-// initialize sets up the UserService with the provided database and Redis client.
-func (us *UserService) initialize(db *gorm.DB, redisClient *redis.Client) {
-	if us.initialized {
-		return
+// InitUserService returns the singleton UserService, creating it if needed.
+// Only the database must answer: Redis is a cache and is reported by its own
+// probe. Failures unwrap to utils.ErrUserServiceUnavailable and leave no
+// instance behind, so the call can simply be retried.
+func InitUserService(ctx context.Context) (*UserService, error) {
+	userMu.Lock()
+	defer userMu.Unlock()
+	if userInstance != nil {
+		return userInstance, nil
 	}
-	if redisClient == nil {
-		redisClient = helper.GetNewRedis() // Assume this function exists
+
+	tokens, err := TokenHasherFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("inner token hashing: %w", err)
 	}
-	if db == nil {
-		db = helper.GetNewDB() // Assume this function exists
+	db, err := helper.OpenDB()
+	if err != nil {
+		return nil, fmt.Errorf("%w: database: %w", utils.ErrUserServiceUnavailable, err)
 	}
-	us.defaultRedis = redisClient
-	us.db = db
+	userInstance = NewUserService(NewGormUserStore(db), helper.GetNewRedis(), tokens)
+	return userInstance, nil
+}
 
+// NewUserService returns a UserService reading users from store and caching
+// them in cache, with the remaining settings taken from the environment.
+// A nil tokens means plain lookups.
+func NewUserService(store UserStore, cache redis.UniversalClient, tokens *TokenHasher) *UserService {
+	if tokens == nil {
+		tokens, _ = NewTokenHasher(nil, TokenLookupPlain)
+	}
+	us := &UserService{
+		defaultRedis: cache,
+		store:        store,
+		tokens:       tokens,
+	}
+	// 哈希模式下使用新的前缀，旧的明文 key 自然过期
 	us.userCachePrefix = "nursor-rpc:user_cache:innertoken:"
+	if us.tokens.Hashed() {
+		us.userCachePrefix = "nursor-rpc:user_cache:tokenhash:"
+	}
 	us.userCachePrefixID = "nursor-rpc:user_cache:id"
 	us.userSubscriptionCachePrefix = "nursor-rpc:user_subscription_cache:"
-	us.initialized = true
+	us.expiryGrace = expiryGraceFromEnv()
+	us.negativeCacheTTL = negativeCacheTTLFromEnv()
+	us.localCache = localUserCacheFromEnv()
+	return us
+}
+
+// PingDB checks that the database accepts connections.
+func (us *UserService) PingDB(ctx context.Context) error {
+	return us.store.Ping(ctx)
+}
+
+// PingRedis checks that Redis answers PING.
+func (us *UserService) PingRedis(ctx context.Context) error {
+	return us.defaultRedis.Ping(ctx).Err()
 }
 
-func (us *UserService) GetUserByInnerToken(ctx context.Context, innerToken string) (*models.User, error) {
-	var user models.User
-	usercache := us.defaultRedis.Get(ctx, us.userCachePrefix+innerToken)
-	if usercache != nil {
-		cacheBytes, err := usercache.Bytes()
-		if err == nil {
-			err := json.Unmarshal(cacheBytes, &user)
-			if err != nil {
-				err := us.db.WithContext(ctx).Where("inner_token = ?", innerToken).First(&user).Error
-				if err != nil {
-					return nil, err
-				}
-				us.defaultRedis.Set(ctx, us.userCachePrefix+innerToken, cacheBytes, 5*time.Minute)
-			}
+// userLookupError marks a missing user with utils.ErrUserNotFound, keeping
+// gorm.ErrRecordNotFound in the chain.
+func userLookupError(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("%w: %w", utils.ErrUserNotFound, err)
+	}
+	return err
+}
+
+// GetUserByInnerToken returns the user owning innerToken, failing with
+// utils.ErrUserInactive or utils.ErrUserExpired when they may not use the
+// service (see CheckUserStatus). Lookups go through the in-process cache,
+// then Redis, then the database, keyed by the token's hash unless hashing is
+// off (see TokenHasher).
+func (us *UserService) GetUserByInnerToken(ctx context.Context, innerToken string) (user *models.User, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "UserService.GetUserByInnerToken")
+	defer func() { tracing.End(span, err) }()
+
+	key := us.tokens.CacheKey(innerToken)
+	user, local, err := us.localCache.Lookup(ctx, key, func(ctx context.Context) (*models.User, error) {
+		return us.loadUser(ctx, innerToken, key)
+	}, func(user *models.User) time.Duration {
+		return UserCacheTTL(user, time.Now(), us.expiryGrace)
+	})
+	span.SetAttributes(attribute.Bool("cache.local", local))
+	if local {
+		metrics.UserCacheLookups.WithLabelValues("local_hit").Inc()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckUserStatus(user, time.Now(), us.expiryGrace); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// loadUser reads the user owning innerToken from Redis under key, falling
+// back to the database and caching what it finds, unknown tokens included.
+func (us *UserService) loadUser(ctx context.Context, innerToken, key string) (*models.User, error) {
+	span := trace.SpanFromContext(ctx)
+	user, unknown := us.cachedUser(ctx, key)
+	switch {
+	case unknown:
+		metrics.UserCacheLookups.WithLabelValues("negative_hit").Inc()
+		span.SetAttributes(attribute.Bool("cache.hit", true))
+		return nil, fmt.Errorf("%w: token cached as unknown", utils.ErrUserNotFound)
+	case user != nil:
+		metrics.UserCacheLookups.WithLabelValues("hit").Inc()
+		span.SetAttributes(attribute.Bool("cache.hit", true))
+		return user, nil
+	}
+	metrics.UserCacheLookups.WithLabelValues("miss").Inc()
+	span.SetAttributes(attribute.Bool("cache.hit", false))
+
+	user, err := us.queryUser(ctx, innerToken)
+	if errors.Is(err, utils.ErrUserNotFound) && us.negativeCacheTTL > 0 {
+		// 未知 token 短暂缓存，避免每次请求都查询数据库
+		us.defaultRedis.Set(ctx, us.userCachePrefix+key, unknownTokenMarker, us.negativeCacheTTL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// 缓存时长不超过用户到期时间，保证到期后及时生效；哈希模式下缓存中不保存明文 token
+	cached := *user
+	if us.tokens.Hashed() {
+		cached.InnerToken = ""
+	}
+	cacheBytes, _ := json.Marshal(&cached)
+	us.defaultRedis.Set(ctx, us.userCachePrefix+key, cacheBytes, UserCacheTTL(user, time.Now(), us.expiryGrace))
+	return user, nil
+}
+
+// unknownTokenMarker is cached instead of a user for tokens no user owns.
+const unknownTokenMarker = "unknown"
+
+// cachedUser returns the user cached in Redis under key, or nil when there
+// is no usable entry. unknown is set when the token is cached as belonging
+// to no user.
+func (us *UserService) cachedUser(ctx context.Context, key string) (user *models.User, unknown bool) {
+	ctx, span := tracing.Tracer().Start(ctx, "redis.GET user_cache", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+
+	cacheBytes, err := us.defaultRedis.Get(ctx, us.userCachePrefix+key).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			span.RecordError(err)
 		}
+		return nil, false
+	}
+	if string(cacheBytes) == unknownTokenMarker {
+		return nil, true
+	}
+	user = &models.User{}
+	if err := json.Unmarshal(cacheBytes, user); err != nil || user.ID == 0 {
+		return nil, false
+	}
+	return user, false
+}
+
+// queryUser loads the user owning innerToken from the database, by
+// inner_token_hash unless hashing is off. Rows whose hash no longer matches
+// a non-empty inner_token get their hash fixed and do not match. In dual
+// mode those and rows without a hash are then found by the plaintext
+// column.
+func (us *UserService) queryUser(ctx context.Context, innerToken string) (user *models.User, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "mysql.SELECT user_user", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.End(span, err) }()
+
+	if us.tokens.Mode() == TokenLookupPlain {
+		return us.findUser(ctx, columnInnerToken, innerToken)
 	}
-	if user.ID == 0 {
-		err := us.db.WithContext(ctx).Where("inner_token = ?", innerToken).First(&user).Error
-		if err != nil {
-			return nil, err
+
+	user, err = us.findUser(ctx, columnInnerTokenHash, us.tokens.Hash(innerToken))
+	switch {
+	case err == nil && (user.InnerToken == "" || user.InnerToken == innerToken):
+		return user, nil
+	case err == nil:
+		// token 已轮换但哈希未更新，旧 token 不能再通过哈希登录
+		us.storeTokenHash(ctx, user)
+		if us.tokens.Mode() == TokenLookupHash {
+			return nil, fmt.Errorf("%w: stale token hash of user %d", utils.ErrUserNotFound, user.ID)
 		}
-		cacheBytes, _ := json.Marshal(user)
-		us.defaultRedis.Set(ctx, us.userCachePrefix+innerToken, cacheBytes, 5*time.Minute)
+	case !errors.Is(err, utils.ErrUserNotFound) || us.tokens.Mode() == TokenLookupHash:
+		return nil, err
+	}
+	span.SetAttributes(attribute.Bool("token.plaintext_fallback", true))
+	user, err = us.findUser(ctx, columnInnerToken, innerToken)
+	if err != nil {
+		return nil, err
 	}
+	us.storeTokenHash(ctx, user)
+	return user, nil
+}
 
-	return &user, nil
+func (us *UserService) findUser(ctx context.Context, column, value string) (*models.User, error) {
+	user, err := us.store.FindUser(ctx, column, value)
+	if err != nil {
+		return nil, userLookupError(err)
+	}
+	return user, nil
+}
+
+// storeTokenHash sets the user's inner_token_hash from their current
+// inner_token, unless the token changed meanwhile. It leaves updated_at
+// alone since the row is owned by the Django side.
+func (us *UserService) storeTokenHash(ctx context.Context, user *models.User) {
+	hash := us.tokens.Hash(user.InnerToken)
+	if _, err := us.store.SetTokenHash(ctx, user.ID, user.InnerToken, hash); err != nil {
+		logger.L().Warnf("Failed to store the token hash of user %d: %v", user.ID, err)
+		return
+	}
+	user.InnerTokenHash = &hash
 }
@@ -0,0 +1,64 @@
+package service
+
+import (
+	"fmt"
+	"nursor-envoy-rpc/models"
+	"nursor-envoy-rpc/utils"
+	"os"
+	"time"
+)
+
+// userCacheTTL is how long a user stays cached when nothing about them is
+// about to change.
+const userCacheTTL = 5 * time.Minute
+
+// rejectedUserCacheTTL is how long inactive and expired users stay cached,
+// short so that reactivating or renewing them takes effect quickly.
+const rejectedUserCacheTTL = 30 * time.Second
+
+// expiryGraceFromEnv reads USER_EXPIRY_GRACE_PERIOD, how long users keep
+// working after ExpiredAt. It defaults to none.
+func expiryGraceFromEnv() time.Duration {
+	grace, err := time.ParseDuration(os.Getenv("USER_EXPIRY_GRACE_PERIOD"))
+	if err != nil || grace < 0 {
+		return 0
+	}
+	return grace
+}
+
+// negativeCacheTTLFromEnv reads USER_NEGATIVE_CACHE_TTL, how long unknown
+// tokens are cached. It defaults to 30s; 0 disables it.
+func negativeCacheTTLFromEnv() time.Duration {
+	ttl, err := time.ParseDuration(os.Getenv("USER_NEGATIVE_CACHE_TTL"))
+	if err != nil || ttl < 0 {
+		return 30 * time.Second
+	}
+	return ttl
+}
+
+// CheckUserStatus returns utils.ErrUserInactive or utils.ErrUserExpired
+// (wrapped) when user may not use the service at now. Users without an
+// expiry never expire; the others keep working for grace after it.
+func CheckUserStatus(user *models.User, now time.Time, grace time.Duration) error {
+	if !user.IsActive {
+		return fmt.Errorf("%w: user %d", utils.ErrUserInactive, user.ID)
+	}
+	if user.ExpiredAt != nil && !now.Before(user.ExpiredAt.Add(grace)) {
+		return fmt.Errorf("%w: user %d expired at %s", utils.ErrUserExpired, user.ID, user.ExpiredAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// UserCacheTTL returns how long user may be cached at now: never past the
+// moment they expire, so the expiry is enforced on time.
+func UserCacheTTL(user *models.User, now time.Time, grace time.Duration) time.Duration {
+	if CheckUserStatus(user, now, grace) != nil {
+		return rejectedUserCacheTTL
+	}
+	if user.ExpiredAt != nil {
+		if left := user.ExpiredAt.Add(grace).Sub(now); left < userCacheTTL {
+			return left
+		}
+	}
+	return userCacheTTL
+}
@@ -0,0 +1,99 @@
+package service
+
+import (
+	"context"
+	"nursor-envoy-rpc/models"
+
+	"gorm.io/gorm"
+)
+
+// Columns UserStore.FindUser looks users up by.
+const (
+	columnInnerToken     = "inner_token"
+	columnInnerTokenHash = "inner_token_hash"
+)
+
+// UserToken is the token columns of one user_user row.
+type UserToken struct {
+	ID             int
+	InnerToken     string
+	InnerTokenHash *string
+}
+
+// UserStore is the user_user table as UserService uses it. The table is
+// owned by the Django side, so a store never changes its schema.
+type UserStore interface {
+	// FindUser returns the user whose column ("inner_token" or
+	// "inner_token_hash") equals value. A missing user fails with
+	// gorm.ErrRecordNotFound.
+	FindUser(ctx context.Context, column, value string) (*models.User, error)
+	// TokenOf returns the token columns of user id, reading
+	// inner_token_hash only when withHash is set. Unknown IDs give an
+	// empty UserToken.
+	TokenOf(ctx context.Context, id int, withHash bool) (UserToken, error)
+	// Tokens returns up to limit users with an inner_token whose ID is
+	// above afterID, by ID.
+	Tokens(ctx context.Context, afterID, limit int) ([]UserToken, error)
+	// SetTokenHash sets inner_token_hash of user id to hash unless their
+	// inner_token is no longer token, leaving updated_at alone. It reports
+	// whether a row changed.
+	SetTokenHash(ctx context.Context, id int, token, hash string) (bool, error)
+	// HasTokenHashColumn reports whether user_user has inner_token_hash.
+	HasTokenHashColumn(ctx context.Context) bool
+	Ping(ctx context.Context) error
+}
+
+// GormUserStore is the UserStore backed by the database.
+type GormUserStore struct {
+	db *gorm.DB
+}
+
+// NewGormUserStore returns a UserStore reading user_user through db.
+func NewGormUserStore(db *gorm.DB) *GormUserStore {
+	return &GormUserStore{db: db}
+}
+
+func (s *GormUserStore) FindUser(ctx context.Context, column, value string) (*models.User, error) {
+	user := &models.User{}
+	if err := s.db.WithContext(ctx).Where(column+" = ?", value).First(user).Error; err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s *GormUserStore) TokenOf(ctx context.Context, id int, withHash bool) (UserToken, error) {
+	row := UserToken{}
+	columns := "id, inner_token"
+	if withHash {
+		columns += ", inner_token_hash"
+	}
+	err := s.db.WithContext(ctx).Model(&models.User{}).Select(columns).Where("id = ?", id).Limit(1).Scan(&row).Error
+	return row, err
+}
+
+func (s *GormUserStore) Tokens(ctx context.Context, afterID, limit int) ([]UserToken, error) {
+	var rows []UserToken
+	err := s.db.WithContext(ctx).Model(&models.User{}).Select("id, inner_token, inner_token_hash").
+		Where("id > ? AND inner_token <> ''", afterID).Order("id").Limit(limit).Scan(&rows).Error
+	return rows, err
+}
+
+func (s *GormUserStore) SetTokenHash(ctx context.Context, id int, token, hash string) (bool, error) {
+	// UpdateColumn 不会更新 updated_at
+	res := s.db.WithContext(ctx).Model(&models.User{}).
+		Where("id = ? AND inner_token = ?", id, token).
+		UpdateColumn("inner_token_hash", hash)
+	return res.RowsAffected > 0, res.Error
+}
+
+func (s *GormUserStore) HasTokenHashColumn(ctx context.Context) bool {
+	return s.db.WithContext(ctx).Migrator().HasColumn(&models.User{}, "InnerTokenHash")
+}
+
+func (s *GormUserStore) Ping(ctx context.Context) error {
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.PingContext(ctx)
+}
@@ -0,0 +1,104 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"nursor-envoy-rpc/admin"
+	"nursor-envoy-rpc/healthcheck"
+	"nursor-envoy-rpc/processor"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/health"
+)
+
+func adminGet(t *testing.T, h http.Handler, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	return rec
+}
+
+// TestAdminServer_Readiness tests that readiness waits for every dependency and fails while draining
+func TestAdminServer_Readiness(t *testing.T) {
+	managerErr := errors.New("connection refused")
+	monitor := healthcheck.NewMonitor(health.NewServer(), time.Second,
+		healthcheck.Probe{Name: "mysql", Critical: true, Check: func(context.Context) error { return nil }},
+		healthcheck.Probe{Name: "account_manager", Critical: true, Check: func(context.Context) error { return managerErr }},
+	)
+	server := admin.NewServer(processor.NewRegistry(), monitor)
+
+	if rec := adminGet(t, server, "/healthz"); rec.Code != http.StatusOK {
+		t.Errorf("Expected healthz 200, got %d", rec.Code)
+	}
+	if rec := adminGet(t, server, "/readyz"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected readyz 503 before probing, got %d", rec.Code)
+	}
+
+	monitor.CheckNow(context.Background())
+	rec := adminGet(t, server, "/readyz")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected readyz 503 while the account manager is down, got %d", rec.Code)
+	}
+	var state struct {
+		Dependencies map[string]string `json:"dependencies"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &state)
+	if state.Dependencies["account_manager"] != "connection refused" || state.Dependencies["mysql"] != "ok" {
+		t.Errorf("Unexpected dependencies: %v", state.Dependencies)
+	}
+
+	managerErr = nil
+	monitor.CheckNow(context.Background())
+	if rec := adminGet(t, server, "/readyz"); rec.Code != http.StatusOK {
+		t.Errorf("Expected readyz 200 once every dependency answered, got %d", rec.Code)
+	}
+
+	server.SetDraining()
+	if rec := adminGet(t, server, "/readyz"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected readyz 503 while draining, got %d", rec.Code)
+	}
+}
+
+// TestAdminServer_DebugStreams tests that open streams are listed and removed streams are not
+func TestAdminServer_DebugStreams(t *testing.T) {
+	streams := processor.NewRegistry()
+	server := admin.NewServer(streams, healthcheck.NewMonitor(health.NewServer(), time.Second))
+	chain := processor.NewChain()
+	sc := processor.NewStreamContext(context.Background(), nil)
+	chain.OnRequestHeaders(sc, requestHeaders(":authority", "api2.cursor.sh", ":path", "/aiserver.v1.AiService/StreamChat"))
+	streams.Update(sc)
+	other := processor.NewStreamContext(context.Background(), nil)
+	streams.Update(other)
+	streams.Remove(other.ID)
+
+	var body struct {
+		Count   int                    `json:"count"`
+		Streams []processor.StreamInfo `json:"streams"`
+	}
+	rec := adminGet(t, server, "/debug/streams")
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Failed to decode streams: %v", err)
+	}
+	if body.Count != 1 || body.Streams[0].ID != sc.ID {
+		t.Fatalf("Expected only stream %s, got %+v", sc.ID, body.Streams)
+	}
+	if body.Streams[0].Phase != "request_headers" || body.Streams[0].Authority != "api2.cursor.sh" {
+		t.Errorf("Unexpected stream info: %+v", body.Streams[0])
+	}
+}
+
+// TestAdminServer_PprofOptIn tests that pprof is only served once enabled
+func TestAdminServer_PprofOptIn(t *testing.T) {
+	server := admin.NewServer(processor.NewRegistry(), healthcheck.NewMonitor(health.NewServer(), time.Second))
+	if rec := adminGet(t, server, "/debug/pprof/"); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected pprof to be off by default, got %d", rec.Code)
+	}
+	server.EnablePprof()
+	if rec := adminGet(t, server, "/debug/pprof/"); rec.Code != http.StatusOK {
+		t.Errorf("Expected pprof once enabled, got %d", rec.Code)
+	}
+}
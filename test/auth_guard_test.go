@@ -0,0 +1,96 @@
+package test
+
+import (
+	"context"
+	"nursor-envoy-rpc/config"
+	"nursor-envoy-rpc/processor"
+	"testing"
+	"time"
+)
+
+type stubGuard struct {
+	locked  time.Duration
+	checked []string
+}
+
+func (g *stubGuard) LockedFor(ctx context.Context, client string) (time.Duration, error) {
+	g.checked = append(g.checked, client)
+	return g.locked, nil
+}
+
+func (g *stubGuard) RecordFailure(ctx context.Context, client string, max int, window, lockout time.Duration) (time.Duration, error) {
+	return 0, nil
+}
+
+// TestAuthGuard_ClientIP tests that the client address is taken from before the trusted proxies' entries
+func TestAuthGuard_ClientIP(t *testing.T) {
+	sc := processor.NewStreamContext(context.Background(), nil)
+	sc.RequestHeaders["x-forwarded-for"] = "1.1.1.1, 203.0.113.7, 10.0.0.2"
+
+	if got := sc.ClientIP(0); got != "10.0.0.2" {
+		t.Errorf("Expected the last entry without trusted hops, got %q", got)
+	}
+	if got := sc.ClientIP(1); got != "203.0.113.7" {
+		t.Errorf("Expected the entry before one trusted hop, got %q", got)
+	}
+	if got := sc.ClientIP(5); got != "1.1.1.1" {
+		t.Errorf("Expected the first entry when hops exceed the list, got %q", got)
+	}
+	sc.RequestHeaders["x-forwarded-for"] = "not-an-ip"
+	if got := sc.ClientIP(0); got != "" {
+		t.Errorf("Expected no address for garbage, got %q", got)
+	}
+}
+
+// TestAuthGuard_ConfigDefaults tests the lockout defaults and that a negative max_failures disables it
+func TestAuthGuard_ConfigDefaults(t *testing.T) {
+	cfg, err := config.Parse([]byte("auth: {trusted_hops: 1, lockout: 1h}"), ".yaml")
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	max, window, lockout := cfg.AuthLockout()
+	if max != config.DefaultMaxAuthFailures || window != config.DefaultAuthFailureWindow || lockout != time.Hour {
+		t.Errorf("Expected 10 failures per 10m locking for 1h, got %d per %s locking for %s", max, window, lockout)
+	}
+	if cfg.TrustedHops() != 1 {
+		t.Errorf("Expected 1 trusted hop, got %d", cfg.TrustedHops())
+	}
+
+	cfg, _ = config.Parse([]byte("auth: {max_failures: -1}"), ".yaml")
+	if max, _, _ := cfg.AuthLockout(); max != 0 {
+		t.Errorf("Expected the lockout to be disabled, got max %d", max)
+	}
+	if _, err := config.Parse([]byte("auth: {failure_window: -1m}"), ".yaml"); err == nil {
+		t.Error("Expected a negative failure_window to be rejected")
+	}
+}
+
+// TestAuthGuard_LockedClientRejected tests that a locked out client gets 429 with retry-after before any lookup
+func TestAuthGuard_LockedClientRejected(t *testing.T) {
+	guard := &stubGuard{locked: 90 * time.Second}
+	h := &processor.AuthHandler{Guard: guard}
+	sc := processor.NewStreamContext(context.Background(), nil)
+	sc.RequestHeaders["nursor-token"] = "guess"
+	sc.RequestHeaders["x-forwarded-for"] = "203.0.113.7"
+	sc.RequestHeaders["content-type"] = "application/json"
+
+	res, err := h.OnRequestHeaders(sc, nil)
+	if err != nil || res == nil || res.ImmediateResponse == nil {
+		t.Fatalf("Expected an immediate response, got %+v, %v", res, err)
+	}
+	if len(guard.checked) != 1 || guard.checked[0] != "203.0.113.7" {
+		t.Errorf("Expected the client address to be checked, got %v", guard.checked)
+	}
+	if code := res.ImmediateResponse.GetStatus().GetCode(); code != 429 {
+		t.Errorf("Expected status 429, got %v", code)
+	}
+	var retryAfter string
+	for _, h := range res.ImmediateResponse.Headers.GetSetHeaders() {
+		if h.Header.Key == "retry-after" {
+			retryAfter = string(h.Header.RawValue)
+		}
+	}
+	if retryAfter != "90" {
+		t.Errorf("Expected retry-after 90, got %q", retryAfter)
+	}
+}
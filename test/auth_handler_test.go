@@ -0,0 +1,25 @@
+package test
+
+import (
+	"context"
+	"nursor-envoy-rpc/processor"
+	"testing"
+)
+
+// TestAuthHandler_UserServiceUnavailable tests that a lookup while the database is down is answered with 503 instead of exiting
+func TestAuthHandler_UserServiceUnavailable(t *testing.T) {
+	t.Setenv("MYSQL_HOST", "127.0.0.1")
+	t.Setenv("MYSQL_PORT", "1")
+	h := &processor.AuthHandler{}
+	sc := processor.NewStreamContext(context.Background(), nil)
+	sc.RequestHeaders["nursor-token"] = "token"
+	sc.RequestHeaders["content-type"] = "application/json"
+
+	res, err := h.OnRequestHeaders(sc, nil)
+	if err != nil || res == nil || res.ImmediateResponse == nil {
+		t.Fatalf("Expected an immediate response, got %+v, %v", res, err)
+	}
+	if code := res.ImmediateResponse.GetStatus().GetCode(); code != 503 {
+		t.Errorf("Expected status 503, got %v", code)
+	}
+}
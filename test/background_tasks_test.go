@@ -0,0 +1,54 @@
+package test
+
+import (
+	"context"
+	"nursor-envoy-rpc/service"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestBackgroundTasks_WaitDrains tests that Wait returns once every task has finished
+func TestBackgroundTasks_WaitDrains(t *testing.T) {
+	tasks := service.NewBackgroundTasks()
+	var finished atomic.Int32
+	for i := 0; i < 5; i++ {
+		tasks.Go("test", func(ctx context.Context) {
+			time.Sleep(20 * time.Millisecond)
+			finished.Add(1)
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := tasks.Wait(ctx); err != nil {
+		t.Fatalf("Expected drain to succeed, got %v", err)
+	}
+	if finished.Load() != 5 {
+		t.Errorf("Expected 5 finished tasks, got %d", finished.Load())
+	}
+	if tasks.Running() != 0 {
+		t.Errorf("Expected no running tasks, got %d", tasks.Running())
+	}
+}
+
+// TestBackgroundTasks_WaitTimeout tests that Wait gives up at the deadline and cancels the stragglers
+func TestBackgroundTasks_WaitTimeout(t *testing.T) {
+	tasks := service.NewBackgroundTasks()
+	cancelled := make(chan struct{})
+	tasks.Go("stuck", func(ctx context.Context) {
+		<-ctx.Done()
+		close(cancelled)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := tasks.Wait(ctx); err == nil {
+		t.Fatal("Expected drain to time out")
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("Expected the stuck task's context to be cancelled")
+	}
+}
@@ -0,0 +1,96 @@
+package test
+
+import (
+	"bytes"
+	"nursor-envoy-rpc/models/nursor"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestBodyBuffer_TruncatesAtCap tests that bytes past the cap are counted but not kept
+func TestBodyBuffer_TruncatesAtCap(t *testing.T) {
+	b := nursor.NewBodyBuffer(nursor.BodyLimits{MaxBytes: 8})
+	b.Write([]byte("hello "))
+	b.Write([]byte("world"))
+	b.Write([]byte("!!!"))
+
+	if b.Total() != 14 {
+		t.Errorf("Expected total 14, got %d", b.Total())
+	}
+	if b.Captured() != 8 {
+		t.Errorf("Expected 8 captured bytes, got %d", b.Captured())
+	}
+	if !b.Truncated() {
+		t.Error("Expected buffer to be truncated")
+	}
+	data := b.Bytes()
+	if !bytes.HasPrefix(data, []byte("hello wo")) {
+		t.Errorf("Expected captured prefix, got %q", data)
+	}
+	if !strings.Contains(string(data), "truncated, captured 8 of 14 bytes") {
+		t.Errorf("Expected truncation marker, got %q", data)
+	}
+}
+
+// TestBodyBuffer_SpillsToFile tests that large bodies move to a temp file that Close removes
+func TestBodyBuffer_SpillsToFile(t *testing.T) {
+	dir := t.TempDir()
+	b := nursor.NewBodyBuffer(nursor.BodyLimits{MaxBytes: 1024, MemoryBytes: 4, SpillDir: dir})
+	b.Write([]byte("abc"))
+	b.Write([]byte("defgh"))
+
+	files, _ := filepath.Glob(filepath.Join(dir, "nursor-body-*"))
+	if len(files) != 1 {
+		t.Fatalf("Expected one spill file, got %v", files)
+	}
+	if got := string(b.Bytes()); got != "abcdefgh" {
+		t.Errorf("Expected spilled body to read back, got %q", got)
+	}
+	if b.Truncated() {
+		t.Error("Expected body under the cap not to be truncated")
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatalf("Expected no error closing buffer, got: %v", err)
+	}
+	if _, err := os.Stat(files[0]); !os.IsNotExist(err) {
+		t.Errorf("Expected spill file to be removed, got %v", err)
+	}
+}
+
+// TestHttpRecord_UsesBodyLimits tests that records honour the limits they were created with
+func TestHttpRecord_UsesBodyLimits(t *testing.T) {
+	record := nursor.NewRequestRecordWithLimits(nursor.BodyLimits{MaxBytes: 2})
+	record.AddResponseBody([]byte("abcdef"))
+	if record.ResponseBody.Captured() != 2 || record.ResponseBody.Total() != 6 {
+		t.Errorf("Expected 2 of 6 bytes captured, got %d of %d", record.ResponseBody.Captured(), record.ResponseBody.Total())
+	}
+}
+
+// TestBodyBuffer_ReadBackFailure tests that a spill file that cannot be read back in full marks the body truncated
+func TestBodyBuffer_ReadBackFailure(t *testing.T) {
+	dir := t.TempDir()
+	b := nursor.NewBodyBuffer(nursor.BodyLimits{MaxBytes: 1024, MemoryBytes: 4, SpillDir: dir})
+	defer b.Close()
+	b.Write([]byte("abcdefgh"))
+	files, _ := filepath.Glob(filepath.Join(dir, "nursor-body-*"))
+	if len(files) != 1 {
+		t.Fatalf("Expected one spill file, got %v", files)
+	}
+	if err := os.Truncate(files[0], 3); err != nil {
+		t.Fatalf("Failed to truncate spill file: %v", err)
+	}
+
+	data := string(b.Bytes())
+	if !strings.HasPrefix(data, "abc") || strings.Contains(data, "abcd") {
+		t.Errorf("Expected the readable prefix, got %q", data)
+	}
+	if !b.Truncated() || b.ReadErr() == nil {
+		t.Errorf("Expected the body to be marked truncated with an error, got %v, %v", b.Truncated(), b.ReadErr())
+	}
+	if !strings.Contains(data, "captured 3 of 8 bytes") {
+		t.Errorf("Expected the truncation marker, got %q", data)
+	}
+}
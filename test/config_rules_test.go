@@ -0,0 +1,139 @@
+package test
+
+import (
+	"nursor-envoy-rpc/config"
+	"testing"
+
+	filterv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_proc/v3"
+)
+
+// TestLoad_BuiltinRules tests the rules compiled into the binary
+func TestLoad_BuiltinRules(t *testing.T) {
+	t.Setenv("RULES_FILE", "")
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	cases := []struct {
+		headers map[string]string
+		want    string
+	}{
+		{map[string]string{":authority": "metrics.cursor.sh", ":path": "/"}, "block-metrics"},
+		{map[string]string{":authority": "example.com", ":path": "/"}, "passthrough-non-cursor"},
+		{map[string]string{":authority": "api2.cursor.sh", ":path": "/aiserver.v1.AuthService/GetEmail"}, "fake-get-email"},
+		{map[string]string{":authority": "api2.cursor.sh", ":path": "/aiserver.v1.DashboardService/ReportBug"}, "drop-report-bug"},
+		{map[string]string{":authority": "api2.cursor.sh", ":path": "/aiserver.v1.ChatService/StreamUnifiedChatWithTools"}, ""},
+	}
+	for _, c := range cases {
+		rule := cfg.MatchRule(c.headers)
+		got := ""
+		if rule != nil {
+			got = rule.Name
+		}
+		if got != c.want {
+			t.Errorf("For %v expected rule %q, got %q", c.headers, c.want, got)
+		}
+	}
+
+	rule := cfg.MatchRule(map[string]string{":authority": "api2.cursor.sh", ":path": "/aiserver.v1.AuthService/GetEmail"})
+	if rule.Action.Respond.ResponseBody() != "\n\x10jimmylee@mit.edu\x10\x01" {
+		t.Errorf("Unexpected GetEmail body: %q", rule.Action.Respond.ResponseBody())
+	}
+}
+
+// TestParse_JSONRules tests method and header conditions in a JSON rules file
+func TestParse_JSONRules(t *testing.T) {
+	data := []byte(`{
+		"version": "7",
+		"rules": [{
+			"name": "skip-get",
+			"match": {"path": {"prefix": "/api/"}, "methods": ["get"], "headers_present": ["X-Debug"]},
+			"action": {"record": false, "set_headers": {"x-routed": "1"}}
+		}]
+	}`)
+	cfg, err := config.Parse(data, ".json")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if cfg.Version != "7" {
+		t.Errorf("Expected version 7, got %q", cfg.Version)
+	}
+
+	headers := map[string]string{":path": "/api/x", ":method": "GET", "x-debug": "1"}
+	rule := cfg.MatchRule(headers)
+	if rule == nil {
+		t.Fatal("Expected rule to match")
+	}
+	if rule.Action.ShouldRecord() {
+		t.Error("Expected record: false to disable recording")
+	}
+
+	delete(headers, "x-debug")
+	if cfg.MatchRule(headers) != nil {
+		t.Error("Expected rule not to match without the required header")
+	}
+}
+
+// TestParse_InvalidRules tests that broken rules are rejected
+func TestParse_InvalidRules(t *testing.T) {
+	cases := map[string]string{
+		"bad regex":         "rules:\n  - name: a\n    match:\n      path:\n        regex: '('\n",
+		"two matchers":      "rules:\n  - name: a\n    match:\n      path:\n        prefix: /a\n        suffix: /b\n",
+		"both actions":      "rules:\n  - name: a\n    action:\n      passthrough: true\n      respond: {}\n",
+		"bad status":        "rules:\n  - name: a\n    action:\n      respond:\n        status: 42\n",
+		"duplicate name":    "rules:\n  - name: a\n  - name: a\n",
+		"unknown field":     "rules:\n  - name: a\n    action:\n      passthru: true\n",
+		"missing rule name": "rules:\n  - match: {}\n",
+	}
+	for name, data := range cases {
+		if _, err := config.Parse([]byte(data), ".yaml"); err == nil {
+			t.Errorf("%s: expected error, got nil", name)
+		}
+	}
+}
+
+// TestModeOverride_FillsFromProcessingMode tests that rule modes are layered over the filter's base mode
+func TestModeOverride_FillsFromProcessingMode(t *testing.T) {
+	data := []byte(`
+processing_mode:
+  response_body: buffered
+rules:
+  - name: headers-only
+    match:
+      path: {prefix: /aiserver.v1.AiService/}
+    action:
+      record: false
+      mode:
+        request_body: none
+        response_body: none
+  - name: no-override
+    match: {}
+`)
+	cfg, err := config.Parse(data, ".yaml")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	mode := cfg.ModeOverride(cfg.MatchRule(map[string]string{":path": "/aiserver.v1.AiService/StreamCpp"}))
+	if mode == nil {
+		t.Fatal("Expected a mode override")
+	}
+	if mode.RequestBodyMode != filterv3.ProcessingMode_NONE || mode.ResponseBodyMode != filterv3.ProcessingMode_NONE {
+		t.Errorf("Expected bodies to be skipped, got %v", mode)
+	}
+	if mode.ResponseHeaderMode != filterv3.ProcessingMode_SEND {
+		t.Errorf("Expected response headers to keep the default, got %v", mode.ResponseHeaderMode)
+	}
+	if mode.ResponseTrailerMode != filterv3.ProcessingMode_SKIP {
+		t.Errorf("Expected response trailers to keep the default, got %v", mode.ResponseTrailerMode)
+	}
+
+	if cfg.ModeOverride(cfg.MatchRule(map[string]string{":path": "/other"})) != nil {
+		t.Error("Expected no override for a rule without mode")
+	}
+
+	if _, err := config.Parse([]byte("rules:\n  - name: a\n    action:\n      mode:\n        request_body: chunked\n"), ".yaml"); err == nil {
+		t.Error("Expected unknown body mode to be rejected")
+	}
+}
@@ -0,0 +1,71 @@
+package test
+
+import (
+	"nursor-envoy-rpc/config"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestStore_ReloadSwapsSnapshot tests that a reload leaves earlier snapshots untouched
+func TestStore_ReloadSwapsSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(path, []byte("version: v1\nrules:\n  - name: a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadFile(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	store := config.NewStore(cfg, path)
+	snapshot := store.Current()
+
+	if err := os.WriteFile(path, []byte("version: v2\nrules:\n  - name: a\n  - name: b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Reload(); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if store.Current().Version != "v2" || len(store.Current().Rules) != 2 {
+		t.Errorf("Expected v2 with 2 rules, got %s with %d", store.Current().Version, len(store.Current().Rules))
+	}
+	if snapshot.Version != "v1" || len(snapshot.Rules) != 1 {
+		t.Errorf("Expected in-flight snapshot to stay v1, got %s", snapshot.Version)
+	}
+}
+
+// TestStore_RejectsInvalidFile tests that a bad file keeps the previous config
+func TestStore_RejectsInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(path, []byte("version: good\nrules: []\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadFile(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	store := config.NewStore(cfg, path)
+
+	if err := os.WriteFile(path, []byte("version: bad\nrules:\n  - name: x\n    match:\n      path:\n        regex: '['\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Reload(); err == nil {
+		t.Fatal("Expected reload of invalid file to fail")
+	}
+	if store.Current().Version != "good" {
+		t.Errorf("Expected previous config to stay active, got %s", store.Current().Version)
+	}
+}
+
+// TestParse_VersionDefaultsToChecksum tests that unversioned files still get a stable version
+func TestParse_VersionDefaultsToChecksum(t *testing.T) {
+	data := []byte("rules:\n  - name: a\n")
+	first, err := config.Parse(data, ".yaml")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	second, _ := config.Parse(data, ".yaml")
+	if first.Version == "" || first.Version != second.Version {
+		t.Errorf("Expected stable checksum version, got %q and %q", first.Version, second.Version)
+	}
+}
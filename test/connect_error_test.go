@@ -0,0 +1,104 @@
+package test
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"nursor-envoy-rpc/utils"
+	"testing"
+
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"google.golang.org/grpc/codes"
+)
+
+func responseContentType(resp *extprocv3.ImmediateResponse) string {
+	for _, h := range resp.GetHeaders().GetSetHeaders() {
+		if h.GetHeader().GetKey() == "Content-Type" {
+			return string(h.GetHeader().GetRawValue())
+		}
+	}
+	return ""
+}
+
+// TestBuildErrorResponse_ConnectStreaming tests that connect streaming clients get an end-of-stream frame
+func TestBuildErrorResponse_ConnectStreaming(t *testing.T) {
+	resp := utils.BuildErrorResponse("application/connect+proto", utils.ClientError{
+		Code:    utils.CodePermissionDenied,
+		Message: "subscription expired",
+	}).GetImmediateResponse()
+
+	if resp.GetStatus().GetCode() != 200 {
+		t.Errorf("Expected HTTP 200, got %d", resp.GetStatus().GetCode())
+	}
+	if ct := responseContentType(resp); ct != "application/connect+proto" {
+		t.Errorf("Expected connect content type, got %q", ct)
+	}
+	frame := []byte(resp.GetBody())
+	if len(frame) < 5 || frame[0] != 0x02 {
+		t.Fatalf("Expected end-of-stream frame, got %q", frame)
+	}
+	if n := binary.BigEndian.Uint32(frame[1:5]); int(n) != len(frame)-5 {
+		t.Errorf("Expected frame length %d, got %d", len(frame)-5, n)
+	}
+	var end struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(frame[5:], &end); err != nil {
+		t.Fatalf("Failed to decode end-of-stream message: %v", err)
+	}
+	if end.Error.Code != "permission_denied" || end.Error.Message != "subscription expired" {
+		t.Errorf("Unexpected error envelope: %+v", end.Error)
+	}
+}
+
+// TestBuildErrorResponse_ConnectUnary tests that unary connect clients get a JSON envelope with the mapped status
+func TestBuildErrorResponse_ConnectUnary(t *testing.T) {
+	resp := utils.BuildErrorResponse("application/proto", utils.ClientError{
+		Code:    utils.CodeResourceExhausted,
+		Message: "quota exceeded",
+	}).GetImmediateResponse()
+
+	if resp.GetStatus().GetCode() != 429 {
+		t.Errorf("Expected HTTP 429, got %d", resp.GetStatus().GetCode())
+	}
+	if ct := responseContentType(resp); ct != "application/json" {
+		t.Errorf("Expected application/json, got %q", ct)
+	}
+	var envelope map[string]interface{}
+	if err := json.Unmarshal([]byte(resp.GetBody()), &envelope); err != nil {
+		t.Fatalf("Failed to decode body: %v", err)
+	}
+	if envelope["code"] != "resource_exhausted" || envelope["message"] != "quota exceeded" {
+		t.Errorf("Unexpected envelope: %v", envelope)
+	}
+}
+
+// TestBuildErrorResponse_Grpc tests that grpc clients get a grpc-status
+func TestBuildErrorResponse_Grpc(t *testing.T) {
+	resp := utils.BuildErrorResponse("application/grpc+proto", utils.ClientError{
+		Code:    utils.CodeUnauthenticated,
+		Message: "Invalid token: access denied",
+	}).GetImmediateResponse()
+
+	if resp.GetGrpcStatus() == nil || codes.Code(resp.GetGrpcStatus().GetStatus()) != codes.Unauthenticated {
+		t.Errorf("Expected grpc status Unauthenticated, got %v", resp.GetGrpcStatus())
+	}
+}
+
+// TestGetResponseForErr_PlainText tests that other clients keep the plain-text 401
+func TestGetResponseForErr_PlainText(t *testing.T) {
+	resp := utils.GetResponseForErr(context.Background(), utils.ErrUserNotFound, "").GetImmediateResponse()
+
+	if resp.GetStatus().GetCode() != 401 {
+		t.Errorf("Expected HTTP 401, got %d", resp.GetStatus().GetCode())
+	}
+	if resp.GetBody() != "Invalid token: access denied" {
+		t.Errorf("Unexpected body %q", resp.GetBody())
+	}
+	if ct := responseContentType(resp); ct != "text/plain" {
+		t.Errorf("Expected text/plain, got %q", ct)
+	}
+}
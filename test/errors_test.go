@@ -0,0 +1,54 @@
+package test
+
+import (
+	"errors"
+	"fmt"
+	"nursor-envoy-rpc/utils"
+	"testing"
+)
+
+// TestClientErrorFor_Table tests that wrapped service errors map to their client responses
+func TestClientErrorFor_Table(t *testing.T) {
+	cases := []struct {
+		err    error
+		status int
+		code   utils.ConnectCode
+	}{
+		{fmt.Errorf("%w: record not found", utils.ErrUserNotFound), 401, utils.CodeUnauthenticated},
+		{utils.ErrUserInactive, 403, utils.CodePermissionDenied},
+		{utils.ErrUserExpired, 403, utils.CodePermissionDenied},
+		{fmt.Errorf("%w: dial tcp: refused", utils.ErrAccountManagerUnavailable), 503, utils.CodeUnavailable},
+		{fmt.Errorf("%w for user 1", utils.ErrNoAccountAvailable), 503, utils.CodeUnavailable},
+		{fmt.Errorf("%w: database: dial tcp: refused", utils.ErrUserServiceUnavailable), 503, utils.CodeUnavailable},
+		{errors.New("redis: connection pool timeout"), 500, utils.CodeInternal},
+	}
+	for _, c := range cases {
+		client, _ := utils.ClientErrorFor(c.err)
+		if client.HTTPStatus != c.status || client.Code != c.code {
+			t.Errorf("%v: expected %d/%s, got %d/%s", c.err, c.status, c.code, client.HTTPStatus, client.Code)
+		}
+	}
+}
+
+// TestClientErrorFor_AccountManagerError tests that account manager errors unwrap by status and keep their message
+func TestClientErrorFor_AccountManagerError(t *testing.T) {
+	err := fmt.Errorf("acquire: %w", &utils.AccountManagerError{
+		StatusCode: 402,
+		Code:       "quota_exceeded",
+		Message:    "您的套餐已过期或使用次数已达到上限",
+	})
+	if !errors.Is(err, utils.ErrQuotaExceeded) {
+		t.Fatalf("Expected ErrQuotaExceeded in chain of %v", err)
+	}
+	client, _ := utils.ClientErrorFor(err)
+	if client.Code != utils.CodeResourceExhausted {
+		t.Errorf("Expected resource_exhausted, got %s", client.Code)
+	}
+	if client.Message != "您的套餐已过期或使用次数已达到上限" {
+		t.Errorf("Expected account manager message, got %q", client.Message)
+	}
+
+	if !errors.Is(&utils.AccountManagerError{StatusCode: 503}, utils.ErrAccountManagerUnavailable) {
+		t.Error("Expected 5xx to unwrap to ErrAccountManagerUnavailable")
+	}
+}
@@ -0,0 +1,74 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"nursor-envoy-rpc/healthcheck"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func servingStatus(t *testing.T, server *health.Server, name string) healthpb.HealthCheckResponse_ServingStatus {
+	t.Helper()
+	resp, err := server.Check(context.Background(), &healthpb.HealthCheckRequest{Service: name})
+	if err != nil {
+		t.Fatalf("Check(%q) failed: %v", name, err)
+	}
+	return resp.GetStatus()
+}
+
+// TestMonitor_CriticalProbeFlipsOverall tests that only critical dependencies take the server to NOT_SERVING
+func TestMonitor_CriticalProbeFlipsOverall(t *testing.T) {
+	server := health.NewServer()
+	var dbErr, redisErr error
+	monitor := healthcheck.NewMonitor(server, time.Second,
+		healthcheck.Probe{Name: "mysql", Critical: true, Check: func(context.Context) error { return dbErr }},
+		healthcheck.Probe{Name: "redis", Check: func(context.Context) error { return redisErr }},
+	)
+	if servingStatus(t, server, "") != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Error("Expected NOT_SERVING before the first probe")
+	}
+
+	monitor.CheckNow(context.Background())
+	if servingStatus(t, server, healthcheck.ExtProcService) != healthpb.HealthCheckResponse_SERVING {
+		t.Error("Expected SERVING with all dependencies up")
+	}
+
+	redisErr = errors.New("connection refused")
+	monitor.CheckNow(context.Background())
+	if servingStatus(t, server, "redis") != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Error("Expected redis NOT_SERVING")
+	}
+	if servingStatus(t, server, "") != healthpb.HealthCheckResponse_SERVING {
+		t.Error("Expected a non-critical failure to keep the server SERVING")
+	}
+
+	dbErr = errors.New("connection refused")
+	monitor.CheckNow(context.Background())
+	if servingStatus(t, server, healthcheck.ExtProcService) != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Error("Expected a critical failure to flip the server to NOT_SERVING")
+	}
+	results, checked := monitor.Results()
+	if !checked || results["mysql"] == nil || results["redis"] == nil {
+		t.Errorf("Unexpected results: %v (checked %v)", results, checked)
+	}
+}
+
+// TestMonitor_ProbeTimeout tests that a hanging probe is cut off by the probe timeout
+func TestMonitor_ProbeTimeout(t *testing.T) {
+	server := health.NewServer()
+	monitor := healthcheck.NewMonitor(server, 20*time.Millisecond,
+		healthcheck.Probe{Name: "account_manager", Critical: true, Check: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}},
+	)
+
+	monitor.CheckNow(context.Background())
+	if servingStatus(t, server, "account_manager") != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Error("Expected timed out probe to be NOT_SERVING")
+	}
+}
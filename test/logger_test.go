@@ -0,0 +1,56 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"nursor-envoy-rpc/logger"
+	"nursor-envoy-rpc/processor"
+	"os"
+	"testing"
+)
+
+func captureJSONLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	t.Setenv("LOG_FORMAT", "json")
+	if err := logger.Init(); err != nil {
+		t.Fatalf("Failed to init logger: %v", err)
+	}
+	var buf bytes.Buffer
+	logger.SetOutput(&buf)
+	t.Cleanup(func() { logger.SetOutput(os.Stdout) })
+	return &buf
+}
+
+// TestLogger_StreamFields tests that stream log lines carry the stream, request and user fields
+func TestLogger_StreamFields(t *testing.T) {
+	buf := captureJSONLog(t)
+
+	chain := processor.NewChain()
+	sc := processor.NewStreamContext(context.Background(), nil)
+	chain.OnRequestHeaders(sc, requestHeaders(":authority", "api2.cursor.sh", ":path", "/aiserver.v1.ChatService/StreamUnifiedChatWithTools"))
+	sc.AddLogFields(logger.Fields{"user_id": 42})
+	logger.FromContext(sc.Detach(context.Background())).Info("post-stream")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("Expected one JSON line, got %q: %v", buf.String(), err)
+	}
+	if line["stream_id"] != sc.ID {
+		t.Errorf("Expected stream_id %s, got %v", sc.ID, line["stream_id"])
+	}
+	if line["authority"] != "api2.cursor.sh" || line["path"] != "/aiserver.v1.ChatService/StreamUnifiedChatWithTools" {
+		t.Errorf("Expected authority and path fields, got %v", line)
+	}
+	if line["user_id"] != float64(42) {
+		t.Errorf("Expected user_id 42, got %v", line["user_id"])
+	}
+}
+
+// TestLogger_InvalidFormat tests that an unknown LOG_FORMAT is rejected
+func TestLogger_InvalidFormat(t *testing.T) {
+	t.Setenv("LOG_FORMAT", "xml")
+	if err := logger.Init(); err == nil {
+		t.Error("Expected an error for LOG_FORMAT=xml")
+	}
+}
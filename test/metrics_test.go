@@ -0,0 +1,53 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"nursor-envoy-rpc/metrics"
+	"nursor-envoy-rpc/processor"
+	"nursor-envoy-rpc/service"
+	"testing"
+
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestMetrics_ImmediateResponseByReason tests that immediate responses are counted by handler and reason
+func TestMetrics_ImmediateResponseByReason(t *testing.T) {
+	counter := metrics.ImmediateResponses.WithLabelValues("deny", "blocked")
+	before := testutil.ToFloat64(counter)
+
+	chain := processor.NewChain(&stubHandler{
+		name:   "deny",
+		result: processor.Immediate(&extprocv3.ImmediateResponse{Details: "blocked"}),
+	})
+	sc := processor.NewStreamContext(context.Background(), nil)
+	chain.OnRequestHeaders(sc, requestHeaders(":authority", "api2.cursor.sh"))
+
+	if got := testutil.ToFloat64(counter) - before; got != 1 {
+		t.Errorf("Expected 1 immediate response, got %v", got)
+	}
+}
+
+// TestMetrics_AccountManagerStatus tests that account manager calls are counted by endpoint and status
+func TestMetrics_AccountManagerStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusPaymentRequired)
+		w.Write([]byte(`{"error":"quota_exceeded","message":"limit reached"}`))
+	}))
+	defer server.Close()
+
+	counter := metrics.AccountManagerRequests.WithLabelValues("acquire", "402")
+	before := testutil.ToFloat64(counter)
+
+	ds := &service.DispatchService{}
+	ds.InitializeForTest(server.URL + "/")
+	if _, err := ds.GetAccountByUserId(context.Background(), 1); err == nil {
+		t.Fatal("Expected an error for a 402 answer")
+	}
+
+	if got := testutil.ToFloat64(counter) - before; got != 1 {
+		t.Errorf("Expected 1 acquire request with status 402, got %v", got)
+	}
+}
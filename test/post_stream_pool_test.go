@@ -0,0 +1,378 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"nursor-envoy-rpc/processor"
+	"nursor-envoy-rpc/service"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// taskRecorder runs post-stream tasks by remembering their stream IDs. The
+// first task blocks until release is closed, so tests can fill the queue.
+type taskRecorder struct {
+	mu      sync.Mutex
+	ran     []string
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func newTaskRecorder() *taskRecorder {
+	return &taskRecorder{started: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (r *taskRecorder) run(ctx context.Context, task *service.PostStreamTask) {
+	r.once.Do(func() {
+		close(r.started)
+		<-r.release
+	})
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ran = append(r.ran, task.StreamID)
+}
+
+func (r *taskRecorder) ids() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.ran...)
+}
+
+// blockedPool starts a one-worker pool whose worker is stuck on task "busy".
+func blockedPool(t *testing.T, opts service.PostStreamOptions) (*service.PostStreamPool, *taskRecorder, *service.BackgroundTasks) {
+	t.Helper()
+	recorder := newTaskRecorder()
+	pool, err := service.NewPostStreamPool(opts, recorder.run)
+	if err != nil {
+		t.Fatalf("Failed to create pool: %v", err)
+	}
+	bg := service.NewBackgroundTasks()
+	pool.Start(bg)
+	pool.Submit(&service.PostStreamTask{StreamID: "busy"})
+	<-recorder.started
+	return pool, recorder, bg
+}
+
+func drainPool(t *testing.T, pool *service.PostStreamPool, bg *service.BackgroundTasks) {
+	t.Helper()
+	pool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := bg.Wait(ctx); err != nil {
+		t.Fatalf("Expected the pool to drain, got %v", err)
+	}
+}
+
+func equalIDs(got []string, want ...string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// TestPostStreamPool_RunsAllTasks tests that every submitted task runs before the drained pool exits
+func TestPostStreamPool_RunsAllTasks(t *testing.T) {
+	recorder := newTaskRecorder()
+	close(recorder.release)
+	pool, err := service.NewPostStreamPool(service.PostStreamOptions{Workers: 4, QueueSize: 100, Overflow: service.OverflowDropNewest}, recorder.run)
+	if err != nil {
+		t.Fatalf("Failed to create pool: %v", err)
+	}
+	bg := service.NewBackgroundTasks()
+	pool.Start(bg)
+	for i := 0; i < 50; i++ {
+		pool.Submit(&service.PostStreamTask{StreamID: "s"})
+	}
+	drainPool(t, pool, bg)
+	if n := len(recorder.ids()); n != 50 {
+		t.Errorf("Expected 50 tasks to run, got %d", n)
+	}
+}
+
+// TestPostStreamPool_DropNewest tests that a full queue refuses new tasks under drop_newest
+func TestPostStreamPool_DropNewest(t *testing.T) {
+	pool, recorder, bg := blockedPool(t, service.PostStreamOptions{Workers: 1, QueueSize: 1, Overflow: service.OverflowDropNewest})
+	pool.Submit(&service.PostStreamTask{StreamID: "a"})
+	pool.Submit(&service.PostStreamTask{StreamID: "b"})
+	close(recorder.release)
+	drainPool(t, pool, bg)
+
+	if got := recorder.ids(); !equalIDs(got, "busy", "a") {
+		t.Errorf("Expected busy, a to run, got %v", got)
+	}
+}
+
+// TestPostStreamPool_DropOldest tests that a full queue makes room by dropping the oldest task under drop_oldest
+func TestPostStreamPool_DropOldest(t *testing.T) {
+	pool, recorder, bg := blockedPool(t, service.PostStreamOptions{Workers: 1, QueueSize: 1, Overflow: service.OverflowDropOldest})
+	pool.Submit(&service.PostStreamTask{StreamID: "a"})
+	pool.Submit(&service.PostStreamTask{StreamID: "b"})
+	close(recorder.release)
+	drainPool(t, pool, bg)
+
+	if got := recorder.ids(); !equalIDs(got, "busy", "b") {
+		t.Errorf("Expected busy, b to run, got %v", got)
+	}
+}
+
+func bodyTask(id string, size int) *service.PostStreamTask {
+	return &service.PostStreamTask{StreamID: id, Record: &service.HttpRecordPayload{RequestBody: strings.Repeat("x", size)}}
+}
+
+// TestPostStreamPool_QueueBytes tests that the memory queue is also bounded by the size of the record bodies it holds
+func TestPostStreamPool_QueueBytes(t *testing.T) {
+	opts := service.PostStreamOptions{Workers: 1, QueueSize: 100, QueueBytes: 100, Overflow: service.OverflowDropOldest}
+	pool, recorder, bg := blockedPool(t, opts)
+	pool.Submit(bodyTask("a", 40))
+	pool.Submit(bodyTask("b", 40))
+	pool.Submit(&service.PostStreamTask{StreamID: "c"})
+	// 放不下 d 时丢弃最早的 a、b
+	pool.Submit(bodyTask("d", 90))
+	if memory, _ := pool.Queued(); memory != 2 {
+		t.Errorf("Expected 2 queued tasks, got %d", memory)
+	}
+	close(recorder.release)
+	drainPool(t, pool, bg)
+	if got := recorder.ids(); !equalIDs(got, "busy", "c", "d") {
+		t.Errorf("Expected busy, c, d to run, got %v", got)
+	}
+
+	dir := t.TempDir()
+	opts = service.PostStreamOptions{Workers: 1, QueueSize: 100, QueueBytes: 100, Overflow: service.OverflowSpill, SpillDir: dir, MaxSpilled: 10}
+	pool, recorder, bg = blockedPool(t, opts)
+	defer close(recorder.release)
+	pool.Submit(bodyTask("big", 150))
+	pool.Submit(bodyTask("next", 10))
+	if memory, spilled := pool.Queued(); memory != 1 || spilled != 1 {
+		t.Errorf("Expected the task past the byte cap to be spilled, got %d queued and %d spilled", memory, spilled)
+	}
+}
+
+// TestPostStreamPool_SpillAndRecover tests that overflow is spilled to disk and picked up by the next pool
+func TestPostStreamPool_SpillAndRecover(t *testing.T) {
+	dir := t.TempDir()
+	opts := service.PostStreamOptions{Workers: 1, QueueSize: 1, Overflow: service.OverflowSpill, SpillDir: dir, MaxSpilled: 10}
+	pool, recorder, bg := blockedPool(t, opts)
+	pool.Submit(&service.PostStreamTask{StreamID: "a"})
+	pool.Submit(&service.PostStreamTask{StreamID: "b", Record: &service.HttpRecordPayload{Url: "http://example.com"}})
+	pool.Submit(&service.PostStreamTask{StreamID: "c"})
+	if memory, spilled := pool.Queued(); memory != 1 || spilled != 2 {
+		t.Fatalf("Expected 1 queued and 2 spilled tasks, got %d and %d", memory, spilled)
+	}
+
+	// Closing leaves spilled tasks on disk for the next process.
+	close(recorder.release)
+	drainPool(t, pool, bg)
+	if got := recorder.ids(); !equalIDs(got, "busy", "a") {
+		t.Errorf("Expected busy, a to run before shutdown, got %v", got)
+	}
+
+	next := newTaskRecorder()
+	close(next.release)
+	var urls []string
+	var mu sync.Mutex
+	restarted, err := service.NewPostStreamPool(opts, func(ctx context.Context, task *service.PostStreamTask) {
+		if task.Record != nil {
+			mu.Lock()
+			urls = append(urls, task.Record.Url)
+			mu.Unlock()
+		}
+		next.run(ctx, task)
+	})
+	if err != nil {
+		t.Fatalf("Failed to create pool: %v", err)
+	}
+	bg = service.NewBackgroundTasks()
+	restarted.Start(bg)
+	deadline := time.Now().Add(time.Second)
+	for len(next.ids()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	drainPool(t, restarted, bg)
+
+	if got := next.ids(); !equalIDs(got, "b", "c") {
+		t.Errorf("Expected spilled b, c to run in order, got %v", got)
+	}
+	if len(urls) != 1 || urls[0] != "http://example.com" {
+		t.Errorf("Expected the spilled record to survive, got %v", urls)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Expected the spill dir to be empty, got %d files", len(entries))
+	}
+}
+
+// TestPostStreamPool_AbandonSpills tests that tasks left after a drain timeout are spilled rather than lost
+func TestPostStreamPool_AbandonSpills(t *testing.T) {
+	dir := t.TempDir()
+	pool, recorder, bg := blockedPool(t, service.PostStreamOptions{Workers: 1, QueueSize: 10, Overflow: service.OverflowSpill, SpillDir: dir, MaxSpilled: 10})
+	defer close(recorder.release)
+	pool.Submit(&service.PostStreamTask{StreamID: "a"})
+	pool.Submit(&service.PostStreamTask{StreamID: "b"})
+	pool.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := bg.Wait(ctx); err == nil {
+		t.Fatal("Expected the drain to time out")
+	}
+	if n := pool.Abandon(); n != 2 {
+		t.Errorf("Expected 2 abandoned tasks, got %d", n)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("Expected 2 spilled files, got %d", len(entries))
+	}
+}
+
+// TestPostStreamPool_AbandonSpillsUnderDropPolicy tests that a drain timeout persists queued tasks under drop_oldest and the next start runs them
+func TestPostStreamPool_AbandonSpillsUnderDropPolicy(t *testing.T) {
+	dir := t.TempDir()
+	opts := service.PostStreamOptions{Workers: 1, QueueSize: 10, Overflow: service.OverflowDropOldest, SpillDir: dir, MaxSpilled: 10}
+	pool, recorder, bg := blockedPool(t, opts)
+	defer close(recorder.release)
+	pool.Submit(&service.PostStreamTask{StreamID: "a"})
+	pool.Submit(&service.PostStreamTask{StreamID: "b", AccountID: 7, IsChat: true})
+	pool.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := bg.Wait(ctx); err == nil {
+		t.Fatal("Expected the drain to time out")
+	}
+	if n := pool.Abandon(); n != 2 {
+		t.Errorf("Expected 2 abandoned tasks, got %d", n)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Fatalf("Expected 2 spilled files, got %d", len(entries))
+	}
+
+	next := newTaskRecorder()
+	close(next.release)
+	restarted, err := service.NewPostStreamPool(opts, next.run)
+	if err != nil {
+		t.Fatalf("Failed to create pool: %v", err)
+	}
+	if _, spilled := restarted.Queued(); spilled != 2 {
+		t.Errorf("Expected 2 spilled tasks on start, got %d", spilled)
+	}
+	bg = service.NewBackgroundTasks()
+	restarted.Start(bg)
+	deadline := time.Now().Add(time.Second)
+	for len(next.ids()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	drainPool(t, restarted, bg)
+	if got := next.ids(); !equalIDs(got, "a", "b") {
+		t.Errorf("Expected abandoned a, b to run after the restart, got %v", got)
+	}
+}
+
+// TestPostStreamPool_CancelledTaskSpilled tests that a task cancelled mid-run by the drain timeout is spilled, unless it had finished
+func TestPostStreamPool_CancelledTaskSpilled(t *testing.T) {
+	dir := t.TempDir()
+	opts := service.PostStreamOptions{Workers: 2, QueueSize: 10, Overflow: service.OverflowDropOldest, SpillDir: dir, MaxSpilled: 10}
+	started := make(chan struct{}, 2)
+	pool, err := service.NewPostStreamPool(opts, func(ctx context.Context, task *service.PostStreamTask) {
+		if task.StreamID == "finished" {
+			// 已完成的任务不应被重新执行
+			task.IsChat = false
+		}
+		started <- struct{}{}
+		<-ctx.Done()
+	})
+	if err != nil {
+		t.Fatalf("Failed to create pool: %v", err)
+	}
+	bg := service.NewBackgroundTasks()
+	pool.Start(bg)
+	pool.Submit(&service.PostStreamTask{StreamID: "cancelled", AccountID: 7, IsChat: true})
+	pool.Submit(&service.PostStreamTask{StreamID: "finished", AccountID: 8, IsChat: true})
+	<-started
+	<-started
+	pool.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := bg.Wait(ctx); err == nil {
+		t.Fatal("Expected the drain to time out")
+	}
+	pool.Abandon()
+	settle, cancelSettle := context.WithTimeout(context.Background(), time.Second)
+	defer cancelSettle()
+	if err := bg.Wait(settle); err != nil {
+		t.Fatalf("Expected cancelled workers to return, got %v", err)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 spilled task, got %d", len(entries))
+	}
+	data, _ := os.ReadFile(dir + "/" + entries[0].Name())
+	var task service.PostStreamTask
+	if err := json.Unmarshal(data, &task); err != nil || task.StreamID != "cancelled" {
+		t.Errorf("Expected the cancelled task to be spilled, got %+v, %v", task, err)
+	}
+}
+
+// TestPostStreamPool_InvalidOptions tests that unusable settings are rejected
+func TestPostStreamPool_InvalidOptions(t *testing.T) {
+	run := func(context.Context, *service.PostStreamTask) {}
+	for _, opts := range []service.PostStreamOptions{
+		{Workers: 0, QueueSize: 1, Overflow: service.OverflowDropNewest},
+		{Workers: 1, QueueSize: 0, Overflow: service.OverflowDropNewest},
+		{Workers: 1, QueueSize: 1, Overflow: "drop_random"},
+		{Workers: 1, QueueSize: 1, QueueBytes: -1, Overflow: service.OverflowDropNewest},
+		{Workers: 1, QueueSize: 1, Overflow: service.OverflowSpill},
+	} {
+		if _, err := service.NewPostStreamPool(opts, run); err == nil {
+			t.Errorf("Expected %+v to be rejected", opts)
+		}
+	}
+
+	t.Setenv("POST_STREAM_WORKERS", "many")
+	if _, err := service.PostStreamOptionsFromEnv(); err == nil {
+		t.Error("Expected POST_STREAM_WORKERS=many to be rejected")
+	}
+}
+
+// TestPostStreamPool_TaskFromStream tests that the stream's task carries its record, usage flags and log fields through JSON
+func TestPostStreamPool_TaskFromStream(t *testing.T) {
+	chain := processor.NewChain()
+	sc := processor.NewStreamContext(context.Background(), nil)
+	chain.OnRequestHeaders(sc, requestHeaders(":path", "/x", "x-request-id", "abc-123"))
+	sc.Record.Url = "http://example.com/x"
+	sc.Record.AccountId = 3
+	sc.IsChatRequest = true
+
+	task := sc.PostStreamTask()
+	data, err := json.Marshal(task)
+	if err != nil {
+		t.Fatalf("Failed to marshal task: %v", err)
+	}
+	var decoded service.PostStreamTask
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Failed to unmarshal task: %v", err)
+	}
+	if decoded.Record == nil || decoded.Record.Url != "http://example.com/x" {
+		t.Errorf("Expected the record payload, got %+v", decoded.Record)
+	}
+	if decoded.AccountID != 3 || !decoded.IsChat || decoded.ChatFailed {
+		t.Errorf("Expected usage for account 3, got %+v", decoded)
+	}
+	if decoded.RequestID != "abc-123" || decoded.LogFields["stream_id"] != sc.ID {
+		t.Errorf("Expected request ID and log fields, got %+v", decoded)
+	}
+
+	sc.SkipRecord = true
+	if task := sc.PostStreamTask(); task.Record != nil {
+		t.Error("Expected no record for a skipped stream")
+	}
+}
@@ -0,0 +1,214 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"nursor-envoy-rpc/config"
+	"nursor-envoy-rpc/processor"
+	"testing"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// stubHandler returns a fixed result for request headers and counts calls.
+type stubHandler struct {
+	processor.BaseHandler
+	name   string
+	result *processor.Result
+	err    error
+	calls  int
+}
+
+func (h *stubHandler) Name() string { return h.name }
+
+func (h *stubHandler) OnRequestHeaders(sc *processor.StreamContext, headers *extprocv3.HttpHeaders) (*processor.Result, error) {
+	h.calls++
+	return h.result, h.err
+}
+
+func requestHeaders(kv ...string) *extprocv3.HttpHeaders {
+	headers := &corev3.HeaderMap{}
+	for i := 0; i+1 < len(kv); i += 2 {
+		headers.Headers = append(headers.Headers, &corev3.HeaderValue{Key: kv[i], RawValue: []byte(kv[i+1])})
+	}
+	return &extprocv3.HttpHeaders{Headers: headers}
+}
+
+// TestChain_MergesHeaderMutations tests that mutations from every handler end up in one response
+func TestChain_MergesHeaderMutations(t *testing.T) {
+	first := &stubHandler{name: "first", result: (&processor.Result{}).RemoveHeader("nursor-token")}
+	second := &stubHandler{name: "second", result: (&processor.Result{}).SetHeader("x-client-key", "abc")}
+	chain := processor.NewChain(first, second)
+
+	sc := processor.NewStreamContext(context.Background(), nil)
+	resp, endStream, err := chain.OnRequestHeaders(sc, requestHeaders(":authority", "api2.cursor.sh"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if endStream {
+		t.Error("Expected stream to stay open")
+	}
+	mutation := resp.GetRequestHeaders().GetResponse().GetHeaderMutation()
+	if len(mutation.GetRemoveHeaders()) != 1 || mutation.GetRemoveHeaders()[0] != "nursor-token" {
+		t.Errorf("Expected nursor-token removal, got %v", mutation.GetRemoveHeaders())
+	}
+	if len(mutation.GetSetHeaders()) != 1 || mutation.GetSetHeaders()[0].GetHeader().GetKey() != "x-client-key" {
+		t.Errorf("Expected x-client-key to be set, got %v", mutation.GetSetHeaders())
+	}
+	if sc.Authority() != "api2.cursor.sh" {
+		t.Errorf("Expected authority to be captured, got %q", sc.Authority())
+	}
+}
+
+// TestChain_ImmediateResponseStopsChain tests that handlers after an immediate response are skipped
+func TestChain_ImmediateResponseStopsChain(t *testing.T) {
+	first := &stubHandler{name: "first", result: processor.Immediate(&extprocv3.ImmediateResponse{Body: "stop"})}
+	second := &stubHandler{name: "second"}
+	chain := processor.NewChain(first, second)
+
+	resp, endStream, err := chain.OnRequestHeaders(processor.NewStreamContext(context.Background(), nil), requestHeaders())
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !endStream {
+		t.Error("Expected stream to end after an immediate response")
+	}
+	if resp.GetImmediateResponse().GetBody() != "stop" {
+		t.Errorf("Expected immediate response body 'stop', got %v", resp)
+	}
+	if second.calls != 0 {
+		t.Errorf("Expected second handler to be skipped, got %d calls", second.calls)
+	}
+}
+
+// TestChain_ErrorKeepsResult tests that a failing handler can still answer before the stream errors
+func TestChain_ErrorKeepsResult(t *testing.T) {
+	failure := errors.New("boom")
+	first := &stubHandler{name: "first", result: processor.Immediate(&extprocv3.ImmediateResponse{}), err: failure}
+	chain := processor.NewChain(first)
+
+	resp, _, err := chain.OnRequestHeaders(processor.NewStreamContext(context.Background(), nil), requestHeaders())
+	if !errors.Is(err, failure) {
+		t.Fatalf("Expected handler error, got: %v", err)
+	}
+	if resp.GetImmediateResponse() == nil {
+		t.Error("Expected immediate response to be sent alongside the error")
+	}
+}
+
+// TestRulesHandler_NonCursorHostPassesThrough tests that foreign hosts end the stream untouched
+func TestRulesHandler_NonCursorHostPassesThrough(t *testing.T) {
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("Failed to load built-in rules: %v", err)
+	}
+	chain := processor.NewChain(&processor.RulesHandler{})
+
+	resp, endStream, err := chain.OnRequestHeaders(processor.NewStreamContext(context.Background(), cfg), requestHeaders(":authority", "example.com", ":path", "/"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !endStream {
+		t.Error("Expected passthrough to end the stream")
+	}
+	if resp.GetRequestHeaders() == nil {
+		t.Errorf("Expected a request headers response, got %v", resp)
+	}
+}
+
+// TestUpstreamErrorHandler_FlagsFailedChat tests that an upstream error status marks the stream as failed
+func TestUpstreamErrorHandler_FlagsFailedChat(t *testing.T) {
+	chain := processor.NewChain(&processor.RecordHandler{}, &processor.UpstreamErrorHandler{})
+	sc := processor.NewStreamContext(context.Background(), nil)
+
+	if _, _, err := chain.OnRequestHeaders(sc, requestHeaders(":authority", "api2.cursor.sh", ":path", "/aiserver.v1.ChatService/StreamUnifiedChatWithTools")); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !sc.IsChatRequest {
+		t.Error("Expected chat request to be detected")
+	}
+
+	resp, _, err := chain.OnResponseHeaders(sc, requestHeaders(":status", "429"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !sc.IsChatHasException {
+		t.Error("Expected chat exception to be flagged")
+	}
+	if resp.GetImmediateResponse() == nil {
+		t.Errorf("Expected immediate response on upstream error, got %v", resp)
+	}
+	if sc.Record.Status != 429 {
+		t.Errorf("Expected record status 429, got %d", sc.Record.Status)
+	}
+}
+
+// TestChain_ResponseTrailersCaptureGrpcStatus tests that trailers get a real TrailersResponse and fail the stream on a non-OK grpc-status
+func TestChain_ResponseTrailersCaptureGrpcStatus(t *testing.T) {
+	chain := processor.NewChain(&processor.RecordHandler{}, &processor.UpstreamErrorHandler{})
+	sc := processor.NewStreamContext(context.Background(), nil)
+
+	if _, _, err := chain.OnRequestHeaders(sc, requestHeaders(":authority", "api2.cursor.sh", ":path", "/aiserver.v1.ChatService/StreamUnifiedChatWithTools")); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	resp, _, err := chain.OnTrailers(sc, processor.DirectionRequest, &extprocv3.HttpTrailers{})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if resp.GetRequestTrailers() == nil {
+		t.Errorf("Expected a request trailers response, got %v", resp)
+	}
+
+	if _, _, err := chain.OnResponseHeaders(sc, requestHeaders(":status", "200")); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if sc.IsChatHasException {
+		t.Fatal("Expected 200 response not to be flagged")
+	}
+
+	trailers := &extprocv3.HttpTrailers{Trailers: requestHeaders("grpc-status", "8", "grpc-message", "quota exceeded").GetHeaders()}
+	resp, endStream, err := chain.OnTrailers(sc, processor.DirectionResponse, trailers)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if endStream {
+		t.Error("Expected trailers not to end the stream early")
+	}
+	if resp.GetResponseTrailers() == nil {
+		t.Errorf("Expected a response trailers response, got %v", resp)
+	}
+	if !sc.IsChatHasException {
+		t.Error("Expected non-OK grpc-status to flag the chat as failed")
+	}
+	if sc.Record.GrpcStatus != "8" || sc.Record.GrpcMessage != "quota exceeded" {
+		t.Errorf("Expected grpc status to be recorded, got %q %q", sc.Record.GrpcStatus, sc.Record.GrpcMessage)
+	}
+}
+
+// TestRulesHandler_SendsModeOverride tests that a rule's mode reaches Envoy and the state machine follows it
+func TestRulesHandler_SendsModeOverride(t *testing.T) {
+	cfg, err := config.Parse([]byte(`
+rules:
+  - name: skip-response-headers
+    match: {}
+    action:
+      mode: {response_headers: skip}
+`), ".yaml")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	chain := processor.NewChain(&processor.RulesHandler{})
+	sc := processor.NewStreamContext(context.Background(), cfg)
+
+	resp, _, err := chain.OnRequestHeaders(sc, requestHeaders(":authority", "api2.cursor.sh", ":path", "/"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if resp.GetModeOverride() == nil {
+		t.Fatal("Expected mode_override in the request headers response")
+	}
+	if _, _, err := chain.OnResponseBody(sc, &extprocv3.HttpBody{}); err != nil {
+		t.Errorf("Expected response body to be accepted with response headers skipped, got: %v", err)
+	}
+}
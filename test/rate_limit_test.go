@@ -0,0 +1,208 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"nursor-envoy-rpc/config"
+	"nursor-envoy-rpc/models"
+	"nursor-envoy-rpc/processor"
+	"nursor-envoy-rpc/service"
+	"testing"
+	"time"
+
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+type stubLimiter struct {
+	decision service.RateDecision
+	err      error
+	keys     []string
+	limit    int
+	window   time.Duration
+	refunded []string
+}
+
+func (l *stubLimiter) Allow(ctx context.Context, key string, limit int, window time.Duration) (service.RateDecision, error) {
+	l.keys = append(l.keys, key)
+	l.limit, l.window = limit, window
+	return l.decision, l.err
+}
+
+func (l *stubLimiter) Refund(ctx context.Context, key, member string) error {
+	l.refunded = append(l.refunded, key+"/"+member)
+	return nil
+}
+
+const rateLimitRules = `
+rate_limit:
+  limits:
+    default:
+      chat: {requests: 30, window: 1m}
+    Free:
+      chat: {requests: 5, window: 1m}
+      completion: {requests: 100, window: 10s}
+`
+
+func rateLimitedStream(t *testing.T, membership models.MembershipType, path string) *processor.StreamContext {
+	t.Helper()
+	cfg, err := config.Parse([]byte(rateLimitRules), ".yaml")
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	sc := processor.NewStreamContext(context.Background(), cfg)
+	sc.User = &models.User{ID: 7, MembershipType: membership}
+	sc.IsChatRequest = path == "/aiserver.v1.ChatService/StreamUnifiedChatWithTools"
+	sc.RequestHeaders[":path"] = path
+	sc.RequestHeaders["content-type"] = "application/connect+proto"
+	return sc
+}
+
+// TestRateLimit_ConfigLookup tests that limits fall back to the default membership per path class
+func TestRateLimit_ConfigLookup(t *testing.T) {
+	cfg, err := config.Parse([]byte(rateLimitRules), ".yaml")
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	if l := cfg.RateLimitFor("Free", config.PathClassChat); l == nil || l.Requests != 5 {
+		t.Errorf("Expected Free chat limit of 5, got %+v", l)
+	}
+	if l := cfg.RateLimitFor("Premium", config.PathClassChat); l == nil || l.Requests != 30 || l.WindowDuration() != time.Minute {
+		t.Errorf("Expected default chat limit of 30/1m, got %+v", l)
+	}
+	if l := cfg.RateLimitFor("Premium", config.PathClassOther); l != nil {
+		t.Errorf("Expected no limit for other requests, got %+v", l)
+	}
+
+	for _, invalid := range []string{
+		"rate_limit: {limits: {Free: {search: {requests: 1, window: 1m}}}}",
+		"rate_limit: {limits: {Free: {chat: {requests: 1, window: soon}}}}",
+		"rate_limit: {limits: {Free: {chat: {requests: -1}}}}",
+	} {
+		if _, err := config.Parse([]byte(invalid), ".yaml"); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+// TestRateLimit_PathClass tests that chat, completion and other requests are told apart
+func TestRateLimit_PathClass(t *testing.T) {
+	cases := map[string]string{
+		"/aiserver.v1.ChatService/StreamUnifiedChatWithTools": config.PathClassChat,
+		"/aiserver.v1.AiService/StreamCpp":                    config.PathClassCompletion,
+		"/aiserver.v1.DashboardService/GetTeams":              config.PathClassOther,
+	}
+	for path, want := range cases {
+		if got := processor.PathClass(rateLimitedStream(t, models.MembershipTypeFree, path)); got != want {
+			t.Errorf("Expected class %s for %s, got %s", want, path, got)
+		}
+	}
+}
+
+// TestRateLimit_AllowsUnderLimit tests that allowed requests continue with the membership's limit
+func TestRateLimit_AllowsUnderLimit(t *testing.T) {
+	limiter := &stubLimiter{decision: service.RateDecision{Allowed: true, Remaining: 4}}
+	h := &processor.RateLimitHandler{Limiter: limiter}
+	sc := rateLimitedStream(t, models.MembershipTypeFree, "/aiserver.v1.AiService/StreamCpp")
+
+	res, err := h.OnRequestHeaders(sc, nil)
+	if err != nil || res != nil {
+		t.Fatalf("Expected the request to continue, got %+v, %v", res, err)
+	}
+	if len(limiter.keys) != 1 || limiter.keys[0] != "7:completion" {
+		t.Errorf("Expected key 7:completion, got %v", limiter.keys)
+	}
+	if limiter.limit != 100 || limiter.window != 10*time.Second {
+		t.Errorf("Expected 100 per 10s, got %d per %s", limiter.limit, limiter.window)
+	}
+}
+
+// TestRateLimit_RejectsOverLimit tests that refused requests get a 429 style error with retry-after
+func TestRateLimit_RejectsOverLimit(t *testing.T) {
+	limiter := &stubLimiter{decision: service.RateDecision{RetryAfter: 1500 * time.Millisecond}}
+	h := &processor.RateLimitHandler{Limiter: limiter}
+	sc := rateLimitedStream(t, models.MembershipTypeFree, "/aiserver.v1.ChatService/StreamUnifiedChatWithTools")
+
+	res, err := h.OnRequestHeaders(sc, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if res == nil || res.ImmediateResponse == nil {
+		t.Fatal("Expected an immediate response")
+	}
+	if res.ImmediateResponse.Details != "resource_exhausted" {
+		t.Errorf("Expected details resource_exhausted, got %q", res.ImmediateResponse.Details)
+	}
+	var retryAfter string
+	for _, h := range res.ImmediateResponse.Headers.GetSetHeaders() {
+		if h.Header.Key == "retry-after" {
+			retryAfter = string(h.Header.RawValue)
+		}
+	}
+	if retryAfter != "2" {
+		t.Errorf("Expected retry-after 2, got %q", retryAfter)
+	}
+}
+
+// TestRateLimit_PlainHTTPStatus tests that plain HTTP clients see status 429
+func TestRateLimit_PlainHTTPStatus(t *testing.T) {
+	h := &processor.RateLimitHandler{Limiter: &stubLimiter{decision: service.RateDecision{RetryAfter: time.Second}}}
+	sc := rateLimitedStream(t, models.MembershipTypeFree, "/aiserver.v1.ChatService/StreamUnifiedChatWithTools")
+	sc.RequestHeaders["content-type"] = "application/json"
+
+	res, _ := h.OnRequestHeaders(sc, nil)
+	if res == nil || res.ImmediateResponse.GetStatus().GetCode() != 429 {
+		t.Errorf("Expected status 429, got %+v", res)
+	}
+}
+
+// TestRateLimit_FailsOpen tests that requests are allowed when the limiter errors or no limit applies
+func TestRateLimit_FailsOpen(t *testing.T) {
+	limiter := &stubLimiter{err: errors.New("redis down")}
+	h := &processor.RateLimitHandler{Limiter: limiter}
+
+	sc := rateLimitedStream(t, models.MembershipTypeFree, "/aiserver.v1.ChatService/StreamUnifiedChatWithTools")
+	if res, err := h.OnRequestHeaders(sc, nil); res != nil || err != nil {
+		t.Errorf("Expected the request to continue on limiter errors, got %+v, %v", res, err)
+	}
+
+	sc = rateLimitedStream(t, models.MembershipTypePremium, "/aiserver.v1.DashboardService/GetTeams")
+	h.OnRequestHeaders(sc, nil)
+	if len(limiter.keys) != 1 {
+		t.Errorf("Expected unlimited classes to skip the limiter, got keys %v", limiter.keys)
+	}
+}
+
+// TestRateLimit_RefundWhenLaterHandlerRejects tests that a request rejected after the rate limit does not use up quota
+func TestRateLimit_RefundWhenLaterHandlerRejects(t *testing.T) {
+	const path = "/aiserver.v1.AiService/StreamCpp"
+	rejection := processor.Immediate(&extprocv3.ImmediateResponse{Details: "too_many_streams"})
+	cases := []struct {
+		name     string
+		result   *processor.Result
+		err      error
+		refunded bool
+	}{
+		{"passed", nil, nil, false},
+		{"rejected", rejection, nil, true},
+		// 账号分配失败时同时返回立即响应和错误
+		{"rejected with error", rejection, errors.New("no account available"), true},
+		// 没有立即响应的错误可能被 failure_mode_allow 放行到上游，不退还
+		{"error only", nil, errors.New("handler failed"), false},
+	}
+	for _, c := range cases {
+		limiter := &stubLimiter{decision: service.RateDecision{Allowed: true, Member: "m1"}}
+		later := &stubHandler{name: "stream_limit", result: c.result, err: c.err}
+		chain := processor.NewChain(&processor.RateLimitHandler{Limiter: limiter}, later)
+
+		sc := rateLimitedStream(t, models.MembershipTypeFree, path)
+		chain.OnRequestHeaders(sc, requestHeaders(":path", path, "content-type", "application/connect+proto"))
+		sc.Cleanup()
+
+		switch {
+		case c.refunded && (len(limiter.refunded) != 1 || limiter.refunded[0] != "7:completion/m1"):
+			t.Errorf("%s: expected the request to be refunded, got %v", c.name, limiter.refunded)
+		case !c.refunded && len(limiter.refunded) != 0:
+			t.Errorf("%s: expected no refund, got %v", c.name, limiter.refunded)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"nursor-envoy-rpc/processor"
+	"nursor-envoy-rpc/service"
+	"nursor-envoy-rpc/utils"
+	"strings"
+	"testing"
+)
+
+// TestRequestID_ReusesEnvoyHeader tests that the x-request-id from Envoy becomes the stream's request ID
+func TestRequestID_ReusesEnvoyHeader(t *testing.T) {
+	buf := captureJSONLog(t)
+
+	chain := processor.NewChain()
+	sc := processor.NewStreamContext(context.Background(), nil)
+	chain.OnRequestHeaders(sc, requestHeaders(":path", "/x", "X-Request-Id", "abc-123"))
+
+	if sc.RequestID != "abc-123" {
+		t.Errorf("Expected request ID abc-123, got %q", sc.RequestID)
+	}
+	if sc.Record.RequestId != "abc-123" {
+		t.Errorf("Expected the record to carry the request ID, got %q", sc.Record.RequestId)
+	}
+	if got := utils.RequestIDFrom(sc.Detach(context.Background())); got != "abc-123" {
+		t.Errorf("Expected the detached context to carry the request ID, got %q", got)
+	}
+
+	sc.Log().Info("hello")
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("Expected one JSON line, got %q: %v", buf.String(), err)
+	}
+	if line["request_id"] != "abc-123" {
+		t.Errorf("Expected request_id field, got %v", line)
+	}
+}
+
+// TestRequestID_GeneratedWhenMissingOrInvalid tests that a UUID is generated when the header is absent or unusable
+func TestRequestID_GeneratedWhenMissingOrInvalid(t *testing.T) {
+	chain := processor.NewChain()
+	for _, headers := range [][]string{
+		{":path", "/x"},
+		{":path", "/x", "x-request-id", "has space"},
+		{":path", "/x", "x-request-id", strings.Repeat("a", 200)},
+	} {
+		sc := processor.NewStreamContext(context.Background(), nil)
+		chain.OnRequestHeaders(sc, requestHeaders(headers...))
+		if len(sc.RequestID) != 36 {
+			t.Errorf("Expected a generated UUID for %v, got %q", headers, sc.RequestID)
+		}
+	}
+}
+
+// TestRequestID_SentToAccountManager tests that account manager calls carry the x-request-id header
+func TestRequestID_SentToAccountManager(t *testing.T) {
+	var got string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("x-request-id")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	ds := &service.DispatchService{}
+	ds.InitializeForTest(server.URL + "/")
+	ctx := utils.WithRequestID(context.Background(), "abc-123")
+	if err := ds.IncrTokenUsage(ctx, 1); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if got != "abc-123" {
+		t.Errorf("Expected x-request-id abc-123, got %q", got)
+	}
+}
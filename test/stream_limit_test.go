@@ -0,0 +1,157 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"nursor-envoy-rpc/config"
+	"nursor-envoy-rpc/models"
+	"nursor-envoy-rpc/processor"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memorySlots is an in-memory service.StreamSlots without expiry.
+type memorySlots struct {
+	mu     sync.Mutex
+	held   map[string]map[string]bool
+	renews int
+	err    error
+}
+
+func newMemorySlots() *memorySlots {
+	return &memorySlots{held: map[string]map[string]bool{}}
+}
+
+func (s *memorySlots) Acquire(ctx context.Context, key, member string, max int, ttl time.Duration) (bool, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return false, 0, s.err
+	}
+	if s.held[key] == nil {
+		s.held[key] = map[string]bool{}
+	}
+	if len(s.held[key]) >= max {
+		return false, len(s.held[key]), nil
+	}
+	s.held[key][member] = true
+	return true, len(s.held[key]), nil
+}
+
+func (s *memorySlots) Renew(ctx context.Context, key, member string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.renews++
+	return nil
+}
+
+func (s *memorySlots) Release(ctx context.Context, key, member string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.held[key], member)
+	return nil
+}
+
+func (s *memorySlots) count(key string) (held, renews int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.held[key]), s.renews
+}
+
+const streamLimitRules = `
+rate_limit:
+  max_streams: {default: 4, Free: 1}
+  stream_lease: 30ms
+`
+
+func streamLimitedStream(t *testing.T, membership models.MembershipType) *processor.StreamContext {
+	t.Helper()
+	cfg, err := config.Parse([]byte(streamLimitRules), ".yaml")
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	sc := processor.NewStreamContext(context.Background(), cfg)
+	sc.User = &models.User{ID: 9, MembershipType: membership}
+	sc.RequestHeaders["content-type"] = "application/json"
+	return sc
+}
+
+// TestStreamLimit_ConfigLookup tests per-membership caps, the default fallback and the lease
+func TestStreamLimit_ConfigLookup(t *testing.T) {
+	cfg, err := config.Parse([]byte(streamLimitRules), ".yaml")
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	if got := cfg.MaxStreamsFor("Free"); got != 1 {
+		t.Errorf("Expected 1 stream for Free, got %d", got)
+	}
+	if got := cfg.MaxStreamsFor("Premium"); got != 4 {
+		t.Errorf("Expected the default of 4 streams, got %d", got)
+	}
+	if got := cfg.StreamLeaseTTL(); got != 30*time.Millisecond {
+		t.Errorf("Expected a 30ms lease, got %s", got)
+	}
+	if _, err := config.Parse([]byte("rate_limit: {stream_lease: forever}"), ".yaml"); err == nil {
+		t.Error("Expected an invalid stream_lease to be rejected")
+	}
+}
+
+// TestStreamLimit_RejectsOverCap tests that a stream beyond the cap is answered with the limit
+func TestStreamLimit_RejectsOverCap(t *testing.T) {
+	slots := newMemorySlots()
+	h := &processor.StreamLimitHandler{Slots: slots}
+
+	first := streamLimitedStream(t, models.MembershipTypeFree)
+	defer first.Cleanup()
+	if res, err := h.OnRequestHeaders(first, nil); res != nil || err != nil {
+		t.Fatalf("Expected the first stream to continue, got %+v, %v", res, err)
+	}
+
+	second := streamLimitedStream(t, models.MembershipTypeFree)
+	res, err := h.OnRequestHeaders(second, nil)
+	if err != nil || res == nil || res.ImmediateResponse == nil {
+		t.Fatalf("Expected an immediate response, got %+v, %v", res, err)
+	}
+	if res.ImmediateResponse.GetStatus().GetCode() != 429 {
+		t.Errorf("Expected status 429, got %v", res.ImmediateResponse.GetStatus().GetCode())
+	}
+	if !strings.Contains(res.ImmediateResponse.Body, "at most 1 at a time") {
+		t.Errorf("Expected the body to state the limit, got %q", res.ImmediateResponse.Body)
+	}
+}
+
+// TestStreamLimit_CleanupReleasesSlot tests that the lease is renewed while open and released at the end
+func TestStreamLimit_CleanupReleasesSlot(t *testing.T) {
+	slots := newMemorySlots()
+	h := &processor.StreamLimitHandler{Slots: slots}
+
+	sc := streamLimitedStream(t, models.MembershipTypeFree)
+	h.OnRequestHeaders(sc, nil)
+	time.Sleep(50 * time.Millisecond)
+	if held, renews := slots.count("9"); held != 1 || renews == 0 {
+		t.Errorf("Expected one renewed slot, got %d held and %d renewals", held, renews)
+	}
+
+	sc.Cleanup()
+	if held, _ := slots.count("9"); held != 0 {
+		t.Errorf("Expected the slot to be released, got %d held", held)
+	}
+	next := streamLimitedStream(t, models.MembershipTypeFree)
+	defer next.Cleanup()
+	if res, _ := h.OnRequestHeaders(next, nil); res != nil {
+		t.Errorf("Expected a new stream to get the released slot, got %+v", res)
+	}
+}
+
+// TestStreamLimit_FailsOpen tests that streams are allowed when the slot store errors
+func TestStreamLimit_FailsOpen(t *testing.T) {
+	slots := newMemorySlots()
+	slots.err = errors.New("redis down")
+	h := &processor.StreamLimitHandler{Slots: slots}
+
+	if res, err := h.OnRequestHeaders(streamLimitedStream(t, models.MembershipTypeFree), nil); res != nil || err != nil {
+		t.Errorf("Expected the stream to continue, got %+v, %v", res, err)
+	}
+}
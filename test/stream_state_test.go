@@ -0,0 +1,100 @@
+package test
+
+import (
+	"context"
+	"nursor-envoy-rpc/models/nursor"
+	"nursor-envoy-rpc/processor"
+	"testing"
+
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestStreamState_AcceptsLegalOrder tests a full request/response exchange including interleaved bodies
+func TestStreamState_AcceptsLegalOrder(t *testing.T) {
+	state := processor.NewStreamState(nursor.NewRequestRecord())
+	var observed []processor.Phase
+	state.OnTransition = func(from, to processor.Phase) {
+		observed = append(observed, to)
+	}
+
+	phases := []processor.Phase{
+		processor.PhaseRequestHeaders,
+		processor.PhaseRequestBody,
+		processor.PhaseResponseHeaders,
+		processor.PhaseRequestBody,
+		processor.PhaseResponseBody,
+		processor.PhaseResponseBody,
+		processor.PhaseResponseTrailers,
+	}
+	for _, p := range phases {
+		if err := state.Advance(p); err != nil {
+			t.Fatalf("Expected %s to be accepted, got: %v", p, err)
+		}
+	}
+	if len(observed) != len(phases) || len(state.Transitions()) != len(phases) {
+		t.Errorf("Expected %d transitions, got %d observed and %d recorded", len(phases), len(observed), len(state.Transitions()))
+	}
+	if state.Phase() != processor.PhaseResponseTrailers {
+		t.Errorf("Expected phase response_trailers, got %s", state.Phase())
+	}
+}
+
+// TestStreamState_RejectsOutOfOrder tests that illegal orderings fail with FailedPrecondition
+func TestStreamState_RejectsOutOfOrder(t *testing.T) {
+	cases := map[string][]processor.Phase{
+		"body before headers":          {processor.PhaseRequestBody},
+		"response before request":      {processor.PhaseResponseHeaders},
+		"duplicate request headers":    {processor.PhaseRequestHeaders, processor.PhaseRequestHeaders},
+		"response body before headers": {processor.PhaseRequestHeaders, processor.PhaseResponseBody},
+		"body after trailers":          {processor.PhaseRequestHeaders, processor.PhaseRequestTrailers, processor.PhaseRequestBody},
+	}
+	for name, phases := range cases {
+		state := processor.NewStreamState(nursor.NewRequestRecord())
+		var err error
+		for _, p := range phases {
+			if err = state.Advance(p); err != nil {
+				break
+			}
+		}
+		if status.Code(err) != codes.FailedPrecondition {
+			t.Errorf("%s: expected FailedPrecondition, got %v", name, err)
+		}
+	}
+}
+
+// TestStreamState_ClosedRejectsMessages tests that nothing is accepted after close
+func TestStreamState_ClosedRejectsMessages(t *testing.T) {
+	state := processor.NewStreamState(nursor.NewRequestRecord())
+	state.Advance(processor.PhaseRequestHeaders)
+	state.Close(processor.CloseImmediate)
+	state.Close(processor.CloseClientEOF)
+
+	if state.CloseReason() != processor.CloseImmediate {
+		t.Errorf("Expected first close reason to be kept, got %s", state.CloseReason())
+	}
+	if err := state.Advance(processor.PhaseRequestBody); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Expected FailedPrecondition after close, got %v", err)
+	}
+}
+
+// TestChain_RejectsBodyBeforeHeaders tests that the chain never runs handlers for out-of-order messages
+func TestChain_RejectsBodyBeforeHeaders(t *testing.T) {
+	chain := processor.NewChain(&processor.RecordHandler{})
+	sc := processor.NewStreamContext(context.Background(), nil)
+
+	resp, endStream, err := chain.OnRequestBody(sc, &extprocv3.HttpBody{Body: []byte("x")})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("Expected FailedPrecondition, got %v", err)
+	}
+	if resp != nil || !endStream {
+		t.Errorf("Expected no response and end of stream, got %v, %v", resp, endStream)
+	}
+	if sc.Record.RequestBody.Len() != 0 {
+		t.Error("Expected body not to be recorded")
+	}
+	if sc.CloseReason() != processor.CloseOutOfOrder {
+		t.Errorf("Expected close reason out_of_order, got %s", sc.CloseReason())
+	}
+}
@@ -0,0 +1,425 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"nursor-envoy-rpc/models"
+	"nursor-envoy-rpc/service"
+	"nursor-envoy-rpc/utils"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"gorm.io/gorm"
+)
+
+var tokenHashKey = []byte(strings.Repeat("k", 32))
+
+// TestTokenHash_KeyedHash tests that hashes are stable per key and reveal nothing of the token
+func TestTokenHash_KeyedHash(t *testing.T) {
+	hasher, err := service.NewTokenHasher(tokenHashKey, "")
+	if err != nil {
+		t.Fatalf("Failed to create hasher: %v", err)
+	}
+	other, _ := service.NewTokenHasher([]byte(strings.Repeat("x", 32)), "")
+
+	hash := hasher.Hash("secret-token")
+	if len(hash) != 64 || strings.Contains(hash, "secret-token") {
+		t.Errorf("Expected a 64 character hex hash, got %q", hash)
+	}
+	if hasher.Hash("secret-token") != hash {
+		t.Error("Expected the same token to hash the same")
+	}
+	if other.Hash("secret-token") == hash {
+		t.Error("Expected a different key to give a different hash")
+	}
+	if hasher.Hash("secret-tokem") == hash {
+		t.Error("Expected a different token to give a different hash")
+	}
+}
+
+// TestTokenHash_Modes tests the default mode and what each mode keys caches by
+func TestTokenHash_Modes(t *testing.T) {
+	plain, err := service.NewTokenHasher(nil, "")
+	if err != nil || plain.Mode() != service.TokenLookupPlain {
+		t.Fatalf("Expected plain mode without a key, got %v, %v", plain, err)
+	}
+	if plain.CacheKey("secret-token") != "secret-token" || plain.HasKey() {
+		t.Error("Expected plain mode to key caches by the raw token")
+	}
+
+	dual, err := service.NewTokenHasher(tokenHashKey, "")
+	if err != nil || dual.Mode() != service.TokenLookupDual {
+		t.Fatalf("Expected dual mode with a key, got %v, %v", dual, err)
+	}
+	if dual.CacheKey("secret-token") != dual.Hash("secret-token") {
+		t.Error("Expected dual mode to key caches by hash")
+	}
+
+	keyed, err := service.NewTokenHasher(tokenHashKey, service.TokenLookupPlain)
+	if err != nil || keyed.Hashed() || !keyed.HasKey() {
+		t.Errorf("Expected plain mode with a key for backfilling, got %v, %v", keyed, err)
+	}
+}
+
+// TestTokenHash_InvalidSettings tests that unusable keys and modes are rejected
+func TestTokenHash_InvalidSettings(t *testing.T) {
+	cases := []struct {
+		key  []byte
+		mode string
+	}{
+		{[]byte("short"), ""},
+		{nil, service.TokenLookupHash},
+		{nil, service.TokenLookupDual},
+		{tokenHashKey, "sha1"},
+	}
+	for _, c := range cases {
+		if _, err := service.NewTokenHasher(c.key, c.mode); err == nil {
+			t.Errorf("Expected key of %d bytes with mode %q to be rejected", len(c.key), c.mode)
+		}
+	}
+
+	t.Setenv("INNER_TOKEN_HMAC_KEY", string(tokenHashKey))
+	t.Setenv("INNER_TOKEN_LOOKUP", service.TokenLookupHash)
+	hasher, err := service.TokenHasherFromEnv()
+	if err != nil || hasher.Mode() != service.TokenLookupHash {
+		t.Errorf("Expected hash mode from the environment, got %v, %v", hasher, err)
+	}
+}
+
+// fakeUserStore is an in-memory user_user table.
+type fakeUserStore struct {
+	mu           sync.Mutex
+	users        map[int]*models.User
+	noHashColumn bool
+}
+
+func newFakeUserStore(users ...*models.User) *fakeUserStore {
+	s := &fakeUserStore{users: map[int]*models.User{}}
+	for _, u := range users {
+		u.IsActive = true
+		s.users[u.ID] = u
+	}
+	return s
+}
+
+func (s *fakeUserStore) ids() []int {
+	ids := make([]int, 0, len(s.users))
+	for id := range s.users {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func (s *fakeUserStore) hashOf(id int) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h := s.users[id].InnerTokenHash; h != nil {
+		return *h
+	}
+	return ""
+}
+
+func (s *fakeUserStore) FindUser(ctx context.Context, column, value string) (*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range s.ids() {
+		u := s.users[id]
+		switch {
+		case column == "inner_token" && u.InnerToken == value,
+			column == "inner_token_hash" && u.InnerTokenHash != nil && *u.InnerTokenHash == value:
+			found := *u
+			return &found, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (s *fakeUserStore) TokenOf(ctx context.Context, id int, withHash bool) (service.UserToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok {
+		return service.UserToken{}, nil
+	}
+	row := service.UserToken{ID: u.ID, InnerToken: u.InnerToken}
+	if withHash {
+		row.InnerTokenHash = u.InnerTokenHash
+	}
+	return row, nil
+}
+
+func (s *fakeUserStore) Tokens(ctx context.Context, afterID, limit int) ([]service.UserToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var rows []service.UserToken
+	for _, id := range s.ids() {
+		u := s.users[id]
+		if id > afterID && u.InnerToken != "" && len(rows) < limit {
+			rows = append(rows, service.UserToken{ID: u.ID, InnerToken: u.InnerToken, InnerTokenHash: u.InnerTokenHash})
+		}
+	}
+	return rows, nil
+}
+
+func (s *fakeUserStore) SetTokenHash(ctx context.Context, id int, token, hash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok || u.InnerToken != token || (u.InnerTokenHash != nil && *u.InnerTokenHash == hash) {
+		return false, nil
+	}
+	u.InnerTokenHash = &hash
+	return true, nil
+}
+
+func (s *fakeUserStore) HasTokenHashColumn(ctx context.Context) bool {
+	return !s.noHashColumn
+}
+
+func (s *fakeUserStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// fakeUserRedis keeps the keys and messages the UserService writes to Redis.
+// Commands it does not implement panic through the nil embedded client.
+type fakeUserRedis struct {
+	redis.UniversalClient
+	mu        sync.Mutex
+	values    map[string]string
+	published []string
+}
+
+func newFakeUserRedis() *fakeUserRedis {
+	return &fakeUserRedis{values: map[string]string{}}
+}
+
+func (r *fakeUserRedis) Get(ctx context.Context, key string) *redis.StringCmd {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	value, ok := r.values[key]
+	if !ok {
+		return redis.NewStringResult("", redis.Nil)
+	}
+	return redis.NewStringResult(value, nil)
+}
+
+func (r *fakeUserRedis) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.values[key] = fmt.Sprintf("%s", value)
+	return redis.NewStatusResult("OK", nil)
+}
+
+func (r *fakeUserRedis) Del(ctx context.Context, keys ...string) *redis.IntCmd {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var n int64
+	for _, key := range keys {
+		if _, ok := r.values[key]; ok {
+			delete(r.values, key)
+			n++
+		}
+	}
+	return redis.NewIntResult(n, nil)
+}
+
+func (r *fakeUserRedis) Publish(ctx context.Context, channel string, message interface{}) *redis.IntCmd {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.published = append(r.published, fmt.Sprintf("%s", message))
+	return redis.NewIntResult(1, nil)
+}
+
+func (r *fakeUserRedis) keys() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	keys := make([]string, 0, len(r.values))
+	for key := range r.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func dualUserService(t *testing.T, store *fakeUserStore) (*service.UserService, *fakeUserRedis, *service.TokenHasher) {
+	t.Helper()
+	return hashingUserService(t, store, service.TokenLookupDual)
+}
+
+func hashingUserService(t *testing.T, store *fakeUserStore, mode string) (*service.UserService, *fakeUserRedis, *service.TokenHasher) {
+	t.Helper()
+	hasher, err := service.NewTokenHasher(tokenHashKey, mode)
+	if err != nil {
+		t.Fatalf("Failed to create hasher: %v", err)
+	}
+	cache := newFakeUserRedis()
+	return service.NewUserService(store, cache, hasher), cache, hasher
+}
+
+func hashPtr(hash string) *string {
+	return &hash
+}
+
+// TestTokenHash_DualLookupFillsMissingHash tests that dual mode finds users without a hash by the plaintext column and stores their hash
+func TestTokenHash_DualLookupFillsMissingHash(t *testing.T) {
+	store := newFakeUserStore(&models.User{ID: 1, InnerToken: "tok-1"})
+	us, _, hasher := dualUserService(t, store)
+
+	user, err := us.GetUserByInnerToken(context.Background(), "tok-1")
+	if err != nil || user.ID != 1 {
+		t.Fatalf("Expected user 1 through the plaintext fallback, got %v, %v", user, err)
+	}
+	if got := store.hashOf(1); got != hasher.Hash("tok-1") {
+		t.Errorf("Expected the missing hash to be written back, got %q", got)
+	}
+}
+
+// TestTokenHash_DualLookupRejectsStaleHash tests that a hash left over from a rotated token no longer logs in and is fixed
+func TestTokenHash_DualLookupRejectsStaleHash(t *testing.T) {
+	store := newFakeUserStore(&models.User{ID: 1, InnerToken: "tok-new"})
+	us, _, hasher := dualUserService(t, store)
+	store.users[1].InnerTokenHash = hashPtr(hasher.Hash("tok-old"))
+
+	if _, err := us.GetUserByInnerToken(context.Background(), "tok-old"); !errors.Is(err, utils.ErrUserNotFound) {
+		t.Errorf("Expected the rotated token to be unknown, got %v", err)
+	}
+	if got := store.hashOf(1); got != hasher.Hash("tok-new") {
+		t.Errorf("Expected the stale hash to be replaced by the current token's, got %q", got)
+	}
+	if user, err := us.GetUserByInnerToken(context.Background(), "tok-new"); err != nil || user.ID != 1 {
+		t.Errorf("Expected the current token to find user 1, got %v, %v", user, err)
+	}
+}
+
+// TestTokenHash_HashLookupRejectsStaleHash tests that hash mode neither falls back to the plaintext column nor accepts a hash left over from a rotated token
+func TestTokenHash_HashLookupRejectsStaleHash(t *testing.T) {
+	store := newFakeUserStore(
+		&models.User{ID: 1, InnerToken: "tok-new"},
+		&models.User{ID: 2, InnerToken: "tok-2"},
+		&models.User{ID: 3},
+	)
+	us, _, hasher := hashingUserService(t, store, service.TokenLookupHash)
+	store.users[1].InnerTokenHash = hashPtr(hasher.Hash("tok-old"))
+	store.users[3].InnerTokenHash = hashPtr(hasher.Hash("tok-3"))
+	ctx := context.Background()
+
+	if _, err := us.GetUserByInnerToken(ctx, "tok-old"); !errors.Is(err, utils.ErrUserNotFound) {
+		t.Errorf("Expected the rotated token to be unknown, got %v", err)
+	}
+	if got := store.hashOf(1); got != hasher.Hash("tok-new") {
+		t.Errorf("Expected the stale hash to be replaced by the current token's, got %q", got)
+	}
+	if user, err := us.GetUserByInnerToken(ctx, "tok-new"); err != nil || user.ID != 1 {
+		t.Errorf("Expected the current token to find user 1 by its fixed hash, got %v, %v", user, err)
+	}
+	if _, err := us.GetUserByInnerToken(ctx, "tok-2"); !errors.Is(err, utils.ErrUserNotFound) {
+		t.Errorf("Expected no plaintext fallback for a user without a hash, got %v", err)
+	}
+	// 明文列清空后只能按哈希匹配
+	if user, err := us.GetUserByInnerToken(ctx, "tok-3"); err != nil || user.ID != 3 {
+		t.Errorf("Expected user 3 by hash after the plaintext column was cleared, got %v, %v", user, err)
+	}
+}
+
+// TestTokenHash_CachedByHash tests that Redis entries are keyed by the tokenhash prefix and hold no plaintext token
+func TestTokenHash_CachedByHash(t *testing.T) {
+	store := newFakeUserStore(&models.User{ID: 1, InnerToken: "tok-1"})
+	us, cache, hasher := dualUserService(t, store)
+
+	if _, err := us.GetUserByInnerToken(context.Background(), "tok-1"); err != nil {
+		t.Fatalf("Failed to look up user: %v", err)
+	}
+	key := "nursor-rpc:user_cache:tokenhash:" + hasher.Hash("tok-1")
+	if keys := cache.keys(); len(keys) != 1 || keys[0] != key {
+		t.Fatalf("Expected only %s to be cached, got %v", key, keys)
+	}
+	raw := cache.values[key]
+	if strings.Contains(raw, "tok-1") {
+		t.Errorf("Expected the cached JSON to hold no plaintext token, got %s", raw)
+	}
+	var cached models.User
+	if err := json.Unmarshal([]byte(raw), &cached); err != nil || cached.ID != 1 || cached.InnerToken != "" {
+		t.Errorf("Expected user 1 cached without inner_token, got %+v, %v", cached, err)
+	}
+}
+
+// TestTokenHash_InvalidateUserPublishesHash tests that invalidations only carry the token hash, never the token
+func TestTokenHash_InvalidateUserPublishesHash(t *testing.T) {
+	store := newFakeUserStore(&models.User{ID: 1, InnerToken: "tok-1"})
+	us, cache, hasher := dualUserService(t, store)
+	ctx := context.Background()
+	if _, err := us.GetUserByInnerToken(ctx, "tok-1"); err != nil {
+		t.Fatalf("Failed to look up user: %v", err)
+	}
+
+	for _, inv := range []service.UserInvalidation{{UserID: 1}, {Token: "tok-1"}} {
+		if err := us.InvalidateUser(ctx, inv); err != nil {
+			t.Fatalf("Failed to invalidate %+v: %v", inv, err)
+		}
+	}
+	if len(cache.published) != 2 {
+		t.Fatalf("Expected 2 published invalidations, got %v", cache.published)
+	}
+	for _, payload := range cache.published {
+		if strings.Contains(payload, "tok-1") {
+			t.Errorf("Expected no plaintext token in %s", payload)
+		}
+		inv, err := service.ParseUserInvalidation(payload)
+		if err != nil || inv.Token != "" || inv.TokenHash != hasher.Hash("tok-1") {
+			t.Errorf("Expected only the token hash in %s, got %+v, %v", payload, inv, err)
+		}
+	}
+	if keys := cache.keys(); len(keys) != 0 {
+		t.Errorf("Expected the cached user to be deleted, got %v", keys)
+	}
+}
+
+// TestTokenHash_BackfillIsRerunnable tests that the backfill fixes missing and stale hashes once and then changes nothing
+func TestTokenHash_BackfillIsRerunnable(t *testing.T) {
+	store := newFakeUserStore(
+		&models.User{ID: 1, InnerToken: "tok-1"},
+		&models.User{ID: 2, InnerToken: "tok-2"},
+		&models.User{ID: 3, InnerToken: "tok-3"},
+		&models.User{ID: 4},
+	)
+	us, _, hasher := dualUserService(t, store)
+	store.users[2].InnerTokenHash = hashPtr(hasher.Hash("tok-old"))
+	store.users[3].InnerTokenHash = hashPtr(hasher.Hash("tok-3"))
+	ctx := context.Background()
+
+	if n, err := us.BackfillTokenHashes(ctx, 2); err != nil || n != 2 {
+		t.Fatalf("Expected 2 rows backfilled, got %d, %v", n, err)
+	}
+	for id, token := range map[int]string{1: "tok-1", 2: "tok-2", 3: "tok-3"} {
+		if got := store.hashOf(id); got != hasher.Hash(token) {
+			t.Errorf("Expected user %d to have the hash of %s, got %q", id, token, got)
+		}
+	}
+	if store.hashOf(4) != "" {
+		t.Error("Expected users without a token to be left alone")
+	}
+	if n, err := us.BackfillTokenHashes(ctx, 2); err != nil || n != 0 {
+		t.Errorf("Expected a second run to change nothing, got %d, %v", n, err)
+	}
+}
+
+// TestTokenHash_BackfillNeedsColumn tests that the backfill refuses to run before the column exists
+func TestTokenHash_BackfillNeedsColumn(t *testing.T) {
+	store := newFakeUserStore(&models.User{ID: 1, InnerToken: "tok-1"})
+	store.noHashColumn = true
+	us, _, _ := dualUserService(t, store)
+
+	if _, err := us.BackfillTokenHashes(context.Background(), 10); !errors.Is(err, service.ErrTokenHashColumnMissing) {
+		t.Errorf("Expected ErrTokenHashColumnMissing, got %v", err)
+	}
+	if store.hashOf(1) != "" {
+		t.Error("Expected nothing to be written")
+	}
+}
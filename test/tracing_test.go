@@ -0,0 +1,90 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"nursor-envoy-rpc/processor"
+	"nursor-envoy-rpc/service"
+	"nursor-envoy-rpc/tracing"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	if _, err := tracing.Init(context.Background()); err != nil {
+		t.Fatalf("Failed to init tracing: %v", err)
+	}
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return recorder
+}
+
+// TestTracing_StreamContinuesTraceparent tests that the stream span joins the client's trace
+func TestTracing_StreamContinuesTraceparent(t *testing.T) {
+	recorder := recordSpans(t)
+
+	chain := processor.NewChain()
+	sc := processor.NewStreamContext(context.Background(), nil)
+	chain.OnRequestHeaders(sc, requestHeaders(":authority", "api2.cursor.sh", "traceparent", testTraceparent))
+	sc.Close(processor.CloseClientEOF)
+	sc.EndTrace()
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("Expected 1 span, got %d", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "ext_proc.Process" {
+		t.Errorf("Unexpected span name %q", span.Name())
+	}
+	if span.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Expected the client's trace ID, got %s", span.SpanContext().TraceID())
+	}
+	if span.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("Expected the client's span as parent, got %s", span.Parent().SpanID())
+	}
+}
+
+// TestTracing_AccountManagerReceivesTraceContext tests that account manager calls carry the stream's trace
+func TestTracing_AccountManagerReceivesTraceContext(t *testing.T) {
+	recorder := recordSpans(t)
+
+	var received string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get("traceparent")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(service.AcquireAccountResponse{})
+	}))
+	defer server.Close()
+
+	chain := processor.NewChain()
+	sc := processor.NewStreamContext(context.Background(), nil)
+	chain.OnRequestHeaders(sc, requestHeaders("traceparent", testTraceparent))
+
+	ds := &service.DispatchService{}
+	ds.InitializeForTest(server.URL + "/")
+	ds.GetAccountByUserId(sc.Ctx, 1)
+	sc.EndTrace()
+
+	if !strings.Contains(received, "4bf92f3577b34da6a3ce929d0e0e4736") {
+		t.Errorf("Expected traceparent with the client's trace ID, got %q", received)
+	}
+	var names []string
+	for _, span := range recorder.Ended() {
+		names = append(names, span.Name())
+	}
+	if len(names) != 2 || names[0] != "account_manager acquire" {
+		t.Errorf("Expected account manager span then stream span, got %v", names)
+	}
+}
@@ -0,0 +1,133 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"nursor-envoy-rpc/models"
+	"nursor-envoy-rpc/service"
+	"nursor-envoy-rpc/utils"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func fixedTTL(d time.Duration) func(*models.User) time.Duration {
+	return func(*models.User) time.Duration { return d }
+}
+
+// TestUserCache_EvictsLeastRecentlyUsed tests that the cache keeps the most recently used tokens
+func TestUserCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	cache := service.NewLocalUserCache(2, time.Minute)
+	cache.Set("a", &models.User{ID: 1}, 0)
+	cache.Set("b", &models.User{ID: 2}, 0)
+	cache.Get("a")
+	cache.Set("c", &models.User{ID: 3}, 0)
+
+	if _, _, ok := cache.Get("b"); ok {
+		t.Error("Expected b to be evicted")
+	}
+	if user, _, ok := cache.Get("a"); !ok || user.ID != 1 {
+		t.Errorf("Expected a to stay cached, got %v, %v", user, ok)
+	}
+	if cache.Len() != 2 {
+		t.Errorf("Expected 2 entries, got %d", cache.Len())
+	}
+}
+
+// TestUserCache_Expiry tests that entries expire after the shorter of the cache and entry TTL
+func TestUserCache_Expiry(t *testing.T) {
+	cache := service.NewLocalUserCache(10, time.Minute)
+	cache.Set("short", &models.User{ID: 1}, 10*time.Millisecond)
+	cache.Set("long", &models.User{ID: 2}, time.Hour)
+	time.Sleep(20 * time.Millisecond)
+
+	if _, _, ok := cache.Get("short"); ok {
+		t.Error("Expected the short entry to expire")
+	}
+	if _, _, ok := cache.Get("long"); !ok {
+		t.Error("Expected the long entry to be capped at the cache TTL, not dropped")
+	}
+}
+
+// TestUserCache_LookupDeduplicates tests that concurrent lookups of one token share a single load
+func TestUserCache_LookupDeduplicates(t *testing.T) {
+	cache := service.NewLocalUserCache(10, time.Minute)
+	var loads atomic.Int32
+	release := make(chan struct{})
+	load := func(ctx context.Context) (*models.User, error) {
+		loads.Add(1)
+		<-release
+		return &models.User{ID: 7}, nil
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			user, _, err := cache.Lookup(context.Background(), "token", load, fixedTTL(time.Minute))
+			if err != nil || user.ID != 7 {
+				errs <- fmt.Errorf("got %v, %v", user, err)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if n := loads.Load(); n != 1 {
+		t.Errorf("Expected 1 load, got %d", n)
+	}
+
+	_, local, _ := cache.Lookup(context.Background(), "token", load, fixedTTL(time.Minute))
+	if !local || loads.Load() != 1 {
+		t.Errorf("Expected the next lookup to be answered locally, local=%v loads=%d", local, loads.Load())
+	}
+}
+
+// TestUserCache_LookupCachesUnknownOnly tests that unknown tokens are cached but other errors are not
+func TestUserCache_LookupCachesUnknownOnly(t *testing.T) {
+	cache := service.NewLocalUserCache(10, time.Minute)
+	var loads atomic.Int32
+
+	unknown := func(ctx context.Context) (*models.User, error) {
+		loads.Add(1)
+		return nil, fmt.Errorf("%w: no row", utils.ErrUserNotFound)
+	}
+	for i := 0; i < 3; i++ {
+		if _, _, err := cache.Lookup(context.Background(), "guess", unknown, fixedTTL(time.Minute)); !errors.Is(err, utils.ErrUserNotFound) {
+			t.Fatalf("Expected ErrUserNotFound, got %v", err)
+		}
+	}
+	if n := loads.Load(); n != 1 {
+		t.Errorf("Expected the unknown token to be loaded once, got %d", n)
+	}
+
+	loads.Store(0)
+	failing := func(ctx context.Context) (*models.User, error) {
+		loads.Add(1)
+		return nil, errors.New("database down")
+	}
+	cache.Lookup(context.Background(), "token", failing, fixedTTL(time.Minute))
+	cache.Lookup(context.Background(), "token", failing, fixedTTL(time.Minute))
+	if n := loads.Load(); n != 2 {
+		t.Errorf("Expected failures not to be cached, got %d loads", n)
+	}
+}
+
+// TestUserCache_ReturnsCopies tests that callers cannot change the cached user
+func TestUserCache_ReturnsCopies(t *testing.T) {
+	cache := service.NewLocalUserCache(10, time.Minute)
+	cache.Set("token", &models.User{ID: 1, Name: "alice"}, 0)
+	user, _, _ := cache.Get("token")
+	user.Name = "mallory"
+	if again, _, _ := cache.Get("token"); again.Name != "alice" {
+		t.Errorf("Expected the cached user to be unchanged, got %q", again.Name)
+	}
+}
@@ -0,0 +1,178 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"nursor-envoy-rpc/admin"
+	"nursor-envoy-rpc/models"
+	"nursor-envoy-rpc/service"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestUserInvalidation_Parse tests the accepted message formats on the invalidation channel
+func TestUserInvalidation_Parse(t *testing.T) {
+	cases := map[string]service.UserInvalidation{
+		`42`:                             {UserID: 42},
+		`{"user_id": 42}`:                {UserID: 42},
+		`{"token": "abc"}`:               {Token: "abc"},
+		`{"user_id": 7, "token": "abc"}`: {UserID: 7, Token: "abc"},
+	}
+	for payload, want := range cases {
+		got, err := service.ParseUserInvalidation(payload)
+		if err != nil || got != want {
+			t.Errorf("Expected %+v for %s, got %+v, %v", want, payload, got, err)
+		}
+	}
+	for _, payload := range []string{``, `{}`, `0`, `user 42`, `{"user_id": "42"}`} {
+		if _, err := service.ParseUserInvalidation(payload); err == nil {
+			t.Errorf("Expected %q to be rejected", payload)
+		}
+	}
+}
+
+// TestUserInvalidation_EvictsByUserID tests that every token cached for a user can be found and dropped
+func TestUserInvalidation_EvictsByUserID(t *testing.T) {
+	cache := service.NewLocalUserCache(10, time.Minute)
+	cache.Set("old", &models.User{ID: 1}, 0)
+	cache.Set("new", &models.User{ID: 1}, 0)
+	cache.Set("other", &models.User{ID: 2}, 0)
+	cache.Set("guess", nil, 0)
+
+	tokens := cache.TokensOf(1)
+	sort.Strings(tokens)
+	if strings.Join(tokens, ",") != "new,old" {
+		t.Errorf("Expected tokens new, old, got %v", tokens)
+	}
+	cache.DeleteUser(1)
+	if cache.Len() != 2 {
+		t.Errorf("Expected only other and guess to stay, got %d entries", cache.Len())
+	}
+	if _, _, ok := cache.Get("other"); !ok {
+		t.Error("Expected other users to stay cached")
+	}
+
+	cache.Purge()
+	if cache.Len() != 0 {
+		t.Errorf("Expected an empty cache after purge, got %d entries", cache.Len())
+	}
+}
+
+// TestUserInvalidation_InFlightLoadNotCached tests that a load started before an eviction does not refill the cache
+func TestUserInvalidation_InFlightLoadNotCached(t *testing.T) {
+	cache := service.NewLocalUserCache(10, time.Minute)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cache.Lookup(context.Background(), "token", func(ctx context.Context) (*models.User, error) {
+			close(started)
+			<-release
+			return &models.User{ID: 1, IsActive: true}, nil
+		}, fixedTTL(time.Minute))
+	}()
+	<-started
+	cache.DeleteUser(1)
+	close(release)
+	<-done
+
+	if _, _, ok := cache.Get("token"); ok {
+		t.Error("Expected the stale load not to be cached")
+	}
+}
+
+const testInvalidateSecret = "s3cret"
+
+func adminPost(h http.Handler, target, body string) *httptest.ResponseRecorder {
+	return adminPostWithSecret(h, target, body, testInvalidateSecret)
+}
+
+func adminPostWithSecret(h http.Handler, target, body, secret string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", target, strings.NewReader(body))
+	if secret != "" {
+		req.Header.Set(admin.InvalidateSecretHeader, secret)
+	}
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// TestUserInvalidation_AdminEndpoint tests that the admin endpoint publishes what the request names
+func TestUserInvalidation_AdminEndpoint(t *testing.T) {
+	var published []service.UserInvalidation
+	var publishErr error
+	h := admin.InvalidateUserHandler(testInvalidateSecret, func(ctx context.Context, inv service.UserInvalidation) error {
+		published = append(published, inv)
+		return publishErr
+	})
+
+	if rec := adminPost(h, "/users/invalidate", `{"user_id": 42}`); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 for a JSON body, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := adminPost(h, "/users/invalidate", `{"token": "abc"}`); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 for a token in the body, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := adminPost(h, "/users/invalidate?user_id=7", ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 for a query parameter, got %d: %s", rec.Code, rec.Body)
+	}
+	if len(published) != 3 || published[0].UserID != 42 || published[1].Token != "abc" || published[2].UserID != 7 {
+		t.Errorf("Expected user 42, token abc and user 7 to be published, got %+v", published)
+	}
+
+	if rec := adminPost(h, "/users/invalidate?token=abc", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a token in the query, got %d", rec.Code)
+	}
+
+	if rec := adminGet(t, h, "/users/invalidate?user_id=42"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for GET, got %d", rec.Code)
+	}
+	for _, body := range []string{"", "{}", "{"} {
+		if rec := adminPost(h, "/users/invalidate", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for body %q, got %d", body, rec.Code)
+		}
+	}
+	if rec := adminPost(h, "/users/invalidate?user_id=x", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid user_id, got %d", rec.Code)
+	}
+
+	if len(published) != 3 {
+		t.Errorf("Expected rejected requests not to publish, got %+v", published)
+	}
+
+	publishErr = errors.New("redis down")
+	if rec := adminPost(h, "/users/invalidate?user_id=1", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 when publishing fails, got %d", rec.Code)
+	}
+}
+
+// TestUserInvalidation_AdminEndpointSecret tests that the admin endpoint refuses requests without the shared secret
+func TestUserInvalidation_AdminEndpointSecret(t *testing.T) {
+	published := 0
+	publish := func(ctx context.Context, inv service.UserInvalidation) error {
+		published++
+		return nil
+	}
+
+	h := admin.InvalidateUserHandler(testInvalidateSecret, publish)
+	if rec := adminPostWithSecret(h, "/users/invalidate", `{"user_id": 42}`, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without the secret header, got %d", rec.Code)
+	}
+	if rec := adminPostWithSecret(h, "/users/invalidate", `{"user_id": 42}`, "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a wrong secret, got %d", rec.Code)
+	}
+
+	disabled := admin.InvalidateUserHandler("", publish)
+	for _, secret := range []string{"", testInvalidateSecret} {
+		if rec := adminPostWithSecret(disabled, "/users/invalidate", `{"user_id": 42}`, secret); rec.Code != http.StatusForbidden {
+			t.Errorf("Expected 403 without a configured secret, got %d", rec.Code)
+		}
+	}
+	if published != 0 {
+		t.Errorf("Expected nothing to be published, got %d", published)
+	}
+}
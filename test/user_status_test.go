@@ -0,0 +1,75 @@
+package test
+
+import (
+	"errors"
+	"nursor-envoy-rpc/models"
+	"nursor-envoy-rpc/service"
+	"nursor-envoy-rpc/utils"
+	"testing"
+	"time"
+)
+
+// TestUserStatus_Check tests that inactive and expired users are rejected with distinct errors
+func TestUserStatus_Check(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	past := now.Add(-time.Hour)
+	future := now.Add(time.Hour)
+
+	cases := []struct {
+		name  string
+		user  models.User
+		grace time.Duration
+		want  error
+	}{
+		{"active without expiry", models.User{ID: 1, IsActive: true}, 0, nil},
+		{"active before expiry", models.User{ID: 1, IsActive: true, ExpiredAt: &future}, 0, nil},
+		{"inactive", models.User{ID: 1, IsActive: false, ExpiredAt: &future}, 0, utils.ErrUserInactive},
+		{"expired", models.User{ID: 1, IsActive: true, ExpiredAt: &past}, 0, utils.ErrUserExpired},
+		{"expired within grace", models.User{ID: 1, IsActive: true, ExpiredAt: &past}, 2 * time.Hour, nil},
+		{"expired after grace", models.User{ID: 1, IsActive: true, ExpiredAt: &past}, 30 * time.Minute, utils.ErrUserExpired},
+	}
+	for _, c := range cases {
+		err := service.CheckUserStatus(&c.user, now, c.grace)
+		if c.want == nil && err != nil || c.want != nil && !errors.Is(err, c.want) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.want, err)
+		}
+	}
+}
+
+// TestUserStatus_ClientResponses tests that inactive and expired users get different messages
+func TestUserStatus_ClientResponses(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	inactive, _ := utils.ClientErrorFor(service.CheckUserStatus(&models.User{ID: 1}, time.Now(), 0))
+	expired, _ := utils.ClientErrorFor(service.CheckUserStatus(&models.User{ID: 1, IsActive: true, ExpiredAt: &past}, time.Now(), 0))
+
+	if inactive.Code != utils.CodePermissionDenied || expired.Code != utils.CodePermissionDenied {
+		t.Errorf("Expected permission_denied for both, got %s and %s", inactive.Code, expired.Code)
+	}
+	if inactive.Message == expired.Message {
+		t.Errorf("Expected distinct messages, got %q for both", inactive.Message)
+	}
+}
+
+// TestUserStatus_CacheTTL tests that users are never cached past their expiry
+func TestUserStatus_CacheTTL(t *testing.T) {
+	now := time.Now()
+	soon := now.Add(time.Minute)
+	later := now.Add(time.Hour)
+	past := now.Add(-time.Hour)
+
+	if got := service.UserCacheTTL(&models.User{IsActive: true}, now, 0); got != 5*time.Minute {
+		t.Errorf("Expected 5m for users without expiry, got %s", got)
+	}
+	if got := service.UserCacheTTL(&models.User{IsActive: true, ExpiredAt: &later}, now, 0); got != 5*time.Minute {
+		t.Errorf("Expected 5m for users expiring later, got %s", got)
+	}
+	if got := service.UserCacheTTL(&models.User{IsActive: true, ExpiredAt: &soon}, now, 0); got != time.Minute {
+		t.Errorf("Expected 1m for users expiring in a minute, got %s", got)
+	}
+	if got := service.UserCacheTTL(&models.User{IsActive: true, ExpiredAt: &soon}, now, 2*time.Minute); got != 3*time.Minute {
+		t.Errorf("Expected the grace period to extend the TTL to 3m, got %s", got)
+	}
+	if got := service.UserCacheTTL(&models.User{IsActive: true, ExpiredAt: &past}, now, 0); got > 30*time.Second {
+		t.Errorf("Expected expired users to be cached briefly, got %s", got)
+	}
+}
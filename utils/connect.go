@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	v32 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/grpc/codes"
+)
+
+// ConnectCode is a Connect protocol error code.
+type ConnectCode string
+
+const (
+	CodeInvalidArgument    ConnectCode = "invalid_argument"
+	CodeNotFound           ConnectCode = "not_found"
+	CodePermissionDenied   ConnectCode = "permission_denied"
+	CodeResourceExhausted  ConnectCode = "resource_exhausted"
+	CodeFailedPrecondition ConnectCode = "failed_precondition"
+	CodeInternal           ConnectCode = "internal"
+	CodeUnavailable        ConnectCode = "unavailable"
+	CodeUnauthenticated    ConnectCode = "unauthenticated"
+)
+
+// connectHTTPStatus is the Connect spec's code -> HTTP status mapping for
+// unary responses.
+var connectHTTPStatus = map[ConnectCode]int{
+	CodeInvalidArgument:    400,
+	CodeNotFound:           404,
+	CodePermissionDenied:   403,
+	CodeResourceExhausted:  429,
+	CodeFailedPrecondition: 400,
+	CodeInternal:           500,
+	CodeUnavailable:        503,
+	CodeUnauthenticated:    401,
+}
+
+var connectGrpcCode = map[ConnectCode]codes.Code{
+	CodeInvalidArgument:    codes.InvalidArgument,
+	CodeNotFound:           codes.NotFound,
+	CodePermissionDenied:   codes.PermissionDenied,
+	CodeResourceExhausted:  codes.ResourceExhausted,
+	CodeFailedPrecondition: codes.FailedPrecondition,
+	CodeInternal:           codes.Internal,
+	CodeUnavailable:        codes.Unavailable,
+	CodeUnauthenticated:    codes.Unauthenticated,
+}
+
+// ErrorDetail is one entry of a Connect error's details: a fully-qualified
+// protobuf type name and the base64 encoded message.
+type ErrorDetail struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// ClientError is an error as the client should see it.
+type ClientError struct {
+	// HTTPStatus is used for plain HTTP and unary Connect clients.
+	HTTPStatus int
+	Code       ConnectCode
+	Message    string
+	Details    []ErrorDetail
+	// Headers are extra response headers, e.g. retry-after.
+	Headers map[string]string
+}
+
+type connectError struct {
+	Code    ConnectCode   `json:"code"`
+	Message string        `json:"message,omitempty"`
+	Details []ErrorDetail `json:"details,omitempty"`
+}
+
+// connectEndStreamFlag marks the end-of-stream message of a Connect stream.
+const connectEndStreamFlag = 0x02
+
+// BuildErrorResponse encodes e the way a client sending contentType
+// expects it:
+//   - application/connect+* (Connect streaming): HTTP 200 with a single
+//     end-of-stream frame carrying the error;
+//   - application/grpc*: HTTP 200 with grpc-status/grpc-message;
+//   - application/proto or application/json (Connect unary): the mapped
+//     HTTP status with a JSON error envelope;
+//   - anything else: the HTTP status with a plain-text body.
+func BuildErrorResponse(contentType string, e ClientError) *extprocv3.ProcessingResponse {
+	contentType = strings.ToLower(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+	envelope := connectError{Code: e.Code, Message: e.Message, Details: e.Details}
+
+	var resp *extprocv3.ImmediateResponse
+	switch {
+	case strings.HasPrefix(contentType, "application/connect+"):
+		endStream, _ := json.Marshal(struct {
+			Error connectError `json:"error"`
+		}{envelope})
+		frame := make([]byte, 5, 5+len(endStream))
+		frame[0] = connectEndStreamFlag
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(endStream)))
+		frame = append(frame, endStream...)
+		resp = immediate(200, contentType, string(frame))
+	case strings.HasPrefix(contentType, "application/grpc"):
+		resp = immediate(200, contentType, e.Message)
+		resp.GrpcStatus = &extprocv3.GrpcStatus{Status: uint32(connectGrpcCode[e.Code])}
+	case contentType == "application/proto" || contentType == "application/json":
+		body, _ := json.Marshal(envelope)
+		resp = immediate(e.status(), "application/json", string(body))
+	default:
+		resp = immediate(e.status(), "text/plain", e.Message)
+	}
+	for key, value := range e.Headers {
+		resp.Headers.SetHeaders = append(resp.Headers.SetHeaders, headerOption(key, value))
+	}
+	resp.Details = string(e.Code)
+
+	return &extprocv3.ProcessingResponse{
+		Response: &extprocv3.ProcessingResponse_ImmediateResponse{
+			ImmediateResponse: resp,
+		},
+	}
+}
+
+func (e ClientError) status() int {
+	if e.HTTPStatus != 0 {
+		return e.HTTPStatus
+	}
+	if status, ok := connectHTTPStatus[e.Code]; ok {
+		return status
+	}
+	return 500
+}
+
+func immediate(status int, contentType, body string) *extprocv3.ImmediateResponse {
+	return &extprocv3.ImmediateResponse{
+		Status: &v32.HttpStatus{
+			Code: v32.StatusCode(status),
+		},
+		Body: body,
+		Headers: &extprocv3.HeaderMutation{
+			SetHeaders: []*corev3.HeaderValueOption{
+				headerOption("Content-Type", contentType),
+			},
+		},
+	}
+}
+
+func headerOption(key, value string) *corev3.HeaderValueOption {
+	return &corev3.HeaderValueOption{
+		Header: &corev3.HeaderValue{
+			Key:      key,
+			RawValue: []byte(value),
+		},
+	}
+}
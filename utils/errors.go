@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Errors the services return for conditions the client should be told
+// about. Wrap them with %w so the original cause stays in the logs; the
+// client response is picked from the error table in exceptions_service.go.
+var (
+	ErrUserNotFound              = errors.New("user not found")
+	ErrUserInactive              = errors.New("user inactive")
+	ErrUserExpired               = errors.New("user subscription expired")
+	ErrNoAccountAvailable        = errors.New("no account available")
+	ErrAccountManagerUnavailable = errors.New("account manager unavailable")
+	ErrUserServiceUnavailable    = errors.New("user service unavailable")
+	ErrQuotaExceeded             = errors.New("quota exceeded")
+	ErrRateLimited               = errors.New("rate limited")
+	ErrTooManyStreams            = errors.New("too many concurrent streams")
+	ErrAuthLocked                = errors.New("too many failed authentication attempts")
+)
+
+// RateLimitError is returned when a user exceeds a rate limit. It unwraps
+// to ErrRateLimited.
+type RateLimitError struct {
+	Class      string
+	Limit      int
+	Window     time.Duration
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limit of %d %s requests per %s exceeded, retry after %s", e.Limit, e.Class, e.Window, e.RetryAfter)
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return ErrRateLimited
+}
+
+// StreamLimitError is returned when a user already holds as many streams as
+// allowed. It unwraps to ErrTooManyStreams.
+type StreamLimitError struct {
+	Limit int
+	Held  int
+}
+
+func (e *StreamLimitError) Error() string {
+	return fmt.Sprintf("%d of %d concurrent streams already open", e.Held, e.Limit)
+}
+
+func (e *StreamLimitError) Unwrap() error {
+	return ErrTooManyStreams
+}
+
+// RetryAfterSeconds returns RetryAfter as sent in the retry-after header.
+func (e *RateLimitError) RetryAfterSeconds() int {
+	return retryAfterSeconds(e.RetryAfter)
+}
+
+// AuthLockedError is returned while a client is locked out after too many
+// unknown tokens. It unwraps to ErrAuthLocked.
+type AuthLockedError struct {
+	ClientIP   string
+	RetryAfter time.Duration
+}
+
+func (e *AuthLockedError) Error() string {
+	return fmt.Sprintf("client %s locked out for %s after failed authentications", e.ClientIP, e.RetryAfter)
+}
+
+func (e *AuthLockedError) Unwrap() error {
+	return ErrAuthLocked
+}
+
+// RetryAfterSeconds returns RetryAfter as sent in the retry-after header.
+func (e *AuthLockedError) RetryAfterSeconds() int {
+	return retryAfterSeconds(e.RetryAfter)
+}
+
+// retryAfterSeconds rounds d up to whole seconds, at least 1.
+func retryAfterSeconds(d time.Duration) int {
+	seconds := int((d + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
+
+// AccountManagerError is an error answer from the account manager. It
+// unwraps to the sentinel matching its status code.
+type AccountManagerError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *AccountManagerError) Error() string {
+	if e.Code == "" && e.Message == "" {
+		return fmt.Sprintf("account manager returned status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("account manager error (status %d): %s - %s", e.StatusCode, e.Code, e.Message)
+}
+
+func (e *AccountManagerError) Unwrap() error {
+	switch {
+	case e.StatusCode == http.StatusPaymentRequired:
+		return ErrQuotaExceeded
+	case e.StatusCode >= 500:
+		return ErrAccountManagerUnavailable
+	default:
+		// The manager answers other 4xx when it has nothing to hand out.
+		return ErrNoAccountAvailable
+	}
+}
@@ -1,83 +1,75 @@
 package utils
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"nursor-envoy-rpc/logger"
+	"strconv"
 
-	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
-	v32 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
 	"github.com/sirupsen/logrus"
-	"gorm.io/gorm"
 )
 
-func GetResponseForErr(err error) *extprocv3.ProcessingResponse {
-	if errors.Is(err, gorm.ErrRecordNotFound) {
-		return &extprocv3.ProcessingResponse{
-			Response: &extprocv3.ProcessingResponse_ImmediateResponse{
-				ImmediateResponse: &extprocv3.ImmediateResponse{
-					Status: &v32.HttpStatus{
-						Code: v32.StatusCode_Unauthorized,
-					},
-					Body: "Invalid token: access denied",
-					Headers: &extprocv3.HeaderMutation{
-						SetHeaders: []*corev3.HeaderValueOption{
-							{
-								Header: &corev3.HeaderValue{
-									Key:      "Content-Type",
-									RawValue: []byte("text/plain"),
-								},
-							},
-						},
-					},
-				},
-			},
-		}
+type errorMapping struct {
+	target error
+	level  logrus.Level
+	client ClientError
+}
 
-	}
-	logrus.Error(err)
-	return &extprocv3.ProcessingResponse{
-		Response: &extprocv3.ProcessingResponse_ImmediateResponse{
-			ImmediateResponse: &extprocv3.ImmediateResponse{
-				Status: &v32.HttpStatus{
-					Code: v32.StatusCode_Unauthorized,
-				},
-				Body: "Invalid token: access denied",
-				Headers: &extprocv3.HeaderMutation{
-					SetHeaders: []*corev3.HeaderValueOption{
-						{
-							Header: &corev3.HeaderValue{
-								Key:      "Content-Type",
-								RawValue: []byte("text/plain"),
-							},
-						},
-					},
-				},
-			},
-		},
-	}
+// errorTable maps service errors to what the client sees and how loudly we
+// log them. The first entry err matches wins.
+var errorTable = []errorMapping{
+	{ErrUserNotFound, logrus.InfoLevel, ClientError{HTTPStatus: 401, Code: CodeUnauthenticated, Message: "Invalid token: access denied"}},
+	{ErrUserInactive, logrus.InfoLevel, ClientError{HTTPStatus: 403, Code: CodePermissionDenied, Message: "Account disabled"}},
+	{ErrUserExpired, logrus.InfoLevel, ClientError{HTTPStatus: 403, Code: CodePermissionDenied, Message: "Subscription expired"}},
+	{ErrAuthLocked, logrus.WarnLevel, ClientError{HTTPStatus: 429, Code: CodeResourceExhausted, Message: "Too many failed authentication attempts, please retry later"}},
+	{ErrRateLimited, logrus.InfoLevel, ClientError{HTTPStatus: 429, Code: CodeResourceExhausted, Message: "Too many requests, please retry later"}},
+	{ErrTooManyStreams, logrus.InfoLevel, ClientError{HTTPStatus: 429, Code: CodeResourceExhausted, Message: "Too many concurrent requests, please wait for one to finish"}},
+	{ErrQuotaExceeded, logrus.InfoLevel, ClientError{HTTPStatus: 402, Code: CodeResourceExhausted, Message: "Subscription expired or usage limit reached"}},
+	{ErrNoAccountAvailable, logrus.WarnLevel, ClientError{HTTPStatus: 503, Code: CodeUnavailable, Message: "No account available, please retry later"}},
+	{ErrAccountManagerUnavailable, logrus.ErrorLevel, ClientError{HTTPStatus: 503, Code: CodeUnavailable, Message: "Service temporarily unavailable"}},
+	{ErrUserServiceUnavailable, logrus.ErrorLevel, ClientError{HTTPStatus: 503, Code: CodeUnavailable, Message: "Service temporarily unavailable"}},
+}
 
+var unknownError = errorMapping{
+	level:  logrus.ErrorLevel,
+	client: ClientError{HTTPStatus: 500, Code: CodeInternal, Message: "Internal error"},
 }
 
-func GetResponseForExpireError() *extprocv3.ProcessingResponse {
-	return &extprocv3.ProcessingResponse{
-		Response: &extprocv3.ProcessingResponse_ImmediateResponse{
-			ImmediateResponse: &extprocv3.ImmediateResponse{
-				Status: &v32.HttpStatus{
-					Code: v32.StatusCode_Unauthorized,
-				},
-				Body: "Token Expired",
-				Headers: &extprocv3.HeaderMutation{
-					SetHeaders: []*corev3.HeaderValueOption{
-						{
-							Header: &corev3.HeaderValue{
-								Key:      "Content-Type",
-								RawValue: []byte("text/plain"),
-							},
-						},
-					},
-				},
-			},
-		},
+// ClientErrorFor returns the client-facing error for err and the level it
+// should be logged at. Messages sent by the account manager are passed on
+// as is, they are written for end users; errors with a RetryAfterSeconds
+// method add retry-after and stream limit errors state the limit.
+func ClientErrorFor(err error) (ClientError, logrus.Level) {
+	m := unknownError
+	for _, candidate := range errorTable {
+		if errors.Is(err, candidate.target) {
+			m = candidate
+			break
+		}
+	}
+	client := m.client
+	var managerErr *AccountManagerError
+	if errors.As(err, &managerErr) && managerErr.Message != "" {
+		client.Message = managerErr.Message
+	}
+	var retryErr interface{ RetryAfterSeconds() int }
+	if errors.As(err, &retryErr) {
+		client.Headers = map[string]string{"retry-after": strconv.Itoa(retryErr.RetryAfterSeconds())}
 	}
+	var streamErr *StreamLimitError
+	if errors.As(err, &streamErr) {
+		client.Message = fmt.Sprintf("Too many concurrent requests: at most %d at a time, please wait for one to finish", streamErr.Limit)
+	}
+	return client, m.level
+}
 
+// GetResponseForErr logs err with the fields of ctx and builds the
+// immediate response for it, encoded for a client that sent contentType
+// (see BuildErrorResponse).
+func GetResponseForErr(ctx context.Context, err error, contentType string) *extprocv3.ProcessingResponse {
+	client, level := ClientErrorFor(err)
+	logger.FromContext(ctx).WithField("code", client.Code).Log(level, err)
+	return BuildErrorResponse(contentType, client)
 }
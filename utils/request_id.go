@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+)
+
+// RequestIDHeader carries the request ID from Envoy and to the account
+// manager.
+const RequestIDHeader = "x-request-id"
+
+// maxRequestIDLength bounds IDs taken from the client, since they end up in
+// logs, records and outgoing headers.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// WithRequestID returns ctx carrying the request ID id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFrom returns the request ID carried by ctx, or "".
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// RequestIDOrNew returns id if it is usable as a request ID (non-empty,
+// printable ASCII, at most 128 bytes), otherwise a new UUID.
+func RequestIDOrNew(id string) string {
+	if id == "" || len(id) > maxRequestIDLength {
+		return uuid.NewString()
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return uuid.NewString()
+		}
+	}
+	return id
+}